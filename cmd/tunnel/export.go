@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"cdr.dev/slog/sloggers/sloghuman"
+	"github.com/coder/wgtunnel/internal/cliconfig"
+	"github.com/coder/wgtunnel/internal/keyfile"
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+var exportConfigCommand = &cli.Command{
+	Name:  "export-config",
+	Usage: "Register with the server and print a wg-quick config for running the tunnel on a kernel wireguard interface. The server forwards tunnel traffic to port 8090 on the interface address. Flags for the tunnel must be passed before the command, e.g. `tunnel --api-url https://tunnel.example.com export-config`.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Write the config to this file instead of stdout. The file contains the private key and is only readable by the current user.",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-registered",
+			Usage: "Keep re-registering with the server until interrupted, so the server keeps routing traffic to the interface. If the registration changes, e.g. because the server rotated its key, the config is written again and the interface must be updated with `wg syncconf`.",
+		},
+	},
+	Action: exportConfig,
+}
+
+func exportConfig(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), ctx.App.Flags)
+	if err != nil {
+		return err
+	}
+
+	var (
+		verbose        = ctx.Bool("verbose")
+		apiURL         = ctx.String("api-url")
+		output         = ctx.String("output")
+		keepRegistered = ctx.Bool("keep-registered")
+	)
+	if apiURL == "" {
+		return xerrors.New("api-url is required. See --help for more information.")
+	}
+	apiURLParsed, err := url.Parse(apiURL)
+	if err != nil {
+		return xerrors.Errorf("failed to parse api-url %q: %w", apiURL, err)
+	}
+
+	logger := slog.Make(sloghuman.Sink(os.Stderr)).Leveled(slog.LevelInfo)
+	if verbose {
+		logger = logger.Leveled(slog.LevelDebug)
+	}
+
+	key, err := loadKey(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	client := tunnelsdk.New(apiURLParsed)
+	cfg := tunnelsdk.TunnelConfig{
+		Log:        logger,
+		PrivateKey: key,
+	}
+	res, err := client.Register(ctx.Context, cfg)
+	if err != nil {
+		return xerrors.Errorf("register: %w", err)
+	}
+	err = writeWireguardConfig(ctx, output, res, key)
+	if err != nil {
+		return err
+	}
+	if !keepRegistered {
+		return nil
+	}
+
+	_, _ = fmt.Fprintln(os.Stderr, "Keeping the client registered. You can connect to one of the following URLs once the interface is up:")
+	for _, u := range res.TunnelURLs {
+		_, _ = fmt.Fprintln(os.Stderr, "  -", u)
+	}
+
+	notifyCtx, notifyStop := signal.NotifyContext(ctx.Context, InterruptSignals...)
+	defer notifyStop()
+	// KeepRegistered only returns once interrupted.
+	_ = client.KeepRegistered(notifyCtx, cfg, res, func(res tunnelsdk.ClientRegisterResponse, changes []string) {
+		log := logger.With(slog.F("changes", changes))
+		if output == "" {
+			log.Warn(notifyCtx, "server registration changed, export the config again and update the interface")
+			return
+		}
+		err := writeWireguardConfig(ctx, output, res, key)
+		if err != nil {
+			log.Error(notifyCtx, "server registration changed, but writing the config failed", slog.Error(err))
+			return
+		}
+		log.Warn(notifyCtx, "server registration changed and the config was written again, update the interface with `wg syncconf`", slog.F("path", output))
+	})
+	return nil
+}
+
+// writeWireguardConfig writes the wg-quick config for a registration to path,
+// or to stdout if path is empty.
+func writeWireguardConfig(ctx *cli.Context, path string, res tunnelsdk.ClientRegisterResponse, key tunnelsdk.Key) error {
+	config, err := res.WireguardConfig(key)
+	if err != nil {
+		return xerrors.Errorf("create wireguard config: %w", err)
+	}
+	if path == "" {
+		_, err = fmt.Fprint(ctx.App.Writer, config)
+		return err
+	}
+	err = keyfile.Write(path, []byte(config))
+	if err != nil {
+		return xerrors.Errorf("write wireguard config to %q: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+// forwardTCP accepts connections from the tunnel and splices them to the
+// target address. It returns when the tunnel listener is closed.
+func forwardTCP(ctx context.Context, logger slog.Logger, tunnel *tunnelsdk.Tunnel, targetAddress string) {
+	for {
+		conn, err := tunnel.Listener.Accept()
+		if err != nil {
+			// The listener is closed when the tunnel is shutting down.
+			if !xerrors.Is(err, net.ErrClosed) {
+				logger.Error(ctx, "close tunnel", slog.Error(err))
+				_ = tunnel.Close()
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+			defer dialCancel()
+
+			targetConn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", targetAddress)
+			if err != nil {
+				logger.Warn(ctx, "could not dial target", slog.F("target_address", targetAddress), slog.Error(err))
+				return
+			}
+			defer targetConn.Close()
+
+			go func() {
+				_, err := io.Copy(targetConn, conn)
+				if err != nil && !xerrors.Is(err, io.EOF) {
+					logger.Warn(ctx, "could not copy from tunnel to target", slog.Error(err))
+				}
+			}()
+
+			_, err = io.Copy(conn, targetConn)
+			if err != nil && !xerrors.Is(err, io.EOF) {
+				logger.Warn(ctx, "could not copy from target to tunnel", slog.Error(err))
+			}
+		}()
+	}
+}
+
+const (
+	hostHeaderPreserve = "preserve"
+	hostHeaderRewrite  = "rewrite"
+)
+
+type httpForwarderOptions struct {
+	// Target is the http:// or https:// URL requests are forwarded to.
+	Target *url.URL
+	// HostHeader is either hostHeaderPreserve, hostHeaderRewrite or a literal
+	// value for the Host header sent to the target.
+	HostHeader string
+	// PublicScheme is the scheme of the tunnel URL, used for the
+	// X-Forwarded-Proto header.
+	PublicScheme string
+	// InsecureSkipVerify disables TLS certificate verification for https://
+	// targets.
+	InsecureSkipVerify bool
+}
+
+// newHTTPForwarder returns a handler that proxies HTTP requests received from
+// the tunnel to the target URL.
+func newHTTPForwarder(logger slog.Logger, opts httpForwarderOptions) http.Handler {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.InsecureSkipVerify {
+		//nolint:gosec // This is explicitly requested by the user for local
+		// self-signed certificates.
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(opts.Target)
+
+			// Requests from tunneld already carry the real client IP in
+			// X-Forwarded-For, so append to it rather than replacing it.
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
+			if opts.PublicScheme != "" {
+				pr.Out.Header.Set("X-Forwarded-Proto", opts.PublicScheme)
+			}
+
+			var host string
+			switch opts.HostHeader {
+			case "", hostHeaderPreserve:
+				pr.Out.Host = pr.In.Host
+				return
+			case hostHeaderRewrite:
+				host = opts.Target.Host
+			default:
+				host = opts.HostHeader
+			}
+			pr.Out.Host = host
+
+			// Dev servers commonly check that the Origin matches the Host,
+			// so rewrite it as well when it points at the tunnel.
+			origin := pr.In.Header.Get("Origin")
+			if origin != "" {
+				u, err := url.Parse(origin)
+				if err == nil && u.Host == pr.In.Host {
+					u.Scheme = opts.Target.Scheme
+					u.Host = host
+					pr.Out.Header.Set("Origin", u.String())
+				}
+			}
+		},
+		Transport: transport,
+		ErrorLog:  log.New(io.Discard, "", 0),
+		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn(r.Context(), "could not proxy request to target",
+				slog.F("target", opts.Target.String()),
+				slog.F("method", r.Method),
+				slog.F("path", r.URL.Path),
+				slog.Error(err),
+			)
+			rw.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// newTunnelHTTPServer returns an HTTP server for serving requests received
+// from the tunnel with the given handler.
+func newTunnelHTTPServer(ctx context.Context, handler http.Handler) *http.Server {
+	// ReadHeaderTimeout is purposefully not enabled. It caused some issues with
+	// websockets over the dev tunnel.
+	// See: https://github.com/coder/coder/pull/3730
+	//nolint:gosec
+	return &http.Server{
+		// These errors are typically noise like "TLS: EOF". Vault does similar:
+		// https://github.com/hashicorp/vault/blob/e2490059d0711635e529a4efcbaa1b26998d6e1c/command/server.go#L2714
+		ErrorLog: log.New(io.Discard, "", 0),
+		Handler:  handler,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func Test_newHTTPForwarder(t *testing.T) {
+	t.Parallel()
+
+	const tunnelHost = "abc123.tunnel.dev"
+
+	cases := []struct {
+		name         string
+		hostHeader   string
+		publicScheme string
+		origin       string
+		// expectedHost is the Host the target receives. "target" is replaced
+		// with the target's address.
+		expectedHost   string
+		expectedOrigin string
+		expectedProto  string
+	}{
+		{
+			name:           "Default",
+			origin:         "https://" + tunnelHost,
+			expectedHost:   tunnelHost,
+			expectedOrigin: "https://" + tunnelHost,
+			expectedProto:  "http",
+		},
+		{
+			name:           "Preserve",
+			hostHeader:     hostHeaderPreserve,
+			publicScheme:   "https",
+			origin:         "https://" + tunnelHost,
+			expectedHost:   tunnelHost,
+			expectedOrigin: "https://" + tunnelHost,
+			expectedProto:  "https",
+		},
+		{
+			name:           "Rewrite",
+			hostHeader:     hostHeaderRewrite,
+			publicScheme:   "https",
+			origin:         "https://" + tunnelHost,
+			expectedHost:   "target",
+			expectedOrigin: "http://target",
+			expectedProto:  "https",
+		},
+		{
+			name:           "Literal",
+			hostHeader:     "app.localhost:3000",
+			publicScheme:   "https",
+			origin:         "https://" + tunnelHost + "/path",
+			expectedHost:   "app.localhost:3000",
+			expectedOrigin: "http://app.localhost:3000/path",
+			expectedProto:  "https",
+		},
+		{
+			// Origins from other sites are passed through unchanged.
+			name:           "ForeignOrigin",
+			hostHeader:     hostHeaderRewrite,
+			origin:         "https://example.com",
+			expectedHost:   "target",
+			expectedOrigin: "https://example.com",
+			expectedProto:  "http",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			received := make(chan *http.Request, 1)
+			target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				received <- r
+				rw.WriteHeader(http.StatusNoContent)
+			}))
+			t.Cleanup(target.Close)
+			targetURL, err := url.Parse(target.URL)
+			require.NoError(t, err)
+
+			h := newHTTPForwarder(slogtest.Make(t, nil), httpForwarderOptions{
+				Target:       targetURL,
+				HostHeader:   c.hostHeader,
+				PublicScheme: c.publicScheme,
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "http://"+tunnelHost+"/foo", nil)
+			r.RemoteAddr = "10.0.0.2:1234"
+			r.Header.Set("Origin", c.origin)
+			// Set by tunneld to the real client IP.
+			r.Header.Set("X-Forwarded-For", "203.0.113.1")
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, r)
+			require.Equal(t, http.StatusNoContent, rw.Code)
+
+			got := <-received
+			expectedHost := c.expectedHost
+			if expectedHost == "target" {
+				expectedHost = targetURL.Host
+			}
+			expectedOrigin, err := url.Parse(c.expectedOrigin)
+			require.NoError(t, err)
+			if expectedOrigin.Host == "target" {
+				expectedOrigin.Host = targetURL.Host
+			}
+			require.Equal(t, "/foo", got.URL.Path)
+			require.Equal(t, expectedHost, got.Host)
+			require.Equal(t, expectedOrigin.String(), got.Header.Get("Origin"))
+			require.Equal(t, c.expectedProto, got.Header.Get("X-Forwarded-Proto"))
+			require.Equal(t, tunnelHost, got.Header.Get("X-Forwarded-Host"))
+			require.Equal(t, "203.0.113.1, 10.0.0.2", got.Header.Get("X-Forwarded-For"))
+		})
+	}
+}
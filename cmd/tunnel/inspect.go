@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/xerrors"
+)
+
+const (
+	defaultInspectBodyLimit   = 64 << 10 // 64KB
+	defaultInspectMaxRequests = 100
+)
+
+// capturedRequest is a single request/response pair recorded by the
+// inspector.
+type capturedRequest struct {
+	ID         int64         `json:"id"`
+	ReplayOf   int64         `json:"replay_of,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	Duration   time.Duration `json:"duration"`
+	RemoteAddr string        `json:"remote_addr"`
+
+	Method               string      `json:"method"`
+	URI                  string      `json:"uri"`
+	Proto                string      `json:"proto"`
+	Host                 string      `json:"host"`
+	RequestHeader        http.Header `json:"request_header"`
+	RequestBody          []byte      `json:"request_body"`
+	RequestBodySize      int64       `json:"request_body_size"`
+	RequestBodyTruncated bool        `json:"request_body_truncated"`
+
+	StatusCode            int         `json:"status_code"`
+	ResponseHeader        http.Header `json:"response_header"`
+	ResponseBody          []byte      `json:"response_body"`
+	ResponseBodySize      int64       `json:"response_body_size"`
+	ResponseBodyTruncated bool        `json:"response_body_truncated"`
+	Hijacked              bool        `json:"hijacked"`
+}
+
+// inspector records HTTP requests flowing through the tunnel and serves a
+// local UI and JSON API for browsing and replaying them.
+type inspector struct {
+	bodyLimit   int64
+	maxRequests int
+
+	mu       sync.Mutex
+	nextID   int64
+	requests []*capturedRequest // oldest first
+	handler  http.Handler
+}
+
+func newInspector(bodyLimit int64, maxRequests int) *inspector {
+	if bodyLimit < 0 {
+		bodyLimit = 0
+	}
+	if maxRequests <= 0 {
+		maxRequests = defaultInspectMaxRequests
+	}
+	return &inspector{
+		bodyLimit:   bodyLimit,
+		maxRequests: maxRequests,
+		nextID:      1,
+	}
+}
+
+// Middleware records every request that passes through the returned handler.
+// The handler is also used for replaying requests, so it must only be called
+// once.
+func (i *inspector) Middleware(next http.Handler) http.Handler {
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c := &capturedRequest{
+			StartedAt:     time.Now(),
+			RemoteAddr:    r.RemoteAddr,
+			Method:        r.Method,
+			URI:           r.RequestURI,
+			Proto:         r.Proto,
+			Host:          r.Host,
+			RequestHeader: r.Header.Clone(),
+		}
+		rc, _ := r.Context().Value(replayKey{}).(*replayContext)
+		if rc != nil {
+			c.ReplayOf = rc.of
+		}
+
+		// Capture the start of the request body before forwarding, since the
+		// transport may still be reading the body after next returns. The rest
+		// is only counted.
+		var (
+			reqBody      []byte
+			reqBodyRead  int64
+			reqBodyRest  atomic.Int64
+			reqTruncated bool
+		)
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			reqBody, err = io.ReadAll(io.LimitReader(r.Body, i.bodyLimit+1))
+			reqBodyRead = int64(len(reqBody))
+			// A body that failed to read can't be replayed either.
+			reqTruncated = reqBodyRead > i.bodyLimit || err != nil
+			r.Body = &bodyReadCloser{
+				r: io.MultiReader(bytes.NewReader(reqBody), &countingReader{r: r.Body, n: &reqBodyRest}),
+				c: r.Body,
+			}
+			if reqBodyRead > i.bodyLimit {
+				reqBody = reqBody[:i.bodyLimit]
+			}
+		}
+		crw := &captureResponseWriter{
+			ResponseWriter: rw,
+			body:           &boundedBuffer{limit: i.bodyLimit},
+		}
+
+		next.ServeHTTP(crw, r)
+
+		c.Duration = time.Since(c.StartedAt)
+		c.RequestBody = reqBody
+		// The size of a truncated body only includes what was read by now.
+		c.RequestBodySize = reqBodyRead + reqBodyRest.Load()
+		c.RequestBodyTruncated = reqTruncated
+		c.StatusCode = crw.status
+		if c.StatusCode == 0 {
+			c.StatusCode = http.StatusOK
+		}
+		c.ResponseHeader = crw.header
+		if c.ResponseHeader == nil {
+			c.ResponseHeader = rw.Header().Clone()
+		}
+		c.ResponseBody = crw.body.buf.Bytes()
+		c.ResponseBodySize = crw.body.n
+		c.ResponseBodyTruncated = crw.body.truncated()
+		c.Hijacked = crw.hijacked
+
+		i.record(c)
+		if rc != nil {
+			rc.capture = c
+		}
+	})
+
+	i.mu.Lock()
+	i.handler = h
+	i.mu.Unlock()
+	return h
+}
+
+func (i *inspector) record(c *capturedRequest) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	c.ID = i.nextID
+	i.nextID++
+	i.requests = append(i.requests, c)
+	if len(i.requests) > i.maxRequests {
+		// Copy to a new slice so the old backing array can be collected.
+		i.requests = append([]*capturedRequest(nil), i.requests[len(i.requests)-i.maxRequests:]...)
+	}
+}
+
+func (i *inspector) list() []*capturedRequest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Newest first.
+	out := make([]*capturedRequest, len(i.requests))
+	for j, c := range i.requests {
+		out[len(out)-j-1] = c
+	}
+	return out
+}
+
+func (i *inspector) get(id int64) (*capturedRequest, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, c := range i.requests {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func (i *inspector) clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.requests = nil
+}
+
+type replayKey struct{}
+
+// replayContext is stored on the context of replayed requests so the new
+// capture can be handed back to the caller.
+type replayContext struct {
+	of      int64
+	capture *capturedRequest
+}
+
+// replay sends a previously captured request through the forwarding handler
+// again and returns the new capture.
+func (i *inspector) replay(ctx context.Context, id int64) (*capturedRequest, error) {
+	c, ok := i.get(id)
+	if !ok {
+		return nil, xerrors.Errorf("request %d not found", id)
+	}
+	if c.RequestBodyTruncated {
+		return nil, xerrors.Errorf("request %d body was truncated and cannot be replayed", id)
+	}
+
+	i.mu.Lock()
+	handler := i.handler
+	i.mu.Unlock()
+	if handler == nil {
+		return nil, xerrors.New("inspector is not attached to a handler")
+	}
+
+	rc := &replayContext{of: c.ID}
+	ctx = context.WithValue(ctx, replayKey{}, rc)
+	r, err := http.NewRequestWithContext(ctx, c.Method, c.URI, bytes.NewReader(c.RequestBody))
+	if err != nil {
+		return nil, xerrors.Errorf("create replay request: %w", err)
+	}
+	r.RequestURI = c.URI
+	r.Host = c.Host
+	r.Header = c.RequestHeader.Clone()
+	r.ContentLength = int64(len(c.RequestBody))
+	r.RemoteAddr = c.RemoteAddr
+
+	// Upgrades can't be replayed as the connection can't be hijacked.
+	r.Header.Del("Connection")
+	r.Header.Del("Upgrade")
+
+	rw := &discardResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(rw, r)
+	if rc.capture == nil {
+		return nil, xerrors.New("replayed request was not recorded")
+	}
+	return rc.capture, nil
+}
+
+// inspectorRequestHeader must be set on requests that change state, such as
+// replays. Browsers only send custom headers cross-origin after a CORS
+// preflight, which the inspector never allows, so other websites can't make
+// these requests.
+const inspectorRequestHeader = "X-Tunnel-Inspector"
+
+// Handler returns the inspector UI and JSON API. listenAddr is the address the
+// inspector is served on, requests for other hosts are rejected to prevent DNS
+// rebinding.
+func (i *inspector) Handler(listenAddr string) http.Handler {
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			err := checkInspectorRequest(r, listenAddr)
+			if err != nil {
+				writeJSON(rw, http.StatusForbidden, map[string]string{"error": err.Error()})
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	})
+
+	r.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = rw.Write([]byte(inspectorHTML))
+	})
+	r.Route("/api/requests", func(r chi.Router) {
+		r.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+			writeJSON(rw, http.StatusOK, i.list())
+		})
+		r.Delete("/", func(rw http.ResponseWriter, r *http.Request) {
+			i.clear()
+			rw.WriteHeader(http.StatusNoContent)
+		})
+		r.Get("/{id}", func(rw http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "invalid request ID"})
+				return
+			}
+			c, ok := i.get(id)
+			if !ok {
+				writeJSON(rw, http.StatusNotFound, map[string]string{"error": "request not found"})
+				return
+			}
+			writeJSON(rw, http.StatusOK, c)
+		})
+		r.Post("/{id}/replay", func(rw http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "invalid request ID"})
+				return
+			}
+			c, err := i.replay(r.Context(), id)
+			if err != nil {
+				writeJSON(rw, http.StatusConflict, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(rw, http.StatusOK, c)
+		})
+	})
+
+	return r
+}
+
+// checkInspectorRequest returns an error if the request could have been made
+// by another website the user has open.
+func checkInspectorRequest(r *http.Request, listenAddr string) error {
+	if !inspectorHostAllowed(r.Host, listenAddr) {
+		return xerrors.Errorf("host %q is not allowed", r.Host)
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return nil
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return xerrors.Errorf("origin %q is not allowed", origin)
+		}
+	}
+	if r.Header.Get(inspectorRequestHeader) == "" {
+		return xerrors.Errorf("the %s header is required", inspectorRequestHeader)
+	}
+	return nil
+}
+
+// inspectorHostAllowed returns true if host refers to the inspector listening
+// on listenAddr. Other names could point at the inspector through DNS
+// rebinding, so only the listen address, localhost and IP addresses are
+// allowed.
+func inspectorHostAllowed(host, listenAddr string) bool {
+	if host == listenAddr {
+		return true
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	_, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil || port != listenPort {
+		return false
+	}
+	if strings.EqualFold(hostname, "localhost") {
+		return true
+	}
+	_, err = netip.ParseAddr(hostname)
+	return err == nil
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// boundedBuffer is an io.Writer that keeps the first limit bytes written to it
+// and counts the rest.
+type boundedBuffer struct {
+	limit int64
+	n     int64
+	buf   bytes.Buffer
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - int64(b.buf.Len()); remaining > 0 {
+		if int64(len(p)) > remaining {
+			_, _ = b.buf.Write(p[:remaining])
+		} else {
+			_, _ = b.buf.Write(p)
+		}
+	}
+	b.n += int64(len(p))
+	return len(p), nil
+}
+
+func (b *boundedBuffer) truncated() bool {
+	return b.n > int64(b.buf.Len())
+}
+
+type bodyReadCloser struct {
+	r io.Reader
+	c io.Closer
+}
+
+func (b *bodyReadCloser) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *bodyReadCloser) Close() error {
+	return b.c.Close()
+}
+
+// countingReader counts the bytes read from r. The count can be read while
+// another goroutine is reading.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// captureResponseWriter records the status, headers and a bounded copy of the
+// body written to the underlying http.ResponseWriter.
+type captureResponseWriter struct {
+	http.ResponseWriter
+
+	status   int
+	header   http.Header
+	body     *boundedBuffer
+	hijacked bool
+}
+
+func (w *captureResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	_, _ = w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *captureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, xerrors.New("response writer does not support hijacking")
+	}
+	w.hijacked = true
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	return h.Hijack()
+}
+
+// discardResponseWriter is used when replaying requests, as the response is
+// only recorded by the inspector.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (*discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (*discardResponseWriter) WriteHeader(int) {}
+
+const inspectorHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tunnel inspector</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 40%; overflow-y: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow-y: auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 4px 8px; border-bottom: 1px solid #eee; font-family: monospace; cursor: pointer; }
+tr:hover { background: #f4f4f4; }
+pre { background: #f8f8f8; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<div id="list">
+  <p style="padding: 0 8px"><button onclick="refresh()">Refresh</button> <button onclick="clearAll()">Clear</button></p>
+  <table id="requests"></table>
+</div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+function text(s) { const d = document.createElement("div"); d.textContent = s; return d.innerHTML; }
+function body(b, size, truncated) {
+  if (!b) return "(empty)";
+  let s;
+  try { s = atob(b); } catch (e) { s = b; }
+  return text(s) + (truncated ? "\n... (" + size + " bytes total, truncated)" : "");
+}
+function headers(h) {
+  return text(Object.keys(h || {}).sort().map(k => h[k].map(v => k + ": " + v).join("\n")).join("\n"));
+}
+async function refresh() {
+  const res = await fetch("/api/requests");
+  const reqs = await res.json();
+  document.getElementById("requests").innerHTML = reqs.map(r =>
+    "<tr onclick=\"show(" + r.id + ")\"><td>" + r.id + "</td><td>" + text(r.method) + "</td><td>" +
+    text(r.uri) + "</td><td>" + r.status_code + "</td><td>" + Math.round(r.duration / 1e6) + "ms</td></tr>").join("");
+}
+async function show(id) {
+  const res = await fetch("/api/requests/" + id);
+  const r = await res.json();
+  document.getElementById("detail").innerHTML =
+    "<h3>" + text(r.method + " " + r.uri) + "</h3>" +
+    (r.replay_of ? "<p>Replay of #" + r.replay_of + "</p>" : "") +
+    "<p><button onclick=\"replay(" + r.id + ")\">Replay</button></p>" +
+    "<h4>Request</h4><pre>" + text(r.proto + "\nHost: " + r.host) + "\n" + headers(r.request_header) + "</pre>" +
+    "<pre>" + body(r.request_body, r.request_body_size, r.request_body_truncated) + "</pre>" +
+    "<h4>Response " + r.status_code + "</h4><pre>" + headers(r.response_header) + "</pre>" +
+    "<pre>" + body(r.response_body, r.response_body_size, r.response_body_truncated) + "</pre>";
+}
+async function replay(id) {
+  const res = await fetch("/api/requests/" + id + "/replay", { method: "POST", headers: { "X-Tunnel-Inspector": "1" } });
+  const r = await res.json();
+  if (!res.ok) { alert(r.error); return; }
+  await refresh();
+  await show(r.id);
+}
+async function clearAll() {
+  await fetch("/api/requests", { method: "DELETE", headers: { "X-Tunnel-Inspector": "1" } });
+  document.getElementById("detail").innerHTML = "<p>Select a request.</p>";
+  await refresh();
+}
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
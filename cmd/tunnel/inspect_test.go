@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func Test_inspector(t *testing.T) {
+	t.Parallel()
+
+	// newTestInspector returns an inspector in front of a handler that echoes
+	// the request body, and the requests the handler received.
+	newTestInspector := func(t *testing.T, bodyLimit int64) (*inspector, http.Handler, *[]*http.Request) {
+		var received []*http.Request
+		insp := newInspector(bodyLimit, 2)
+		h := insp.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			received = append(received, r)
+			rw.Header().Set("X-Echo", r.Header.Get("Authorization"))
+			rw.WriteHeader(http.StatusCreated)
+			_, _ = rw.Write(body)
+		}))
+		return insp, h, &received
+	}
+
+	t.Run("Capture", func(t *testing.T) {
+		t.Parallel()
+
+		insp, h, _ := newTestInspector(t, 1024)
+		r := httptest.NewRequest(http.MethodPost, "/foo?bar=baz", strings.NewReader("hello"))
+		r.Header.Set("Authorization", "secret")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		require.Equal(t, http.StatusCreated, rw.Code)
+		require.Equal(t, "hello", rw.Body.String())
+
+		reqs := insp.list()
+		require.Len(t, reqs, 1)
+		c := reqs[0]
+		require.EqualValues(t, 1, c.ID)
+		require.Equal(t, http.MethodPost, c.Method)
+		require.Equal(t, "/foo?bar=baz", c.URI)
+		require.Equal(t, "secret", c.RequestHeader.Get("Authorization"))
+		require.Equal(t, "hello", string(c.RequestBody))
+		require.EqualValues(t, 5, c.RequestBodySize)
+		require.False(t, c.RequestBodyTruncated)
+		require.Equal(t, http.StatusCreated, c.StatusCode)
+		require.Equal(t, "secret", c.ResponseHeader.Get("X-Echo"))
+		require.Equal(t, "hello", string(c.ResponseBody))
+		require.False(t, c.ResponseBodyTruncated)
+
+		// Only the newest requests are kept, newest first.
+		for j := 0; j < 2; j++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+		reqs = insp.list()
+		require.Len(t, reqs, 2)
+		require.EqualValues(t, 3, reqs[0].ID)
+		require.EqualValues(t, 2, reqs[1].ID)
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		t.Parallel()
+
+		insp, h, _ := newTestInspector(t, 4)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello world")))
+		// The forwarded request and response aren't affected.
+		require.Equal(t, "hello world", rw.Body.String())
+
+		c := insp.list()[0]
+		require.Equal(t, "hell", string(c.RequestBody))
+		require.EqualValues(t, 11, c.RequestBodySize)
+		require.True(t, c.RequestBodyTruncated)
+		require.Equal(t, "hell", string(c.ResponseBody))
+		require.EqualValues(t, 11, c.ResponseBodySize)
+		require.True(t, c.ResponseBodyTruncated)
+
+		_, err := insp.replay(context.Background(), c.ID)
+		require.ErrorContains(t, err, "body was truncated and cannot be replayed")
+	})
+
+	t.Run("UnreadBody", func(t *testing.T) {
+		t.Parallel()
+
+		insp := newInspector(1024, 2)
+		h := insp.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusAccepted)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+
+		// The body is captured even though the handler never read it.
+		c := insp.list()[0]
+		require.Equal(t, "hello", string(c.RequestBody))
+		require.EqualValues(t, 5, c.RequestBodySize)
+		require.False(t, c.RequestBodyTruncated)
+	})
+
+	t.Run("Forwarder", func(t *testing.T) {
+		t.Parallel()
+
+		// The target responds without reading the body, so the transport can
+		// still be writing it after the forwarder returns.
+		target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusAccepted)
+		}))
+		t.Cleanup(target.Close)
+		targetURL, err := url.Parse(target.URL)
+		require.NoError(t, err)
+
+		insp := newInspector(1024, 2)
+		h := insp.Middleware(newHTTPForwarder(slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}), httpForwarderOptions{
+			Target: targetURL,
+		}))
+		body := strings.Repeat("a", 1<<20)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		require.Equal(t, http.StatusAccepted, rw.Code)
+
+		c := insp.list()[0]
+		require.Equal(t, body[:1024], string(c.RequestBody))
+		require.True(t, c.RequestBodyTruncated)
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		t.Parallel()
+
+		insp, h, received := newTestInspector(t, 1024)
+		r := httptest.NewRequest(http.MethodPut, "/foo", strings.NewReader("hello"))
+		r.Host = "app.example.com"
+		r.Header.Set("Authorization", "secret")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		c, err := insp.replay(context.Background(), 1)
+		require.NoError(t, err)
+		require.EqualValues(t, 2, c.ID)
+		require.EqualValues(t, 1, c.ReplayOf)
+		require.Equal(t, "hello", string(c.ResponseBody))
+
+		require.Len(t, *received, 2)
+		replayed := (*received)[1]
+		require.Equal(t, http.MethodPut, replayed.Method)
+		require.Equal(t, "/foo", replayed.RequestURI)
+		require.Equal(t, "app.example.com", replayed.Host)
+		require.Equal(t, "secret", replayed.Header.Get("Authorization"))
+
+		_, err = insp.replay(context.Background(), 100)
+		require.ErrorContains(t, err, "not found")
+	})
+
+	t.Run("API", func(t *testing.T) {
+		t.Parallel()
+
+		const listenAddr = "127.0.0.1:4040"
+		insp, h, received := newTestInspector(t, 1024)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+		api := insp.Handler(listenAddr)
+
+		do := func(method, path, host string, header http.Header) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, path, nil)
+			r.Host = host
+			for k, v := range header {
+				r.Header[k] = v
+			}
+			rw := httptest.NewRecorder()
+			api.ServeHTTP(rw, r)
+			return rw
+		}
+
+		rw := do(http.MethodGet, "/api/requests/1", listenAddr, nil)
+		require.Equal(t, http.StatusOK, rw.Code)
+		var c capturedRequest
+		require.NoError(t, json.NewDecoder(rw.Body).Decode(&c))
+		require.Equal(t, "hello", string(c.RequestBody))
+
+		// Hostnames other than localhost could be rebound to the inspector.
+		rw = do(http.MethodGet, "/api/requests/1", "evil.example.com:4040", nil)
+		require.Equal(t, http.StatusForbidden, rw.Code)
+		rw = do(http.MethodGet, "/api/requests/1", "localhost:4040", nil)
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		// Replays need the custom header, which browsers won't send
+		// cross-origin, and a matching origin.
+		rw = do(http.MethodPost, "/api/requests/1/replay", listenAddr, nil)
+		require.Equal(t, http.StatusForbidden, rw.Code)
+		rw = do(http.MethodPost, "/api/requests/1/replay", listenAddr, http.Header{
+			"Origin":               {"https://evil.example.com"},
+			inspectorRequestHeader: {"1"},
+		})
+		require.Equal(t, http.StatusForbidden, rw.Code)
+		require.Len(t, *received, 1)
+
+		rw = do(http.MethodPost, "/api/requests/1/replay", listenAddr, http.Header{
+			"Origin":               {"http://" + listenAddr},
+			inspectorRequestHeader: {"1"},
+		})
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Len(t, *received, 2)
+
+		rw = do(http.MethodDelete, "/api/requests/", listenAddr, nil)
+		require.Equal(t, http.StatusForbidden, rw.Code)
+		rw = do(http.MethodDelete, "/api/requests/", listenAddr, http.Header{inspectorRequestHeader: {"1"}})
+		require.Equal(t, http.StatusNoContent, rw.Code)
+		require.Empty(t, insp.list())
+	})
+}
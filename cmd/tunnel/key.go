@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/wgtunnel/internal/cliconfig"
+	"github.com/coder/wgtunnel/internal/keyfile"
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+var keyCommand = &cli.Command{
+	Name:  "key",
+	Usage: "Manage the wireguard private key that determines the tunnel hostname. Flags for the tunnel must be passed before the command, e.g. `tunnel --api-url https://tunnel.example.com key show`.",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "generate",
+			Usage: "Generate a new private key and write it to the key file.",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Overwrite an existing key file. The tunnel hostname will change.",
+				},
+			},
+			Action: generateKey,
+		},
+		{
+			Name:   "show",
+			Usage:  "Show the public key and fingerprint of the private key. If api-url is set, also show the IP address and URLs the key maps to on that server.",
+			Action: showKey,
+		},
+		{
+			Name:   "encrypt",
+			Usage:  "Encrypt an existing plain key file with a passphrase. The tunnel hostname doesn't change.",
+			Action: encryptKey,
+		},
+		{
+			Name:      "import",
+			Usage:     "Import a private key in wg format, either the output of `wg genkey` or a wg-quick config file, and write it to the key file. Reads from stdin if no file is given.",
+			ArgsUsage: "[file]",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Overwrite an existing key file. The tunnel hostname will change.",
+				},
+			},
+			Action: importKey,
+		},
+	},
+}
+
+// defaultKeyFile returns the path of the key file that is used if neither
+// wireguard-key nor wireguard-key-file are set.
+func defaultKeyFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", xerrors.Errorf("find user config directory: %w", err)
+	}
+	return filepath.Join(dir, "wgtunnel", "wireguard.key"), nil
+}
+
+// keyFilePath returns wireguard-key-file, or the default key file if it's
+// unset.
+func keyFilePath(ctx *cli.Context) (string, error) {
+	if p := ctx.String("wireguard-key-file"); p != "" {
+		return p, nil
+	}
+	return defaultKeyFile()
+}
+
+// keyPassphrase returns where the passphrase for encrypted key files comes
+// from.
+func keyPassphrase(ctx *cli.Context) keyfile.PassphraseSource {
+	return keyfile.PassphraseSource{
+		EnvVar:      "TUNNEL_KEY_PASSPHRASE",
+		File:        ctx.String("key-passphrase-file"),
+		Interactive: true,
+	}
+}
+
+// loadKey returns the private key from wireguard-key, derived from
+// key-seed-file, or from the key file. If create is true and the key file
+// doesn't exist, a new key is generated and written to it.
+func loadKey(ctx *cli.Context, create bool) (tunnelsdk.Key, error) {
+	var (
+		wireguardKey     = ctx.String("wireguard-key")
+		wireguardKeyFile = ctx.String("wireguard-key-file")
+		keySeedFile      = ctx.String("key-seed-file")
+		serviceName      = ctx.String("service-name")
+	)
+	set := 0
+	for _, v := range []string{wireguardKey, wireguardKeyFile, keySeedFile} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return tunnelsdk.Key{}, xerrors.New("Only one of wireguard-key, wireguard-key-file or key-seed-file can be specified. See --help for more information.")
+	}
+	if serviceName != "" && keySeedFile == "" {
+		return tunnelsdk.Key{}, xerrors.New("service-name requires key-seed-file. See --help for more information.")
+	}
+	if keySeedFile != "" {
+		if serviceName == "" {
+			return tunnelsdk.Key{}, xerrors.New("service-name is required with key-seed-file. See --help for more information.")
+		}
+		seed, err := os.ReadFile(keySeedFile)
+		if err != nil {
+			return tunnelsdk.Key{}, xerrors.Errorf("failed to read key-seed-file %q: %w", keySeedFile, err)
+		}
+		key, err := tunnelsdk.DeriveKey(trimSeedNewline(seed), serviceName)
+		if err != nil {
+			return tunnelsdk.Key{}, xerrors.Errorf("derive key from key-seed-file %q: %w", keySeedFile, err)
+		}
+		return key, nil
+	}
+	if wireguardKey != "" {
+		key, err := tunnelsdk.ParsePrivateKey(wireguardKey)
+		if err != nil {
+			return tunnelsdk.Key{}, xerrors.Errorf("could not parse wireguard-key: %w", err)
+		}
+		return key, nil
+	}
+
+	keyFile, err := keyFilePath(ctx)
+	if err != nil {
+		return tunnelsdk.Key{}, err
+	}
+	fileBytes, err := os.ReadFile(keyFile)
+	if errors.Is(err, os.ErrNotExist) && create {
+		key, err := tunnelsdk.GeneratePrivateKey()
+		if err != nil {
+			return tunnelsdk.Key{}, xerrors.Errorf("failed to generate wireguard key: %w", err)
+		}
+		err = writeKeyFile(ctx, keyFile, key)
+		if err != nil {
+			return tunnelsdk.Key{}, err
+		}
+		return key, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return tunnelsdk.Key{}, xerrors.Errorf("key file %q does not exist, create one with `tunnel key generate`", keyFile)
+	}
+	if err != nil {
+		return tunnelsdk.Key{}, xerrors.Errorf("failed to read wireguard-key-file %q: %w", keyFile, err)
+	}
+
+	key, err := tunnelsdk.ParsePrivateKeyFile(fileBytes, func() ([]byte, error) {
+		return keyPassphrase(ctx).Passphrase(false)
+	})
+	if errors.Is(err, keyfile.ErrNoPassphrase) {
+		return tunnelsdk.Key{}, xerrors.Errorf("key file %q is encrypted, set TUNNEL_KEY_PASSPHRASE or key-passphrase-file to decrypt it.", keyFile)
+	}
+	if err != nil {
+		return tunnelsdk.Key{}, xerrors.Errorf("could not parse key file %q: %w", keyFile, err)
+	}
+	return key, nil
+}
+
+// writeKeyFile writes a private key to path, creating the parent directories
+// if needed. The key is encrypted if encrypt-key-file is set.
+func writeKeyFile(ctx *cli.Context, path string, key tunnelsdk.Key) error {
+	var passphrase []byte
+	if ctx.Bool("encrypt-key-file") {
+		var err error
+		passphrase, err = newKeyPassphrase(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := keyfile.Encode(key, passphrase)
+	if err != nil {
+		return xerrors.Errorf("encode key: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return xerrors.Errorf("create key file directory: %w", err)
+	}
+	err = keyfile.Write(path, data)
+	if err != nil {
+		return xerrors.Errorf("failed to write wireguard key to file %q: %w", path, err)
+	}
+	return nil
+}
+
+// newKeyPassphrase returns the passphrase to encrypt a key file with.
+func newKeyPassphrase(ctx *cli.Context) ([]byte, error) {
+	passphrase, err := keyPassphrase(ctx).Passphrase(true)
+	if errors.Is(err, keyfile.ErrNoPassphrase) {
+		return nil, xerrors.New("a passphrase is required to encrypt the key file, set TUNNEL_KEY_PASSPHRASE or key-passphrase-file, or run tunnel in a terminal.")
+	}
+	return passphrase, err
+}
+
+// saveKey writes key to the key file. Existing key files are only
+// overwritten if force is true.
+func saveKey(ctx *cli.Context, key tunnelsdk.Key, force bool) (string, error) {
+	if ctx.String("wireguard-key") != "" || ctx.String("key-seed-file") != "" {
+		return "", xerrors.New("wireguard-key or key-seed-file is set, unset it to use a key file.")
+	}
+	keyFile, err := keyFilePath(ctx)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(keyFile)
+	if err == nil && !force {
+		return "", xerrors.Errorf("key file %q already exists. Pass --force to overwrite it, which changes the tunnel hostname.", keyFile)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", xerrors.Errorf("stat key file %q: %w", keyFile, err)
+	}
+
+	return keyFile, writeKeyFile(ctx, keyFile, key)
+}
+
+func generateKey(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), ctx.App.Flags)
+	if err != nil {
+		return err
+	}
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	if err != nil {
+		return xerrors.Errorf("failed to generate wireguard key: %w", err)
+	}
+	keyFile, err := saveKey(ctx, key, ctx.Bool("force"))
+	if err != nil {
+		return err
+	}
+	return printKeyWritten(ctx, keyFile, key)
+}
+
+func importKey(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), ctx.App.Flags)
+	if err != nil {
+		return err
+	}
+	if ctx.Args().Len() > 1 {
+		return xerrors.New("at most one argument (file) is allowed. See --help for more information.")
+	}
+
+	var data []byte
+	if path := ctx.Args().First(); path != "" && path != "-" {
+		data, err = os.ReadFile(path)
+	} else {
+		data, err = io.ReadAll(ctx.App.Reader)
+	}
+	if err != nil {
+		return xerrors.Errorf("read key: %w", err)
+	}
+	key, err := parseWireguardKey(data)
+	if err != nil {
+		return err
+	}
+
+	keyFile, err := saveKey(ctx, key, ctx.Bool("force"))
+	if err != nil {
+		return err
+	}
+	return printKeyWritten(ctx, keyFile, key)
+}
+
+// encryptKey encrypts the existing key file in place, so key files written by
+// older versions can be migrated.
+func encryptKey(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), ctx.App.Flags)
+	if err != nil {
+		return err
+	}
+	if ctx.String("wireguard-key") != "" || ctx.String("key-seed-file") != "" {
+		return xerrors.New("wireguard-key or key-seed-file is set, only key files can be encrypted.")
+	}
+	keyFile, err := keyFilePath(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return xerrors.Errorf("read key file %q: %w", keyFile, err)
+	}
+	if tunnelsdk.IsEncryptedPrivateKey(data) {
+		return xerrors.Errorf("key file %q is already encrypted.", keyFile)
+	}
+	key, err := tunnelsdk.ParsePrivateKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return xerrors.Errorf("could not parse key file %q: %w", keyFile, err)
+	}
+
+	passphrase, err := newKeyPassphrase(ctx)
+	if err != nil {
+		return err
+	}
+	data, err = keyfile.Encode(key, passphrase)
+	if err != nil {
+		return xerrors.Errorf("encrypt key: %w", err)
+	}
+	err = keyfile.Write(keyFile, data)
+	if err != nil {
+		return xerrors.Errorf("failed to write wireguard key to file %q: %w", keyFile, err)
+	}
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Encrypted private key in %s\n", keyFile)
+	return nil
+}
+
+func printKeyWritten(ctx *cli.Context, keyFile string, key tunnelsdk.Key) error {
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Wrote private key to %s\n", keyFile)
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Public key: %s\n", publicKey)
+	return nil
+}
+
+func showKey(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), ctx.App.Flags)
+	if err != nil {
+		return err
+	}
+
+	key, err := loadKey(ctx, false)
+	if err != nil {
+		return err
+	}
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Public key:  %s\n", publicKey)
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Fingerprint: %s\n", key.Hash())
+
+	apiURL := ctx.String("api-url")
+	if apiURL == "" {
+		return nil
+	}
+	apiURLParsed, err := url.Parse(apiURL)
+	if err != nil {
+		return xerrors.Errorf("failed to parse api-url %q: %w", apiURL, err)
+	}
+	info, err := tunnelsdk.New(apiURLParsed).ServerInfo(ctx.Context)
+	if err != nil {
+		return xerrors.Errorf("get server info: %w", err)
+	}
+	if info.BaseURL == "" || !info.WireguardNetworkPrefix.IsValid() {
+		return xerrors.New("the server does not report its base URL and network prefix, so the tunnel URLs can't be derived without registering.")
+	}
+	baseURL, err := url.Parse(info.BaseURL)
+	if err != nil {
+		return xerrors.Errorf("parse server base URL %q: %w", info.BaseURL, err)
+	}
+
+	ip, urls := tunnelsdk.PublicKeyToIPAndURLs(key.NoisePublicKey(), info.WireguardNetworkPrefix, baseURL, tunnelsdk.TunnelVersionLatest)
+	if ip.IsValid() {
+		_, _ = fmt.Fprintf(ctx.App.Writer, "IP:          %s\n", ip)
+	} else {
+		_, _ = fmt.Fprintln(ctx.App.Writer, "IP:          assigned by the server when registering")
+	}
+	_, _ = fmt.Fprintln(ctx.App.Writer, "URLs:")
+	for _, u := range urls {
+		_, _ = fmt.Fprintf(ctx.App.Writer, "  - %s\n", u)
+	}
+	return nil
+}
+
+// parseWireguardKey parses a private key in the formats used by wg: a base64
+// encoded key as printed by `wg genkey`, or a wg-quick config file with a
+// PrivateKey in its [Interface] section.
+func parseWireguardKey(data []byte) (tunnelsdk.Key, error) {
+	if key, err := tunnelsdk.ParsePrivateKey(string(bytes.TrimSpace(data))); err == nil {
+		return key, nil
+	}
+
+	var (
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+		section string
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || section != "interface" || !strings.EqualFold(strings.TrimSpace(name), "PrivateKey") {
+			continue
+		}
+		key, err := tunnelsdk.ParsePrivateKey(strings.TrimSpace(value))
+		if err != nil {
+			return tunnelsdk.Key{}, xerrors.Errorf("parse PrivateKey: %w", err)
+		}
+		return key, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return tunnelsdk.Key{}, xerrors.Errorf("read key: %w", err)
+	}
+	return tunnelsdk.Key{}, xerrors.New("no private key found, expected the output of `wg genkey` or a wg-quick config file with an [Interface] PrivateKey")
+}
+
+// trimSeedNewline removes a single trailing "\n" or "\r\n", as added by base64
+// or an editor, from a key seed. Other whitespace is kept so seeds don't lose
+// bytes that are part of the secret.
+func trimSeedNewline(seed []byte) []byte {
+	if bytes.HasSuffix(seed, []byte("\r\n")) {
+		return seed[:len(seed)-2]
+	}
+	return bytes.TrimSuffix(seed, []byte("\n"))
+}
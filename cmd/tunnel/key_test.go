@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_trimSeedNewline(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "seed", string(trimSeedNewline([]byte("seed\n"))))
+	require.Equal(t, "seed", string(trimSeedNewline([]byte("seed\r\n"))))
+	require.Equal(t, "seed\n", string(trimSeedNewline([]byte("seed\n\n"))))
+	// Whitespace in binary seeds is part of the secret, including a carriage
+	// return that isn't followed by a newline.
+	require.Equal(t, "seed\r", string(trimSeedNewline([]byte("seed\r"))))
+	require.Equal(t, "seed\r", string(trimSeedNewline([]byte("seed\r\r\n"))))
+	require.Equal(t, " \tseed \x00", string(trimSeedNewline([]byte(" \tseed \x00"))))
+}
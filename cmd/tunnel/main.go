@@ -6,9 +6,11 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/urfave/cli/v2"
@@ -17,6 +19,7 @@ import (
 	"cdr.dev/slog"
 	"cdr.dev/slog/sloggers/sloghuman"
 	"github.com/coder/wgtunnel/buildinfo"
+	"github.com/coder/wgtunnel/internal/cliconfig"
 	"github.com/coder/wgtunnel/tunnelsdk"
 )
 
@@ -30,9 +33,15 @@ func main() {
 	app := &cli.App{
 		Name:      "tunnel",
 		Usage:     "run a wgtunnel client",
-		ArgsUsage: "<target-address (e.g. 127.0.0.1:8080)>",
+		ArgsUsage: "<target (e.g. 127.0.0.1:8080, http://localhost:3000, https://localhost:8443 or file:///path/to/dir)>",
 		Version:   buildinfo.Version(),
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Aliases: []string{"c"},
+				Usage:   "Path to a YAML config file. Keys are flag names. Flags and environment variables take precedence over the config file.",
+				EnvVars: []string{"TUNNEL_CONFIG"},
+			},
 			&cli.BoolFlag{
 				Name:    "verbose",
 				Aliases: []string{"v"},
@@ -47,17 +56,87 @@ func main() {
 			&cli.StringFlag{
 				Name:    "wireguard-key",
 				Aliases: []string{"wg-key"},
-				Usage:   "The private key for the wireguard client. It should be base64 encoded. You must specify this or wireguard-key-file.",
+				Usage:   "The private key for the wireguard client. It should be base64 encoded. Mutually exclusive with wireguard-key-file.",
 				EnvVars: []string{"TUNNEL_WIREGUARD_KEY"},
 			},
 			&cli.StringFlag{
 				Name:    "wireguard-key-file",
 				Aliases: []string{"wg-key-file"},
-				Usage:   "The file containing the private key for the wireguard client. It should contain a base64 encoded key. The file will be created and populated with a fresh key if it does not exist. You must specify this or wireguard-key.",
+				Usage:   "The file containing the private key for the wireguard client. It should contain a base64 encoded key, or a key encrypted with a passphrase. The file will be created and populated with a fresh key if it does not exist. Defaults to wireguard.key in the wgtunnel directory of the user config directory. Mutually exclusive with wireguard-key.",
 				EnvVars: []string{"TUNNEL_WIREGUARD_KEY_FILE"},
 			},
+			&cli.StringFlag{
+				Name:    "key-passphrase-file",
+				Usage:   "The file containing the passphrase for an encrypted key file. The passphrase can also be set with the TUNNEL_KEY_PASSPHRASE environment variable, otherwise it's prompted for if stdin is a terminal.",
+				EnvVars: []string{"TUNNEL_KEY_PASSPHRASE_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "encrypt-key-file",
+				Usage:   "Encrypt key files written by tunnel with a passphrase. Existing key files can be encrypted with `tunnel key encrypt`.",
+				EnvVars: []string{"TUNNEL_ENCRYPT_KEY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "key-seed-file",
+				Usage:   "Derive the private key from the secret in this file and service-name instead of using a key file, so every machine with the secret gets the same hostname for a service. The secret must be at least 32 bytes, e.g. from `head -c 32 /dev/urandom | base64`. A single trailing newline is removed, every other byte including whitespace is part of the secret. Mutually exclusive with wireguard-key and wireguard-key-file.",
+				EnvVars: []string{"TUNNEL_KEY_SEED_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "service-name",
+				Usage:   "The name of the service to derive the private key for. Required with key-seed-file.",
+				EnvVars: []string{"TUNNEL_SERVICE_NAME"},
+			},
+			&cli.StringFlag{
+				Name:    "host-header",
+				Usage:   "How to set the Host header on requests forwarded to the target. One of \"preserve\" (keep the tunnel hostname), \"rewrite\" (use the target's host) or a literal host value. Setting this forwards traffic as HTTP rather than raw TCP.",
+				Value:   hostHeaderPreserve,
+				EnvVars: []string{"TUNNEL_HOST_HEADER"},
+			},
+			&cli.BoolFlag{
+				Name:    "insecure-skip-verify",
+				Usage:   "Skip TLS certificate verification when forwarding to an https:// target. Useful for local servers with self-signed certificates.",
+				EnvVars: []string{"TUNNEL_INSECURE_SKIP_VERIFY"},
+			},
+			&cli.StringFlag{
+				Name:    "serve-dir",
+				Usage:   "Serve the files in the given directory over the tunnel instead of forwarding to a target. Equivalent to a file:// target.",
+				EnvVars: []string{"TUNNEL_SERVE_DIR"},
+			},
+			&cli.BoolFlag{
+				Name:    "serve-dir-listings",
+				Usage:   "List the contents of directories without an index.html when serving a directory. Files starting with a dot are never served or listed.",
+				EnvVars: []string{"TUNNEL_SERVE_DIR_LISTINGS"},
+			},
+			&cli.BoolFlag{
+				Name:    "serve-echo",
+				Usage:   "Serve a built-in handler that echoes back a description of each request instead of forwarding to a target. Useful for testing connectivity.",
+				EnvVars: []string{"TUNNEL_SERVE_ECHO"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "How long to wait for in-flight connections to finish when shutting down the tunnel.",
+				Value:   10 * time.Second,
+				EnvVars: []string{"TUNNEL_SHUTDOWN_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:    "inspect-address",
+				Usage:   "The address to serve the request inspector UI and API on (e.g. 127.0.0.1:4040). Enabling the inspector forwards traffic as HTTP rather than raw TCP. If empty, the inspector is disabled.",
+				EnvVars: []string{"TUNNEL_INSPECT_ADDRESS"},
+			},
+			&cli.Int64Flag{
+				Name:    "inspect-body-limit",
+				Usage:   "The maximum number of bytes of each request and response body recorded by the inspector.",
+				Value:   defaultInspectBodyLimit,
+				EnvVars: []string{"TUNNEL_INSPECT_BODY_LIMIT"},
+			},
+			&cli.IntFlag{
+				Name:    "inspect-max-requests",
+				Usage:   "The maximum number of requests kept by the inspector. Older requests are discarded.",
+				Value:   defaultInspectMaxRequests,
+				EnvVars: []string{"TUNNEL_INSPECT_MAX_REQUESTS"},
+			},
 		},
-		Action: runApp,
+		Action:   runApp,
+		Commands: []*cli.Command{keyCommand, exportConfigCommand},
 	}
 
 	err := app.Run(os.Args)
@@ -67,32 +146,89 @@ func main() {
 }
 
 func runApp(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), ctx.App.Flags)
+	if err != nil {
+		return err
+	}
+
 	var (
-		verbose          = ctx.Bool("verbose")
-		apiURL           = ctx.String("api-url")
-		wireguardKey     = ctx.String("wireguard-key")
-		wireguardKeyFile = ctx.String("wireguard-key-file")
+		verbose            = ctx.Bool("verbose")
+		apiURL             = ctx.String("api-url")
+		hostHeader         = ctx.String("host-header")
+		insecureSkipVerify = ctx.Bool("insecure-skip-verify")
+		serveDir           = ctx.String("serve-dir")
+		serveDirListings   = ctx.Bool("serve-dir-listings")
+		serveEcho          = ctx.Bool("serve-echo")
+		shutdownTimeout    = ctx.Duration("shutdown-timeout")
+		inspectAddress     = ctx.String("inspect-address")
+		inspectBodyLimit   = ctx.Int64("inspect-body-limit")
+		inspectMaxReqs     = ctx.Int("inspect-max-requests")
 	)
 	if apiURL == "" {
 		return xerrors.New("api-url is required. See --help for more information.")
 	}
-	if wireguardKey == "" && wireguardKeyFile == "" {
-		return xerrors.New("wireguard-key or wireguard-key-file is required. See --help for more information.")
+
+	if serveDir != "" && serveEcho {
+		return xerrors.New("serve-dir and serve-echo are mutually exclusive. See --help for more information.")
+	}
+	var target string
+	if serveDir == "" && !serveEcho {
+		if ctx.Args().Len() != 1 {
+			return xerrors.New("exactly one argument (target) is required. See --help for more information.")
+		}
+		target = ctx.Args().Get(0)
+		if target == "" {
+			return xerrors.New("target is empty")
+		}
+	} else if ctx.Args().Len() != 0 {
+		return xerrors.New("a target cannot be specified with serve-dir or serve-echo. See --help for more information.")
 	}
-	if wireguardKey != "" && wireguardKeyFile != "" {
-		return xerrors.New("Only one of wireguard-key or wireguard-key-file can be specified. See --help for more information.")
+	if strings.HasPrefix(target, "file://") {
+		serveDir = strings.TrimPrefix(target, "file://")
+		target = ""
 	}
 
-	if ctx.Args().Len() != 1 {
-		return xerrors.New("exactly one argument (target-address) is required. See --help for more information.")
+	// Targets with a scheme are always forwarded as HTTP. Plain host:port
+	// targets are spliced as raw TCP unless an HTTP-only feature is enabled.
+	var (
+		targetURL   *url.URL
+		localServer http.Handler
+	)
+	switch {
+	case serveDir != "":
+		h, err := newDirHandler(serveDir, serveDirListings)
+		if err != nil {
+			return xerrors.Errorf("serve directory: %w", err)
+		}
+		localServer = h
+	case serveEcho:
+		localServer = newEchoHandler()
+	case strings.Contains(target, "://"):
+		u, err := url.Parse(target)
+		if err != nil {
+			return xerrors.Errorf("parse target %q: %w", target, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return xerrors.Errorf("target %q has unsupported scheme %q, must be http, https or file", target, u.Scheme)
+		}
+		if u.Host == "" {
+			return xerrors.Errorf("target %q has no host", target)
+		}
+		targetURL = u
+	default:
+		_, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return xerrors.Errorf("target %q is not a valid host:port: %w", target, err)
+		}
+		if ctx.IsSet("host-header") || inspectAddress != "" {
+			targetURL = &url.URL{Scheme: "http", Host: target}
+		}
 	}
-	targetAddress := ctx.Args().Get(0)
-	if targetAddress == "" {
-		return xerrors.New("target-address is empty")
+	if targetURL == nil && insecureSkipVerify {
+		return xerrors.New("insecure-skip-verify can only be used with an https:// target. See --help for more information.")
 	}
-	_, _, err := net.SplitHostPort(targetAddress)
-	if err != nil {
-		return xerrors.Errorf("target-address %q is not a valid host:port: %w", targetAddress, err)
+	if hostHeader == "" {
+		hostHeader = hostHeaderPreserve
 	}
 
 	logger := slog.Make(sloghuman.Sink(os.Stderr)).Leveled(slog.LevelInfo)
@@ -105,34 +241,20 @@ func runApp(ctx *cli.Context) error {
 		return xerrors.Errorf("failed to parse api-url %q: %w", apiURL, err)
 	}
 
-	if wireguardKeyFile != "" {
-		fileBytes, err := os.ReadFile(wireguardKeyFile)
-		if xerrors.Is(err, os.ErrNotExist) {
-			key, err := tunnelsdk.GeneratePrivateKey()
-			if err != nil {
-				return xerrors.Errorf("failed to generate wireguard key: %w", err)
-			}
-
-			fileBytes = []byte(key.String())
-			err = os.WriteFile(wireguardKeyFile, fileBytes, 0600)
-			if err != nil {
-				return xerrors.Errorf("failed to write wireguard key to file %q: %w", wireguardKeyFile, err)
-			}
-		} else if err != nil {
-			return xerrors.Errorf("failed to read wireguard-key-file %q: %w", wireguardKeyFile, err)
-		}
-		wireguardKey = string(fileBytes)
-	}
-
-	wireguardKeyParsed, err := tunnelsdk.ParsePrivateKey(wireguardKey)
+	wireguardKeyParsed, err := loadKey(ctx, true)
 	if err != nil {
-		return xerrors.Errorf("could not parse wireguard-key or wireguard-key-file: %w", err)
+		return err
 	}
 
 	client := tunnelsdk.New(apiURLParsed)
 	tunnel, err := client.LaunchTunnel(ctx.Context, tunnelsdk.TunnelConfig{
 		Log:        logger,
 		PrivateKey: wireguardKeyParsed,
+		EventHandler: func(ev tunnelsdk.TunnelEvent) {
+			if ev.Type == tunnelsdk.TunnelEventStateChanged {
+				_, _ = fmt.Fprintf(os.Stderr, "Tunnel state: %s\n", ev.State)
+			}
+		},
 	})
 	if err != nil {
 		return xerrors.Errorf("launch tunnel: %w", err)
@@ -151,42 +273,48 @@ func runApp(ctx *cli.Context) error {
 	}
 
 	// Start forwarding traffic to/from the tunnel.
-	go func() {
-		for {
-			conn, err := tunnel.Listener.Accept()
-			if err != nil {
-				logger.Error(ctx.Context, "close tunnel", slog.Error(err))
-				tunnel.Close()
-				return
-			}
+	handler := localServer
+	if targetURL != nil {
+		handler = newHTTPForwarder(logger, httpForwarderOptions{
+			Target:             targetURL,
+			HostHeader:         hostHeader,
+			PublicScheme:       tunnel.URL.Scheme,
+			InsecureSkipVerify: insecureSkipVerify,
+		})
+	}
+	if inspectAddress != "" {
+		insp := newInspector(inspectBodyLimit, inspectMaxReqs)
+		handler = insp.Middleware(handler)
 
-			go func() {
-				defer conn.Close()
-
-				dialCtx, dialCancel := context.WithTimeout(ctx.Context, 10*time.Second)
-				defer dialCancel()
-
-				targetConn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", targetAddress)
-				if err != nil {
-					logger.Warn(ctx.Context, "could not dial target", slog.F("target_address", targetAddress), slog.Error(err))
-					return
-				}
-				defer targetConn.Close()
-
-				go func() {
-					_, err := io.Copy(targetConn, conn)
-					if err != nil && !xerrors.Is(err, io.EOF) {
-						logger.Warn(ctx.Context, "could not copy from tunnel to target", slog.Error(err))
-					}
-				}()
-
-				_, err = io.Copy(conn, targetConn)
-				if err != nil && !xerrors.Is(err, io.EOF) {
-					logger.Warn(ctx.Context, "could not copy from target to tunnel", slog.Error(err))
-				}
-			}()
+		inspectListener, err := net.Listen("tcp", inspectAddress)
+		if err != nil {
+			return xerrors.Errorf("listen on inspect-address %q: %w", inspectAddress, err)
 		}
-	}()
+		inspectServer := &http.Server{
+			// See forward.go for why we discard these errors.
+			ErrorLog:          log.New(io.Discard, "", 0),
+			ReadHeaderTimeout: 15 * time.Second,
+			Handler:           insp.Handler(inspectListener.Addr().String()),
+		}
+		defer inspectServer.Close()
+		go func() {
+			_ = inspectServer.Serve(inspectListener)
+		}()
+		_, _ = fmt.Fprintf(os.Stderr, "Inspecting requests at http://%s\n", inspectListener.Addr().String())
+	}
+	var tunnelServer *http.Server
+	if handler != nil {
+		tunnelServer = newTunnelHTTPServer(ctx.Context, handler)
+		go func() {
+			err := tunnelServer.Serve(tunnel.Listener)
+			if err != nil && !xerrors.Is(err, http.ErrServerClosed) && !xerrors.Is(err, net.ErrClosed) {
+				logger.Error(ctx.Context, "close tunnel", slog.Error(err))
+				_ = tunnel.Close()
+			}
+		}()
+	} else {
+		go forwardTCP(ctx.Context, logger, tunnel, target)
+	}
 
 	_, _ = fmt.Printf("\nTunnel is ready! You can now connect to %s\n", tunnel.URL.String())
 
@@ -196,7 +324,14 @@ func runApp(ctx *cli.Context) error {
 	select {
 	case <-notifyCtx.Done():
 		_, _ = fmt.Printf("\nClosing tunnel due to signal...\n")
-		return tunnel.Close()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer shutdownCancel()
+		if tunnelServer != nil {
+			// Closes idle keep-alive connections so the tunnel can drain.
+			_ = tunnelServer.Shutdown(shutdownCtx)
+		}
+		return tunnel.Shutdown(shutdownCtx)
 	case <-tunnel.Wait():
 	}
 
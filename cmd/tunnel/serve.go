@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// newDirHandler returns a handler that serves the files in dir. Files and
+// directories starting with a dot, such as .git and .env, are never served.
+// Directories without an index.html are only listed if listings is true.
+func newDirHandler(dir string, listings bool) (http.Handler, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("stat %q: %w", dir, err)
+	}
+	if !fi.IsDir() {
+		return nil, xerrors.Errorf("%q is not a directory", dir)
+	}
+
+	return http.FileServer(dirFileSystem{fs: http.Dir(dir), listings: listings}), nil
+}
+
+// dirFileSystem hides dot files and directory listings from http.FileServer.
+type dirFileSystem struct {
+	fs       http.FileSystem
+	listings bool
+}
+
+func (d dirFileSystem) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+
+	f, err := d.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return f, nil
+	}
+	if !d.listings {
+		// http.FileServer serves index.html for directories that have one
+		// and lists the rest.
+		index, err := d.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			_ = f.Close()
+			return nil, fs.ErrNotExist
+		}
+		_ = index.Close()
+	}
+	return dotFileHidingDir{File: f}, nil
+}
+
+// dotFileHidingDir leaves dot files out of directory listings.
+type dotFileHidingDir struct {
+	http.File
+}
+
+func (d dotFileHidingDir) Readdir(n int) ([]fs.FileInfo, error) {
+	files, err := d.File.Readdir(n)
+	visible := make([]fs.FileInfo, 0, len(files))
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			visible = append(visible, fi)
+		}
+	}
+	return visible, err
+}
+
+// newEchoHandler returns a handler that responds with a plain text description
+// of the request it received. It's useful for checking connectivity through
+// the tunnel without running a separate local server.
+func newEchoHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(rw, "read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var b strings.Builder
+		_, _ = b.WriteString(r.Method + " " + r.RequestURI + " " + r.Proto + "\n")
+		_, _ = b.WriteString("Host: " + r.Host + "\n")
+
+		keys := make([]string, 0, len(r.Header))
+		for k := range r.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range r.Header[k] {
+				_, _ = b.WriteString(k + ": " + v + "\n")
+			}
+		}
+
+		_, _ = b.WriteString("\n")
+		_, _ = b.WriteString("Remote address: " + r.RemoteAddr + "\n")
+		_, _ = b.WriteString("Body size: " + strconv.FormatInt(n, 10) + " bytes\n")
+		_, _ = b.WriteString("Time: " + time.Now().UTC().Format(time.RFC3339) + "\n")
+
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(b.String()))
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newDirHandler(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+	}
+	writeFile("hello.txt", "hello")
+	writeFile(".env", "SECRET=1")
+	writeFile(".git/config", "[core]")
+	writeFile("site/index.html", "<h1>site</h1>")
+	writeFile("site/.hidden", "hidden")
+
+	get := func(t *testing.T, h http.Handler, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		return rw
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		t.Parallel()
+
+		h, err := newDirHandler(dir, false)
+		require.NoError(t, err)
+
+		rw := get(t, h, "/hello.txt")
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, "hello", rw.Body.String())
+
+		rw = get(t, h, "/site/")
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, "<h1>site</h1>", rw.Body.String())
+
+		for _, path := range []string{"/.env", "/.git/config", "/.git/", "/site/.hidden", "/"} {
+			rw = get(t, h, path)
+			require.Equal(t, http.StatusNotFound, rw.Code, path)
+		}
+	})
+
+	t.Run("Listings", func(t *testing.T) {
+		t.Parallel()
+
+		h, err := newDirHandler(dir, true)
+		require.NoError(t, err)
+
+		rw := get(t, h, "/")
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Contains(t, rw.Body.String(), "hello.txt")
+		require.Contains(t, rw.Body.String(), "site/")
+		require.NotContains(t, rw.Body.String(), ".env")
+		require.NotContains(t, rw.Body.String(), ".git")
+
+		rw = get(t, h, "/.env")
+		require.Equal(t, http.StatusNotFound, rw.Code)
+	})
+
+	t.Run("NotADirectory", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newDirHandler(filepath.Join(dir, "hello.txt"), false)
+		require.ErrorContains(t, err, "is not a directory")
+		_, err = newDirHandler(filepath.Join(dir, "missing"), false)
+		require.Error(t, err)
+	})
+}
+
+func Test_newEchoHandler(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(http.MethodPost, "/foo?bar=baz", strings.NewReader("hello"))
+	r.Host = "abc123.tunnel.dev"
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("X-Test", "value")
+	rw := httptest.NewRecorder()
+	newEchoHandler().ServeHTTP(rw, r)
+
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+	body := rw.Body.String()
+	require.True(t, strings.HasPrefix(body, "POST /foo?bar=baz HTTP/1.1\nHost: abc123.tunnel.dev\n"), body)
+	require.Contains(t, body, "X-Test: value\n")
+	require.Contains(t, body, "Remote address: 10.0.0.2:1234\n")
+	require.Contains(t, body, "Body size: 5 bytes\n")
+}
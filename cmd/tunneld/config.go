@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/wgtunnel/internal/cliconfig"
+	"github.com/coder/wgtunnel/tunneld"
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+// optionsFromContext builds and validates the tunneld options from the flags
+// in ctx. If writeKeyFile is true and wireguard-key-file doesn't exist, a new
+// key is generated and written to it. Otherwise runningKey is used if it's set,
+// so reloads don't report a new key every time, or a key is generated in
+// memory.
+func optionsFromContext(ctx *cli.Context, logger slog.Logger, writeKeyFile bool, runningKey tunnelsdk.Key) (*tunneld.Options, error) {
+	var (
+		proxyAccessLogRate     = ctx.Float64("proxy-access-log-sample-rate")
+		baseURL                = ctx.String("base-url")
+		wireguardEndpoint      = ctx.String("wireguard-endpoint")
+		wireguardPort          = ctx.Uint("wireguard-port")
+		wireguardKey           = ctx.String("wireguard-key")
+		wireguardKeyFile       = ctx.String("wireguard-key-file")
+		wireguardMTU           = ctx.Int("wireguard-mtu")
+		wireguardServerIP      = ctx.String("wireguard-server-ip")
+		wireguardNetworkPrefix = ctx.String("wireguard-network-prefix")
+		previousPrefixes       = ctx.StringSlice("wireguard-previous-network-prefixes")
+		ipAssignmentTTL        = ctx.Duration("wireguard-ip-assignment-ttl")
+		realIPHeader           = ctx.String("real-ip-header")
+		peerDialTimeout        = ctx.Duration("peer-dial-timeout")
+		peerRegisterInterval   = ctx.Duration("peer-register-interval")
+		peerTimeout            = ctx.Duration("peer-timeout")
+		apiRateLimit           = ctx.Int("api-rate-limit")
+		apiRateLimitWindow     = ctx.Duration("api-rate-limit-window")
+		disableLegacyEndpoint  = ctx.Bool("disable-legacy-endpoint")
+		disableOldFormatURLs   = ctx.Bool("disable-old-format-urls")
+		rejectOldFormatURLs    = ctx.Bool("reject-old-format-urls")
+		minimumClientVersion   = ctx.String("minimum-client-version")
+		clientDownloadURL      = ctx.String("client-download-url")
+	)
+	if baseURL == "" {
+		return nil, xerrors.New("base-url is required. See --help for more information.")
+	}
+	if wireguardEndpoint == "" {
+		return nil, xerrors.New("wireguard-endpoint is required. See --help for more information.")
+	}
+	if wireguardPort < 1 || wireguardPort > 65535 {
+		return nil, xerrors.New("wireguard-port is required and must be between 1 and 65535. See --help for more information.")
+	}
+	if wireguardKey == "" && wireguardKeyFile == "" {
+		return nil, xerrors.New("wireguard-key is required. See --help for more information.")
+	}
+	if wireguardKey != "" && wireguardKeyFile != "" {
+		return nil, xerrors.New("wireguard-key and wireguard-key-file are mutually exclusive. See --help for more information.")
+	}
+
+	baseURLParsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, xerrors.Errorf("could not parse base-url %q: %w", baseURL, err)
+	}
+	wireguardServerIPParsed, err := netip.ParseAddr(wireguardServerIP)
+	if err != nil {
+		return nil, xerrors.Errorf("could not parse wireguard-server-ip %q: %w", wireguardServerIP, err)
+	}
+	wireguardNetworkPrefixParsed, err := netip.ParsePrefix(wireguardNetworkPrefix)
+	if err != nil {
+		return nil, xerrors.Errorf("could not parse wireguard-network-prefix %q: %w", wireguardNetworkPrefix, err)
+	}
+	if wireguardNetworkPrefixParsed.Addr().Is4() && !ctx.IsSet("wireguard-server-ip") {
+		// The default server IP is IPv6, let the options pick one in the
+		// network instead.
+		wireguardServerIPParsed = netip.Addr{}
+	}
+	var previousPrefixesParsed []netip.Prefix
+	for _, prefix := range previousPrefixes {
+		parsed, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			return nil, xerrors.Errorf("could not parse wireguard-previous-network-prefixes entry %q: %w", prefix, err)
+		}
+		previousPrefixesParsed = append(previousPrefixesParsed, parsed)
+	}
+
+	var wireguardKeyParsed tunnelsdk.Key
+	if wireguardKeyFile != "" {
+		_, err = os.Stat(wireguardKeyFile)
+		if errors.Is(err, os.ErrNotExist) && !writeKeyFile && !runningKey.IsZero() {
+			wireguardKeyParsed = runningKey
+		} else if errors.Is(err, os.ErrNotExist) {
+			wireguardKeyParsed, err = tunnelsdk.GeneratePrivateKey()
+			if err != nil {
+				return nil, xerrors.Errorf("could not generate private key: %w", err)
+			}
+
+			if writeKeyFile {
+				logger.Info(ctx.Context, "generating private key to file", slog.F("path", wireguardKeyFile))
+				err = writeWireguardKeyFile(ctx, wireguardKeyFile, wireguardKeyParsed)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else if err != nil {
+			return nil, xerrors.Errorf("could not stat wireguard-key-file %q: %w", wireguardKeyFile, err)
+		} else {
+			logger.Info(ctx.Context, "reading private key from file", slog.F("path", wireguardKeyFile))
+			wireguardKeyBytes, err := os.ReadFile(wireguardKeyFile)
+			if err != nil {
+				return nil, xerrors.Errorf("could not read wireguard-key-file %q: %w", wireguardKeyFile, err)
+			}
+			wireguardKeyParsed, err = tunnelsdk.ParsePrivateKeyFile(wireguardKeyBytes, keyPassphrase(ctx, false))
+			if err != nil {
+				return nil, xerrors.Errorf("could not parse wireguard-key-file %q: %w", wireguardKeyFile, err)
+			}
+		}
+	} else {
+		wireguardKeyParsed, err = tunnelsdk.ParsePrivateKey(wireguardKey)
+		if err != nil {
+			return nil, xerrors.Errorf("could not parse wireguard-key: %w", err)
+		}
+	}
+	logger.Info(ctx.Context, "parsed private key", slog.F("hash", wireguardKeyParsed.Hash()))
+
+	var (
+		nextKeyFile      = nextKeyFilePath(ctx)
+		wireguardNextKey tunnelsdk.Key
+		keyRotationTime  time.Time
+	)
+	if nextKeyFile != "" {
+		var next nextKey
+		next, wireguardNextKey, err = readNextKeyFile(ctx, nextKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keyRotationTime = next.RotationTime
+		if !wireguardNextKey.IsZero() && !time.Now().Before(keyRotationTime) && writeKeyFile && wireguardKeyFile != "" {
+			err = promoteNextKey(ctx, logger, wireguardKeyFile, nextKeyFile, next)
+			if err != nil {
+				return nil, err
+			}
+			wireguardKeyParsed = wireguardNextKey
+			wireguardNextKey, keyRotationTime = tunnelsdk.Key{}, time.Time{}
+		}
+	}
+
+	options := &tunneld.Options{
+		Log:                              logger,
+		BaseURL:                          baseURLParsed,
+		WireguardEndpoint:                wireguardEndpoint,
+		WireguardPort:                    uint16(wireguardPort),
+		WireguardKey:                     wireguardKeyParsed,
+		WireguardNextKey:                 wireguardNextKey,
+		WireguardKeyRotationTime:         keyRotationTime,
+		WireguardMTU:                     wireguardMTU,
+		WireguardServerIP:                wireguardServerIPParsed,
+		WireguardNetworkPrefix:           wireguardNetworkPrefixParsed,
+		WireguardPreviousNetworkPrefixes: previousPrefixesParsed,
+		WireguardIPAssignmentsFile:       ipAssignmentsFilePath(ctx),
+		WireguardIPAssignmentTTL:         ipAssignmentTTL,
+		RealIPHeader:                     realIPHeader,
+		PeerDialTimeout:                  peerDialTimeout,
+		PeerRegisterInterval:             peerRegisterInterval,
+		PeerTimeout:                      peerTimeout,
+		APIRateLimit:                     apiRateLimit,
+		APIRateLimitWindow:               apiRateLimitWindow,
+		DisableProxyAccessLogs:           proxyAccessLogRate == 0,
+		DisableLegacyEndpoint:            disableLegacyEndpoint,
+		DisableOldFormatURLs:             disableOldFormatURLs,
+		RejectOldFormatURLs:              rejectOldFormatURLs,
+		MinimumClientVersion:             minimumClientVersion,
+		ClientDownloadURL:                clientDownloadURL,
+	}
+	if proxyAccessLogRate != 0 {
+		options.ProxyAccessLogSampleRate = proxyAccessLogRate
+	}
+
+	err = options.Validate()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid configuration: %w", err)
+	}
+	return options, nil
+}
+
+// printConfig prints the effective configuration after merging the config
+// file, environment variables and flags.
+func printConfig(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), appFlags)
+	if err != nil {
+		return err
+	}
+
+	// Validate the configuration without side effects.
+	_, err = optionsFromContext(ctx, slog.Make(), false, tunnelsdk.Key{})
+	if err != nil {
+		return err
+	}
+
+	out, err := cliconfig.Marshal(ctx, appFlags, secretFlags...)
+	if err != nil {
+		return xerrors.Errorf("marshal config: %w", err)
+	}
+	_, err = ctx.App.Writer.Write(out)
+	return err
+}
+
+// restartFlags are flags that only take effect when tunneld is started, in
+// addition to the options reported by (*tunneld.API).Reload.
+var restartFlags = []string{
+	"verbose",
+	"log-format",
+	"log-file",
+	"listen-address",
+	"shutdown-timeout",
+	"pprof-listen-address",
+	"tracing-honeycomb-team",
+	"tracing-instance-id",
+}
+
+// reloadConfig parses the flags, environment variables and config file again
+// and applies the result to td. Invalid configurations are logged and not
+// applied.
+func reloadConfig(ctx *cli.Context, logger slog.Logger, td *tunneld.API) {
+	logger.Info(ctx.Context, "reloading configuration")
+
+	newCtx, err := reloadContext(ctx)
+	if err != nil {
+		logger.Error(ctx.Context, "refusing to apply invalid configuration", slog.Error(err))
+		return
+	}
+	options, err := optionsFromContext(newCtx, logger, false, td.CurrentOptions().WireguardKey)
+	if err != nil {
+		logger.Error(ctx.Context, "refusing to apply invalid configuration", slog.Error(err))
+		return
+	}
+	res, err := td.Reload(options)
+	if err != nil {
+		logger.Error(ctx.Context, "refusing to apply invalid configuration", slog.Error(err))
+		return
+	}
+
+	var changedFlags []string
+	for _, name := range restartFlags {
+		if fmt.Sprint(ctx.Value(name)) != fmt.Sprint(newCtx.Value(name)) {
+			changedFlags = append(changedFlags, name)
+		}
+	}
+
+	logger.Info(ctx.Context, "reloaded configuration", slog.F("changed", res.Changed))
+	if len(res.RestartRequired) > 0 || len(changedFlags) > 0 {
+		logger.Warn(ctx.Context, "some settings changed but require a restart to take effect",
+			slog.F("options", res.RestartRequired),
+			slog.F("flags", changedFlags),
+		)
+	}
+}
+
+// reloadContext returns a new context with the command line flags and
+// environment variables parsed again and the current contents of the config
+// file loaded.
+func reloadContext(ctx *cli.Context) (*cli.Context, error) {
+	set := flag.NewFlagSet(ctx.App.Name, flag.ContinueOnError)
+	set.SetOutput(io.Discard)
+	for _, f := range appFlags {
+		err := f.Apply(set)
+		if err != nil {
+			return nil, xerrors.Errorf("apply flag %q: %w", f.Names()[0], err)
+		}
+	}
+	err := set.Parse(os.Args[1:])
+	if err != nil {
+		return nil, xerrors.Errorf("parse flags: %w", err)
+	}
+
+	// Each alias is registered as a separate flag, so copy values set through
+	// an alias to the flag's name like cli does when it parses flags.
+	visited := make(map[string]bool)
+	set.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+	for _, f := range appFlags {
+		names := f.Names()
+		for _, alias := range names[1:] {
+			if !visited[alias] || visited[names[0]] {
+				continue
+			}
+			err = set.Set(names[0], set.Lookup(alias).Value.String())
+			if err != nil {
+				return nil, xerrors.Errorf("set flag %q: %w", names[0], err)
+			}
+			visited[names[0]] = true
+		}
+	}
+
+	newCtx := cli.NewContext(ctx.App, set, nil)
+	newCtx.Context = ctx.Context
+	err = cliconfig.Load(newCtx, newCtx.String("config"), appFlags)
+	if err != nil {
+		return nil, err
+	}
+	return newCtx, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"gopkg.in/yaml.v3"
+
+	"cdr.dev/slog"
+	"github.com/coder/wgtunnel/internal/cliconfig"
+	"github.com/coder/wgtunnel/internal/keyfile"
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+// nextKey is the contents of the file written by "tunneld keys rotate".
+type nextKey struct {
+	// Key is the contents of a key file, so it's either a base64 encoded key
+	// or an encrypted key.
+	Key          string    `yaml:"key"`
+	RotationTime time.Time `yaml:"rotation_time"`
+}
+
+var (
+	promptedPassphraseMu sync.Mutex
+	promptedPassphrase   []byte
+)
+
+// keyPassphrase returns a function that returns the passphrase for encrypted
+// key files. A passphrase entered at the prompt is remembered, so reloading
+// the configuration doesn't prompt again. If confirm is true, the passphrase
+// is asked for twice when prompting.
+func keyPassphrase(ctx *cli.Context, confirm bool) func() ([]byte, error) {
+	source := keyfile.PassphraseSource{
+		EnvVar:      "TUNNELD_WIREGUARD_KEY_PASSPHRASE",
+		File:        ctx.String("wireguard-key-passphrase-file"),
+		Interactive: true,
+	}
+	return func() ([]byte, error) {
+		if source.Configured() {
+			return source.Passphrase(confirm)
+		}
+
+		promptedPassphraseMu.Lock()
+		defer promptedPassphraseMu.Unlock()
+		if promptedPassphrase != nil {
+			return promptedPassphrase, nil
+		}
+		passphrase, err := source.Passphrase(confirm)
+		if errors.Is(err, keyfile.ErrNoPassphrase) {
+			return nil, xerrors.New("a passphrase is required for encrypted key files, set TUNNELD_WIREGUARD_KEY_PASSPHRASE or wireguard-key-passphrase-file, or run tunneld in a terminal.")
+		}
+		if err != nil {
+			return nil, err
+		}
+		promptedPassphrase = passphrase
+		return passphrase, nil
+	}
+}
+
+// encodeKey returns the contents of a key file for key. The key is encrypted
+// if encrypt is true.
+func encodeKey(ctx *cli.Context, key tunnelsdk.Key, encrypt bool) ([]byte, error) {
+	var passphrase []byte
+	if encrypt {
+		var err error
+		passphrase, err = keyPassphrase(ctx, true)()
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := keyfile.Encode(key, passphrase)
+	if err != nil {
+		return nil, xerrors.Errorf("encode key: %w", err)
+	}
+	return data, nil
+}
+
+// writeWireguardKeyFile writes key to path, encrypted if
+// encrypt-wireguard-key-file is set.
+func writeWireguardKeyFile(ctx *cli.Context, path string, key tunnelsdk.Key) error {
+	data, err := encodeKey(ctx, key, ctx.Bool("encrypt-wireguard-key-file"))
+	if err != nil {
+		return err
+	}
+	err = keyfile.Write(path, data)
+	if err != nil {
+		return xerrors.Errorf("could not write private key to %q: %w", path, err)
+	}
+	return nil
+}
+
+// nextKeyFilePath returns the path of the next key file, or an empty string if
+// key rotation isn't configured.
+func nextKeyFilePath(ctx *cli.Context) string {
+	if p := ctx.String("wireguard-next-key-file"); p != "" {
+		return p
+	}
+	if p := ctx.String("wireguard-key-file"); p != "" {
+		return p + ".next"
+	}
+	return ""
+}
+
+// ipAssignmentsFilePath returns the path of the IPv4 client IP assignments
+// file, defaulting to the key file path with a .ips suffix.
+func ipAssignmentsFilePath(ctx *cli.Context) string {
+	if p := ctx.String("wireguard-ip-assignments-file"); p != "" {
+		return p
+	}
+	if p := ctx.String("wireguard-key-file"); p != "" {
+		return p + ".ips"
+	}
+	return ""
+}
+
+// readNextKeyFile reads a next key file and parses the key in it. It returns
+// zero values and no error if the file doesn't exist.
+func readNextKeyFile(ctx *cli.Context, path string) (nextKey, tunnelsdk.Key, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nextKey{}, tunnelsdk.Key{}, nil
+	}
+	if err != nil {
+		return nextKey{}, tunnelsdk.Key{}, xerrors.Errorf("read next key file %q: %w", path, err)
+	}
+
+	var next nextKey
+	err = yaml.Unmarshal(data, &next)
+	if err != nil {
+		return nextKey{}, tunnelsdk.Key{}, xerrors.Errorf("parse next key file %q: %w", path, err)
+	}
+	key, err := tunnelsdk.ParsePrivateKeyFile([]byte(next.Key), keyPassphrase(ctx, false))
+	if err != nil {
+		return nextKey{}, tunnelsdk.Key{}, xerrors.Errorf("parse key in next key file %q: %w", path, err)
+	}
+	if next.RotationTime.IsZero() {
+		return nextKey{}, tunnelsdk.Key{}, xerrors.Errorf("next key file %q has no rotation_time", path)
+	}
+	return next, key, nil
+}
+
+// writeNextKeyFile writes a next key file.
+func writeNextKeyFile(path string, next nextKey) error {
+	data, err := yaml.Marshal(next)
+	if err != nil {
+		return xerrors.Errorf("marshal next key: %w", err)
+	}
+	err = keyfile.Write(path, data)
+	if err != nil {
+		return xerrors.Errorf("write next key file %q: %w", path, err)
+	}
+	return nil
+}
+
+// promoteNextKey replaces the key in keyFile with the next key once its
+// rotation time has passed, and removes the next key file. The next key is
+// written as is, so it stays encrypted if it was.
+func promoteNextKey(ctx *cli.Context, logger slog.Logger, keyFile, nextKeyFile string, next nextKey) error {
+	logger.Info(ctx.Context, "key rotation time has passed, replacing private key file with next key",
+		slog.F("path", keyFile),
+		slog.F("next_key_path", nextKeyFile),
+	)
+	err := keyfile.Write(keyFile, []byte(next.Key))
+	if err != nil {
+		return xerrors.Errorf("could not write private key to %q: %w", keyFile, err)
+	}
+	err = os.Remove(nextKeyFile)
+	if err != nil {
+		return xerrors.Errorf("remove next key file %q: %w", nextKeyFile, err)
+	}
+	return nil
+}
+
+// rotateKeys generates the next wireguard key and schedules the rotation by
+// writing it to the next key file. The next key is encrypted if
+// encrypt-wireguard-key-file is set or the current key file is encrypted.
+func rotateKeys(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), appFlags)
+	if err != nil {
+		return err
+	}
+
+	var (
+		keyFile     = ctx.String("wireguard-key-file")
+		nextKeyFile = nextKeyFilePath(ctx)
+		peerTimeout = ctx.Duration("peer-timeout")
+		in          = ctx.Duration("in")
+	)
+	if keyFile == "" {
+		return xerrors.New("key rotation requires wireguard-key-file to be set.")
+	}
+	// Clients learn about the next key when they re-register, so every client
+	// that is still connected needs a chance to re-register first.
+	if in < peerTimeout {
+		return xerrors.Errorf("--in (%s) must be at least peer-timeout (%s) so all clients learn about the next key before the rotation.", in, peerTimeout)
+	}
+
+	existing, existingKey, err := readNextKeyFile(ctx, nextKeyFile)
+	if err != nil {
+		return err
+	}
+	if !existingKey.IsZero() && time.Now().Before(existing.RotationTime) {
+		return xerrors.Errorf("a key rotation is already scheduled for %s in %q.", existing.RotationTime.Format(time.RFC3339), nextKeyFile)
+	}
+	// A running server switches to the next key at the rotation time, but the
+	// key file is only replaced when it starts. Promote the overdue key before
+	// the next key file is overwritten, or the key in use would be lost.
+	if !existingKey.IsZero() {
+		err = promoteNextKey(ctx, slog.Make(), keyFile, nextKeyFile, existing)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(ctx.App.Writer, "Replaced %q with the key from the rotation at %s.\n", keyFile, existing.RotationTime.Format(time.RFC3339))
+	}
+	currentKeyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return xerrors.Errorf("read wireguard-key-file %q: %w", keyFile, err)
+	}
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	if err != nil {
+		return xerrors.Errorf("could not generate private key: %w", err)
+	}
+	encrypt := ctx.Bool("encrypt-wireguard-key-file") || tunnelsdk.IsEncryptedPrivateKey(currentKeyData)
+	keyData, err := encodeKey(ctx, key, encrypt)
+	if err != nil {
+		return err
+	}
+	next := nextKey{
+		Key:          string(keyData),
+		RotationTime: time.Now().Add(in).UTC().Truncate(time.Second),
+	}
+	err = writeNextKeyFile(nextKeyFile, next)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return xerrors.Errorf("get public key: %w", err)
+	}
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Scheduled rotation to public key %s at %s in %q.\n", publicKey, next.RotationTime.Format(time.RFC3339), nextKeyFile)
+	_, _ = fmt.Fprintln(ctx.App.Writer, "Reload tunneld (e.g. send it SIGHUP) or restart it to start advertising the next key to clients.")
+	return nil
+}
+
+// encryptKeys encrypts the plain wireguard key file and next key file in
+// place, so key files written by older versions can be migrated.
+func encryptKeys(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), appFlags)
+	if err != nil {
+		return err
+	}
+
+	var (
+		keyFile     = ctx.String("wireguard-key-file")
+		nextKeyFile = nextKeyFilePath(ctx)
+	)
+	if keyFile == "" {
+		return xerrors.New("wireguard-key-file must be set, only key files can be encrypted.")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return xerrors.Errorf("read wireguard-key-file %q: %w", keyFile, err)
+	}
+	if tunnelsdk.IsEncryptedPrivateKey(data) {
+		_, _ = fmt.Fprintf(ctx.App.Writer, "%s is already encrypted.\n", keyFile)
+	} else {
+		key, err := tunnelsdk.ParsePrivateKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return xerrors.Errorf("could not parse wireguard-key-file %q: %w", keyFile, err)
+		}
+		data, err = encodeKey(ctx, key, true)
+		if err != nil {
+			return err
+		}
+		err = keyfile.Write(keyFile, data)
+		if err != nil {
+			return xerrors.Errorf("could not write private key to %q: %w", keyFile, err)
+		}
+		_, _ = fmt.Fprintf(ctx.App.Writer, "Encrypted %s.\n", keyFile)
+	}
+
+	next, nextKeyParsed, err := readNextKeyFile(ctx, nextKeyFile)
+	if err != nil {
+		return err
+	}
+	if nextKeyParsed.IsZero() {
+		return nil
+	}
+	if tunnelsdk.IsEncryptedPrivateKey([]byte(next.Key)) {
+		_, _ = fmt.Fprintf(ctx.App.Writer, "%s is already encrypted.\n", nextKeyFile)
+		return nil
+	}
+	data, err = encodeKey(ctx, nextKeyParsed, true)
+	if err != nil {
+		return err
+	}
+	next.Key = string(data)
+	err = writeNextKeyFile(nextKeyFile, next)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(ctx.App.Writer, "Encrypted %s.\n", nextKeyFile)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"cdr.dev/slog/sloggers/sloghuman"
+	"cdr.dev/slog/sloggers/slogjson"
+)
+
+const (
+	logFormatHuman = "human"
+	logFormatJSON  = "json"
+)
+
+// newLogger creates a logger that writes in the given format to the given
+// file, or stderr if file is empty. The returned function closes the file.
+func newLogger(format, file string, verbose bool) (slog.Logger, func(), error) {
+	var (
+		w       io.Writer = os.Stderr
+		closeFn           = func() {}
+	)
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return slog.Logger{}, nil, xerrors.Errorf("open log-file %q: %w", file, err)
+		}
+		w = f
+		closeFn = func() {
+			_ = f.Close()
+		}
+	}
+
+	var sink slog.Sink
+	switch format {
+	case logFormatHuman:
+		sink = sloghuman.Sink(w)
+	case logFormatJSON:
+		sink = slogjson.Sink(w)
+	default:
+		closeFn()
+		return slog.Logger{}, nil, xerrors.Errorf("log-format must be %q or %q, got %q. See --help for more information.", logFormatHuman, logFormatJSON, format)
+	}
+
+	logger := slog.Make(sink).Leveled(slog.LevelInfo)
+	if verbose {
+		logger = logger.Leveled(slog.LevelDebug)
+	}
+	return logger, closeFn, nil
+}
@@ -3,12 +3,11 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"io"
 	"log"
 	"net/http"
 	"net/http/pprof"
-	"net/netip"
-	"net/url"
 	"os"
 	"os/signal"
 	"time"
@@ -22,12 +21,226 @@ import (
 	"golang.org/x/xerrors"
 
 	"cdr.dev/slog"
-	"cdr.dev/slog/sloggers/sloghuman"
 	"github.com/coder/wgtunnel/buildinfo"
+	"github.com/coder/wgtunnel/internal/cliconfig"
 	"github.com/coder/wgtunnel/tunneld"
 	"github.com/coder/wgtunnel/tunnelsdk"
 )
 
+// secretFlags are redacted when printing the configuration.
+var secretFlags = []string{"wireguard-key", "tracing-honeycomb-team"}
+
+var appFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "config",
+		Aliases: []string{"c"},
+		Usage:   "Path to a YAML config file. Keys are flag names. Flags and environment variables take precedence over the config file.",
+		EnvVars: []string{"TUNNELD_CONFIG"},
+	},
+	&cli.BoolFlag{
+		Name:    "verbose",
+		Aliases: []string{"v"},
+		Usage:   "Enable verbose logging.",
+		EnvVars: []string{"TUNNELD_VERBOSE"},
+	},
+	&cli.StringFlag{
+		Name:    "log-format",
+		Usage:   "The log format, either human or json.",
+		Value:   logFormatHuman,
+		EnvVars: []string{"TUNNELD_LOG_FORMAT"},
+	},
+	&cli.StringFlag{
+		Name:    "log-file",
+		Usage:   "Append logs to the given file instead of writing them to stderr.",
+		EnvVars: []string{"TUNNELD_LOG_FILE"},
+	},
+	&cli.Float64Flag{
+		Name:    "proxy-access-log-sample-rate",
+		Usage:   "The fraction of requests proxied to tunnels to write access logs for, between 0 and 1. Set to 0 to disable proxy access logs. API requests are always logged.",
+		Value:   1,
+		EnvVars: []string{"TUNNELD_PROXY_ACCESS_LOG_SAMPLE_RATE"},
+	},
+	&cli.StringFlag{
+		Name:    "listen-address",
+		Aliases: []string{"a"},
+		Usage:   "HTTP listen address for the API and tunnel traffic.",
+		Value:   "127.0.0.1:8080",
+		EnvVars: []string{"TUNNELD_LISTEN_ADDRESS"},
+	},
+	&cli.StringFlag{
+		Name:    "base-url",
+		Aliases: []string{"u"},
+		Usage:   "The base URL to use for the tunnel, including scheme. All tunnels will be subdomains of this hostname.",
+		EnvVars: []string{"TUNNELD_BASE_URL"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-endpoint",
+		Aliases: []string{"wg-endpoint"},
+		Usage:   "The UDP address advertised to clients that they will connect to for wireguard connections. It should be in the form host:port.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_ENDPOINT"},
+	},
+	// Technically a uint16.
+	&cli.UintFlag{
+		Name:    "wireguard-port",
+		Aliases: []string{"wg-port"},
+		Usage:   "The UDP port that the wireguard server will listen on. It should be the same as the port in wireguard-endpoint.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_PORT"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-key",
+		Aliases: []string{"wg-key"},
+		Usage:   "The private key for the wireguard server. It should be base64 encoded. You can generate a key with `wg genkey`. Mutually exclusive with wireguard-key-file.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_KEY"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-key-file",
+		Aliases: []string{"wg-key-file"},
+		Usage:   "The file path containing the private key for the wireguard server. The contents should be base64 encoded, or a key encrypted with a passphrase. If the file does not exist, a key will be generated for you and written to the file. Mutually exclusive with wireguard-key.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_KEY_FILE"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-key-passphrase-file",
+		Aliases: []string{"wg-key-passphrase-file"},
+		Usage:   "The file path containing the passphrase for encrypted key files. The passphrase can also be set with the TUNNELD_WIREGUARD_KEY_PASSPHRASE environment variable, otherwise it's prompted for if stdin is a terminal.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_KEY_PASSPHRASE_FILE"},
+	},
+	&cli.BoolFlag{
+		Name:    "encrypt-wireguard-key-file",
+		Usage:   "Encrypt key files written by tunneld with a passphrase. Existing key files can be encrypted with the keys encrypt command.",
+		EnvVars: []string{"TUNNELD_ENCRYPT_WIREGUARD_KEY_FILE"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-next-key-file",
+		Aliases: []string{"wg-next-key-file"},
+		Usage:   "The file path containing the next private key for the wireguard server and when to switch to it, as written by the keys rotate command. Defaults to wireguard-key-file with a .next suffix.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_NEXT_KEY_FILE"},
+	},
+	&cli.IntFlag{
+		Name:    "wireguard-mtu",
+		Aliases: []string{"wg-mtu"},
+		Usage:   "The MTU to use for the wireguard interface.",
+		Value:   tunneld.DefaultWireguardMTU,
+		EnvVars: []string{"TUNNELD_WIREGUARD_MTU"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-server-ip",
+		Aliases: []string{"wg-server-ip"},
+		Usage:   "The virtual IP address of this server in the wireguard network. Must be an address of the same family contained within wireguard-network-prefix. Defaults to the first address in wireguard-network-prefix if it's an IPv4 CIDR.",
+		Value:   tunneld.DefaultWireguardServerIP.String(),
+		EnvVars: []string{"TUNNELD_WIREGUARD_SERVER_IP"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-network-prefix",
+		Aliases: []string{"wg-network-prefix"},
+		Usage:   "The CIDR of the wireguard network. All client IPs will be generated within this network. IPv6 CIDRs must have at least 64 bits available. IPv4 CIDRs such as 100.64.0.0/10 are supported for clients without IPv6, with client IPs assigned by the server and stored in wireguard-ip-assignments-file.",
+		Value:   tunneld.DefaultWireguardNetworkPrefix.String(),
+		EnvVars: []string{"TUNNELD_WIREGUARD_NETWORK_PREFIX"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "wireguard-previous-network-prefixes",
+		Aliases: []string{"wg-previous-network-prefixes"},
+		Usage:   "Network prefixes that wireguard-network-prefix was changed from. Old format tunnel URLs issued under them keep working, and clients move to the new prefix when they re-register.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_PREVIOUS_NETWORK_PREFIXES"},
+	},
+	&cli.StringFlag{
+		Name:    "wireguard-ip-assignments-file",
+		Aliases: []string{"wg-ip-assignments-file"},
+		Usage:   "The file path where client IPs assigned in an IPv4 wireguard-network-prefix are stored so tunnel URLs stay stable across restarts. Defaults to wireguard-key-file with a .ips suffix.",
+		EnvVars: []string{"TUNNELD_WIREGUARD_IP_ASSIGNMENTS_FILE"},
+	},
+	&cli.DurationFlag{
+		Name:    "wireguard-ip-assignment-ttl",
+		Aliases: []string{"wg-ip-assignment-ttl"},
+		Usage:   "How long a client IP assigned in an IPv4 wireguard-network-prefix is kept for a tunnel that stops registering. Expired IPs are given to new tunnels, whose URLs then point at the new tunnel. Must be at least twice peer-timeout. Set to a negative value to keep assignments forever.",
+		Value:   tunneld.DefaultWireguardIPAssignmentTTL,
+		EnvVars: []string{"TUNNELD_WIREGUARD_IP_ASSIGNMENT_TTL"},
+	},
+	&cli.StringFlag{
+		Name:    "real-ip-header",
+		Usage:   "Use the given header as the real IP address rather than the remote socket address.",
+		Value:   "",
+		EnvVars: []string{"TUNNELD_REAL_IP_HEADER"},
+	},
+	&cli.DurationFlag{
+		Name:    "peer-dial-timeout",
+		Usage:   "The timeout for dialing a peer when proxying a request to its tunnel.",
+		Value:   tunneld.DefaultPeerDialTimeout,
+		EnvVars: []string{"TUNNELD_PEER_DIAL_TIMEOUT"},
+	},
+	&cli.DurationFlag{
+		Name:    "peer-register-interval",
+		Usage:   "How often clients should re-register. The server jitters the interval for each client, shortens it for clients that haven't completed a wireguard handshake, and spreads clients out further under load. Clients never wait longer than the interval. Must be less than peer-timeout.",
+		Value:   tunneld.DefaultPeerPollDuration,
+		EnvVars: []string{"TUNNELD_PEER_REGISTER_INTERVAL"},
+	},
+	&cli.DurationFlag{
+		Name:    "peer-timeout",
+		Usage:   "How long after its last registration a peer is considered disconnected.",
+		Value:   tunneld.DefaultPeerTimeout,
+		EnvVars: []string{"TUNNELD_PEER_TIMEOUT"},
+	},
+	&cli.IntFlag{
+		Name:    "api-rate-limit",
+		Usage:   "The number of API requests allowed per client IP in each api-rate-limit-window. Server info and registration challenge requests aren't counted. Set to a negative value to disable rate limiting.",
+		Value:   tunneld.DefaultAPIRateLimit,
+		EnvVars: []string{"TUNNELD_API_RATE_LIMIT"},
+	},
+	&cli.DurationFlag{
+		Name:    "api-rate-limit-window",
+		Usage:   "The window for api-rate-limit.",
+		Value:   tunneld.DefaultAPIRateLimitWindow,
+		EnvVars: []string{"TUNNELD_API_RATE_LIMIT_WINDOW"},
+	},
+	&cli.BoolFlag{
+		Name:    "disable-legacy-endpoint",
+		Usage:   "Respond with a 404 to the legacy /tun endpoint used by old versions of Coder.",
+		EnvVars: []string{"TUNNELD_DISABLE_LEGACY_ENDPOINT"},
+	},
+	&cli.BoolFlag{
+		Name:    "disable-old-format-urls",
+		Usage:   "Stop giving clients the 32 character old format tunnel URL. Old format URLs are still accepted unless reject-old-format-urls is set.",
+		EnvVars: []string{"TUNNELD_DISABLE_OLD_FORMAT_URLS"},
+	},
+	&cli.BoolFlag{
+		Name:    "reject-old-format-urls",
+		Usage:   "Reject requests to tunnels that use old format URLs. Requires disable-old-format-urls.",
+		EnvVars: []string{"TUNNELD_REJECT_OLD_FORMAT_URLS"},
+	},
+	&cli.StringFlag{
+		Name:    "minimum-client-version",
+		Usage:   "The oldest client version allowed to register, e.g. v0.2.0. Clients that don't report a version, including legacy clients, are rejected when set.",
+		EnvVars: []string{"TUNNELD_MINIMUM_CLIENT_VERSION"},
+	},
+	&cli.StringFlag{
+		Name:    "client-download-url",
+		Usage:   "Where clients rejected by minimum-client-version are told to download a newer version.",
+		Value:   tunneld.DefaultClientDownloadURL,
+		EnvVars: []string{"TUNNELD_CLIENT_DOWNLOAD_URL"},
+	},
+	&cli.DurationFlag{
+		Name:    "shutdown-timeout",
+		Usage:   "How long to wait for in-flight requests and proxied connections to finish when shutting down.",
+		Value:   30 * time.Second,
+		EnvVars: []string{"TUNNELD_SHUTDOWN_TIMEOUT"},
+	},
+	&cli.StringFlag{
+		Name:    "pprof-listen-address",
+		Usage:   "The address to listen on for pprof and expvar, which includes legacy usage counters at /debug/vars. If set to an empty string, pprof will not be enabled.",
+		Value:   "127.0.0.1:6060",
+		EnvVars: []string{"TUNNELD_PPROF_LISTEN_ADDRESS"},
+	},
+	&cli.StringFlag{
+		Name:    "tracing-honeycomb-team",
+		Usage:   "The Honeycomb team ID to send tracing data to. If not specified, tracing will not be shipped anywhere.",
+		EnvVars: []string{"TUNNELD_TRACING_HONEYCOMB_TEAM"},
+	},
+	&cli.StringFlag{
+		Name:    "tracing-instance-id",
+		Usage:   "The instance ID to annotate all traces with that uniquely identifies this deployment.",
+		EnvVars: []string{"TUNNELD_TRACING_INSTANCE_ID"},
+	},
+}
+
 func main() {
 	cli.VersionFlag = &cli.BoolFlag{
 		Name:    "version",
@@ -39,96 +252,44 @@ func main() {
 		Name:    "tunneld",
 		Usage:   "run a wgtunnel server",
 		Version: buildinfo.Version(),
-		Flags: []cli.Flag{
-			&cli.BoolFlag{
-				Name:    "verbose",
-				Aliases: []string{"v"},
-				Usage:   "Enable verbose logging.",
-				EnvVars: []string{"TUNNELD_VERBOSE"},
-			},
-			&cli.StringFlag{
-				Name:    "listen-address",
-				Aliases: []string{"a"},
-				Usage:   "HTTP listen address for the API and tunnel traffic.",
-				Value:   "127.0.0.1:8080",
-				EnvVars: []string{"TUNNELD_LISTEN_ADDRESS"},
-			},
-			&cli.StringFlag{
-				Name:    "base-url",
-				Aliases: []string{"u"},
-				Usage:   "The base URL to use for the tunnel, including scheme. All tunnels will be subdomains of this hostname.",
-				EnvVars: []string{"TUNNELD_BASE_URL"},
-			},
-			&cli.StringFlag{
-				Name:    "wireguard-endpoint",
-				Aliases: []string{"wg-endpoint"},
-				Usage:   "The UDP address advertised to clients that they will connect to for wireguard connections. It should be in the form host:port.",
-				EnvVars: []string{"TUNNELD_WIREGUARD_ENDPOINT"},
-			},
-			// Technically a uint16.
-			&cli.UintFlag{
-				Name:    "wireguard-port",
-				Aliases: []string{"wg-port"},
-				Usage:   "The UDP port that the wireguard server will listen on. It should be the same as the port in wireguard-endpoint.",
-				EnvVars: []string{"TUNNELD_WIREGUARD_PORT"},
-			},
-			&cli.StringFlag{
-				Name:    "wireguard-key",
-				Aliases: []string{"wg-key"},
-				Usage:   "The private key for the wireguard server. It should be base64 encoded. You can generate a key with `wg genkey`. Mutually exclusive with wireguard-key-file.",
-				EnvVars: []string{"TUNNELD_WIREGUARD_KEY"},
-			},
-			&cli.StringFlag{
-				Name:    "wireguard-key-file",
-				Aliases: []string{"wg-key-file"},
-				Usage:   "The file path containing the private key for the wireguard server. The contents should be base64 encoded. If the file does not exist, a key will be generated for you and written to the file. Mutually exclusive with wireguard-key.",
-				EnvVars: []string{"TUNNELD_WIREGUARD_KEY_FILE"},
-			},
-			&cli.IntFlag{
-				Name:    "wireguard-mtu",
-				Aliases: []string{"wg-mtu"},
-				Usage:   "The MTU to use for the wireguard interface.",
-				Value:   tunneld.DefaultWireguardMTU,
-				EnvVars: []string{"TUNNELD_WIREGUARD_MTU"},
-			},
-			&cli.StringFlag{
-				Name:    "wireguard-server-ip",
-				Aliases: []string{"wg-server-ip"},
-				Usage:   "The virtual IP address of this server in the wireguard network. Must be an IPv6 address contained within wireguard-network-prefix.",
-				Value:   tunneld.DefaultWireguardServerIP.String(),
-				EnvVars: []string{"TUNNELD_WIREGUARD_SERVER_IP"},
-			},
-			&cli.StringFlag{
-				Name:    "wireguard-network-prefix",
-				Aliases: []string{"wg-network-prefix"},
-				Usage:   "The CIDR of the wireguard network. All client IPs will be generated within this network. Must be a IPv6 CIDR and have at least 64 bits available.",
-				Value:   tunneld.DefaultWireguardNetworkPrefix.String(),
-				EnvVars: []string{"TUNNELD_WIREGUARD_NETWORK_PREFIX"},
-			},
-			&cli.StringFlag{
-				Name:    "real-ip-header",
-				Usage:   "Use the given header as the real IP address rather than the remote socket address.",
-				Value:   "",
-				EnvVars: []string{"TUNNELD_REAL_IP_HEADER"},
-			},
-			&cli.StringFlag{
-				Name:    "pprof-listen-address",
-				Usage:   "The address to listen on for pprof. If set to an empty string, pprof will not be enabled.",
-				Value:   "127.0.0.1:6060",
-				EnvVars: []string{"TUNNELD_PPROF_LISTEN_ADDRESS"},
+		Flags:   appFlags,
+		Action:  runApp,
+		Commands: []*cli.Command{
+			{
+				Name:  "config",
+				Usage: "Manage the server configuration.",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "print",
+						Usage:  "Print the effective configuration as a config file, with secrets redacted. Flags must be passed before the command, e.g. `tunneld --config tunneld.yaml config print`.",
+						Action: printConfig,
+					},
+				},
 			},
-			&cli.StringFlag{
-				Name:    "tracing-honeycomb-team",
-				Usage:   "The Honeycomb team ID to send tracing data to. If not specified, tracing will not be shipped anywhere.",
-				EnvVars: []string{"TUNNELD_TRACING_HONEYCOMB_TEAM"},
-			},
-			&cli.StringFlag{
-				Name:    "tracing-instance-id",
-				Usage:   "The instance ID to annotate all traces with that uniquely identifies this deployment.",
-				EnvVars: []string{"TUNNELD_TRACING_INSTANCE_ID"},
+			{
+				Name:  "keys",
+				Usage: "Manage the wireguard server keys.",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "rotate",
+						Usage: "Generate the next private key and schedule the switch to it. Clients learn about the next key when they re-register and update their peer after the switch. Flags other than --in must be passed before the command, e.g. `tunneld --config tunneld.yaml keys rotate --in 24h`.",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "in",
+								Usage: "How long from now to switch to the next key. Must be at least peer-timeout.",
+								Value: 24 * time.Hour,
+							},
+						},
+						Action: rotateKeys,
+					},
+					{
+						Name:   "encrypt",
+						Usage:  "Encrypt the plain wireguard-key-file and next key file with a passphrase. Flags must be passed before the command, e.g. `tunneld --config tunneld.yaml keys encrypt`.",
+						Action: encryptKeys,
+					},
+				},
 			},
 		},
-		Action: runApp,
 	}
 
 	err := app.Run(os.Args)
@@ -138,41 +299,31 @@ func main() {
 }
 
 func runApp(ctx *cli.Context) error {
+	err := cliconfig.Load(ctx, ctx.String("config"), appFlags)
+	if err != nil {
+		return err
+	}
+
 	var (
-		verbose                = ctx.Bool("verbose")
-		listenAddress          = ctx.String("listen-address")
-		baseURL                = ctx.String("base-url")
-		wireguardEndpoint      = ctx.String("wireguard-endpoint")
-		wireguardPort          = ctx.Uint("wireguard-port")
-		wireguardKey           = ctx.String("wireguard-key")
-		wireguardKeyFile       = ctx.String("wireguard-key-file")
-		wireguardMTU           = ctx.Int("wireguard-mtu")
-		wireguardServerIP      = ctx.String("wireguard-server-ip")
-		wireguardNetworkPrefix = ctx.String("wireguard-network-prefix")
-		realIPHeader           = ctx.String("real-ip-header")
-		pprofListenAddress     = ctx.String("pprof-listen-address")
-		tracingHoneycombTeam   = ctx.String("tracing-honeycomb-team")
-		tracingInstanceID      = ctx.String("tracing-instance-id")
+		verbose              = ctx.Bool("verbose")
+		logFormat            = ctx.String("log-format")
+		logFile              = ctx.String("log-file")
+		listenAddress        = ctx.String("listen-address")
+		shutdownTimeout      = ctx.Duration("shutdown-timeout")
+		pprofListenAddress   = ctx.String("pprof-listen-address")
+		tracingHoneycombTeam = ctx.String("tracing-honeycomb-team")
+		tracingInstanceID    = ctx.String("tracing-instance-id")
 	)
-	if baseURL == "" {
-		return xerrors.New("base-url is required. See --help for more information.")
-	}
-	if wireguardEndpoint == "" {
-		return xerrors.New("wireguard-endpoint is required. See --help for more information.")
-	}
-	if wireguardPort < 1 || wireguardPort > 65535 {
-		return xerrors.New("wireguard-port is required and must be between 1 and 65535. See --help for more information.")
-	}
-	if wireguardKey == "" && wireguardKeyFile == "" {
-		return xerrors.New("wireguard-key is required. See --help for more information.")
-	}
-	if wireguardKey != "" && wireguardKeyFile != "" {
-		return xerrors.New("wireguard-key and wireguard-key-file are mutually exclusive. See --help for more information.")
+
+	logger, closeLog, err := newLogger(logFormat, logFile, verbose)
+	if err != nil {
+		return err
 	}
+	defer closeLog()
 
-	logger := slog.Make(sloghuman.Sink(os.Stderr)).Leveled(slog.LevelInfo)
-	if verbose {
-		logger = logger.Leveled(slog.LevelDebug)
+	options, err := optionsFromContext(ctx, logger, true, tunnelsdk.Key{})
+	if err != nil {
+		return err
 	}
 
 	// Initiate tracing.
@@ -202,64 +353,13 @@ func runApp(ctx *cli.Context) error {
 		}()
 	}
 
-	baseURLParsed, err := url.Parse(baseURL)
-	if err != nil {
-		return xerrors.Errorf("could not parse base-url %q: %w", baseURL, err)
-	}
-	wireguardServerIPParsed, err := netip.ParseAddr(wireguardServerIP)
-	if err != nil {
-		return xerrors.Errorf("could not parse wireguard-server-ip %q: %w", wireguardServerIP, err)
-	}
-	wireguardNetworkPrefixParsed, err := netip.ParsePrefix(wireguardNetworkPrefix)
-	if err != nil {
-		return xerrors.Errorf("could not parse wireguard-network-prefix %q: %w", wireguardNetworkPrefix, err)
-	}
-
-	if wireguardKeyFile != "" {
-		_, err = os.Stat(wireguardKeyFile)
-		if errors.Is(err, os.ErrNotExist) {
-			logger.Info(ctx.Context, "generating private key to file", slog.F("path", wireguardKeyFile))
-			key, err := tunnelsdk.GeneratePrivateKey()
-			if err != nil {
-				return xerrors.Errorf("could not generate private key: %w", err)
-			}
-
-			err = os.WriteFile(wireguardKeyFile, []byte(key.String()), 0600)
-			if err != nil {
-				return xerrors.Errorf("could not write base64-encoded private key to %q: %w", wireguardKeyFile, err)
-			}
-		} else if err != nil {
-			return xerrors.Errorf("could not stat wireguard-key-file %q: %w", wireguardKeyFile, err)
-		}
-
-		logger.Info(ctx.Context, "reading private key from file", slog.F("path", wireguardKeyFile))
-		wireguardKeyBytes, err := os.ReadFile(wireguardKeyFile)
-		if err != nil {
-			return xerrors.Errorf("could not read wireguard-key-file %q: %w", wireguardKeyFile, err)
-		}
-		wireguardKey = string(wireguardKeyBytes)
-	}
-
-	wireguardKeyParsed, err := tunnelsdk.ParsePrivateKey(wireguardKey)
-	if err != nil {
-		return xerrors.Errorf("could not parse wireguard-key %q: %w", wireguardKey, err)
-	}
-	logger.Info(ctx.Context, "parsed private key", slog.F("hash", wireguardKeyParsed.Hash()))
-
-	options := &tunneld.Options{
-		BaseURL:                baseURLParsed,
-		WireguardEndpoint:      wireguardEndpoint,
-		WireguardPort:          uint16(wireguardPort),
-		WireguardKey:           wireguardKeyParsed,
-		WireguardMTU:           wireguardMTU,
-		WireguardServerIP:      wireguardServerIPParsed,
-		WireguardNetworkPrefix: wireguardNetworkPrefixParsed,
-		RealIPHeader:           realIPHeader,
-	}
 	td, err := tunneld.New(options)
 	if err != nil {
 		return xerrors.Errorf("create tunneld.API instance: %w", err)
 	}
+	expvar.Publish("tunneld_legacy_usage", expvar.Func(func() any {
+		return td.LegacyUsage()
+	}))
 
 	// ReadHeaderTimeout is purposefully not enabled. It caused some issues with
 	// websockets over the dev tunnel.
@@ -296,8 +396,8 @@ func runApp(ctx *cli.Context) error {
 	eg, egCtx := errgroup.WithContext(ctx.Context)
 	eg.Go(func() error {
 		logger.Info(egCtx, "listening for requests", slog.F("listen_address", listenAddress))
-		err = server.ListenAndServe()
-		if err != nil {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return xerrors.Errorf("error in ListenAndServe: %w", err)
 		}
 		return nil
@@ -306,13 +406,48 @@ func runApp(ctx *cli.Context) error {
 	notifyCtx, notifyStop := signal.NotifyContext(ctx.Context, InterruptSignals...)
 	defer notifyStop()
 
+	// Reload the configuration on request until the server shuts down.
+	reloadCh := make(chan os.Signal, 1)
+	if len(ReloadSignals) > 0 {
+		// An empty list would relay every signal.
+		signal.Notify(reloadCh, ReloadSignals...)
+		defer signal.Stop(reloadCh)
+	}
+	go func() {
+		for {
+			select {
+			case <-notifyCtx.Done():
+				return
+			case <-egCtx.Done():
+				return
+			case <-reloadCh:
+				reloadConfig(ctx, logger, td)
+			}
+		}
+	}()
+
 	eg.Go(func() error {
-		<-notifyCtx.Done()
-		logger.Info(egCtx, "shutting down server due to signal")
+		select {
+		case <-notifyCtx.Done():
+			logger.Info(egCtx, "shutting down server due to signal")
+		case <-egCtx.Done():
+			logger.Info(egCtx, "shutting down server due to error")
+		}
 
-		shutdownCtx, shutdownCancel := context.WithTimeout(egCtx, 5*time.Second)
+		// Stop accepting requests and wait for regular requests to finish, then
+		// wait for proxied connections (e.g. websockets) that the HTTP server
+		// doesn't track before closing the wireguard device.
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer shutdownCancel()
-		return server.Shutdown(shutdownCtx)
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Warn(egCtx, "shut down HTTP server", slog.Error(err))
+		}
+		err = td.Shutdown(shutdownCtx)
+		if err != nil {
+			return xerrors.Errorf("shut down tunneld: %w", err)
+		}
+		return nil
 	})
 
 	return eg.Wait()
@@ -10,5 +10,7 @@ import (
 var InterruptSignals = []os.Signal{
 	os.Interrupt,
 	syscall.SIGTERM,
-	syscall.SIGHUP,
 }
+
+// ReloadSignals cause the configuration to be reloaded.
+var ReloadSignals = []os.Signal{syscall.SIGHUP}
@@ -7,3 +7,6 @@ import (
 )
 
 var InterruptSignals = []os.Signal{os.Interrupt}
+
+// ReloadSignals is empty as Windows has no equivalent of SIGHUP.
+var ReloadSignals = []os.Signal{}
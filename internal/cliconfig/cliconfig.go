@@ -0,0 +1,156 @@
+// Package cliconfig loads CLI flag values from YAML config files.
+//
+// Config files are flat mappings of flag names to values, e.g.
+//
+//	base-url: https://tunnel.example.com
+//	wireguard-port: 55551
+//	peer-timeout: 2m
+//
+// Values from the config file have the lowest precedence: flags set on the
+// command line or through environment variables take priority.
+package cliconfig
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the YAML config file at path and sets each flag in the file that
+// hasn't been set on the command line or through an environment variable. It's
+// a no-op if path is empty.
+//
+// Keys must be flag names or aliases. Unknown keys are an error so typos don't
+// go unnoticed.
+func Load(ctx *cli.Context, path string, flags []cli.Flag) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return xerrors.Errorf("read config file %q: %w", path, err)
+	}
+	var values map[string]interface{}
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return xerrors.Errorf("parse config file %q: %w", path, err)
+	}
+
+	names := make(map[string]cli.Flag)
+	for _, f := range flags {
+		for _, name := range f.Names() {
+			names[name] = f
+		}
+	}
+
+	// Sort the keys so errors are deterministic.
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f, ok := names[key]
+		if !ok {
+			return xerrors.Errorf("config file %q: unknown setting %q", path, key)
+		}
+		name := f.Names()[0]
+		if ctx.IsSet(name) {
+			continue
+		}
+
+		strs, err := flagValues(values[key])
+		if err != nil {
+			return xerrors.Errorf("config file %q: setting %q: %w", path, key, err)
+		}
+		for _, str := range strs {
+			err = ctx.Set(name, str)
+			if err != nil {
+				return xerrors.Errorf("config file %q: set %q to %q: %w", path, key, str, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// flagValues converts a YAML value to the string values to set the flag to.
+// Lists set the flag once for each element.
+func flagValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string, bool, int, int64, uint64, float64:
+		return []string{fmt.Sprint(v)}, nil
+	case time.Time:
+		return []string{v.Format(time.RFC3339)}, nil
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, e := range v {
+			s, err := flagValues(e)
+			if err != nil {
+				return nil, err
+			}
+			if len(s) != 1 {
+				return nil, xerrors.New("lists may only contain scalar values")
+			}
+			strs = append(strs, s[0])
+		}
+		return strs, nil
+	default:
+		return nil, xerrors.Errorf("unsupported value of type %T", v)
+	}
+}
+
+// Redacted is printed in place of secret values.
+const Redacted = "REDACTED"
+
+// Marshal returns the values of the given flags as a YAML config file that
+// can be passed to Load. Flags in secrets that have a value are redacted.
+func Marshal(ctx *cli.Context, flags []cli.Flag, secrets ...string) ([]byte, error) {
+	secret := make(map[string]bool, len(secrets))
+	for _, s := range secrets {
+		secret[s] = true
+	}
+
+	// Use a node to keep the order of the flags.
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, f := range flags {
+		name := f.Names()[0]
+		if name == "config" || name == "help" {
+			continue
+		}
+
+		value := ctx.Value(name)
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case cli.StringSlice:
+			value = v.Value()
+		case *cli.StringSlice:
+			value = v.Value()
+		}
+		if secret[name] && fmt.Sprint(value) != "" {
+			value = Redacted
+		}
+
+		var valueNode yaml.Node
+		err := valueNode.Encode(value)
+		if err != nil {
+			return nil, xerrors.Errorf("encode %q: %w", name, err)
+		}
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: name},
+			&valueNode,
+		)
+	}
+
+	return yaml.Marshal(doc)
+}
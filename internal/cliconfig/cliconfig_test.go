@@ -0,0 +1,145 @@
+package cliconfig_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+
+	"github.com/coder/wgtunnel/internal/cliconfig"
+)
+
+// Not parallel because it sets environment variables.
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+file-only: from-file
+env-and-file: from-file
+flag-and-file: from-file
+port: 1234
+timeout: 1m
+list: [a, b]
+`)
+	t.Setenv("TEST_ENV_AND_FILE", "from-env")
+
+	var got map[string]interface{}
+	runApp(t, []string{"--flag-and-file", "from-flag"}, func(ctx *cli.Context) error {
+		err := cliconfig.Load(ctx, path, ctx.App.Flags)
+		if err != nil {
+			return err
+		}
+		got = map[string]interface{}{
+			"file-only":     ctx.String("file-only"),
+			"env-and-file":  ctx.String("env-and-file"),
+			"flag-and-file": ctx.String("flag-and-file"),
+			"port":          ctx.Int("port"),
+			"timeout":       ctx.Duration("timeout"),
+			"list":          ctx.StringSlice("list"),
+		}
+		return nil
+	})
+
+	require.Equal(t, map[string]interface{}{
+		"file-only":     "from-file",
+		"env-and-file":  "from-env",
+		"flag-and-file": "from-flag",
+		"port":          1234,
+		"timeout":       time.Minute,
+		"list":          []string{"a", "b"},
+	}, got)
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		t.Parallel()
+
+		path := writeConfig(t, "unknown: value\n")
+		err := runAppErr(t, nil, func(ctx *cli.Context) error {
+			return cliconfig.Load(ctx, path, ctx.App.Flags)
+		})
+		require.ErrorContains(t, err, `unknown setting "unknown"`)
+	})
+
+	t.Run("InvalidValue", func(t *testing.T) {
+		t.Parallel()
+
+		path := writeConfig(t, "port: not-a-number\n")
+		err := runAppErr(t, nil, func(ctx *cli.Context) error {
+			return cliconfig.Load(ctx, path, ctx.App.Flags)
+		})
+		require.ErrorContains(t, err, `set "port"`)
+	})
+}
+
+func TestMarshal(t *testing.T) {
+	t.Parallel()
+
+	path := writeConfig(t, `
+file-only: secret-value
+timeout: 90s
+`)
+
+	var out []byte
+	runApp(t, []string{"--port", "42"}, func(ctx *cli.Context) error {
+		err := cliconfig.Load(ctx, path, ctx.App.Flags)
+		if err != nil {
+			return err
+		}
+		out, err = cliconfig.Marshal(ctx, ctx.App.Flags, "file-only", "env-and-file")
+		return err
+	})
+
+	require.Contains(t, string(out), "file-only: "+cliconfig.Redacted+"\n")
+	// Empty secrets aren't redacted so it's obvious they're unset.
+	require.Contains(t, string(out), "env-and-file: \"\"\n")
+	require.Contains(t, string(out), "port: 42\n")
+	require.Contains(t, string(out), "timeout: 1m30s\n")
+	require.NotContains(t, string(out), "secret-value")
+
+	// The output can be loaded again.
+	path = writeConfig(t, string(out))
+	runApp(t, nil, func(ctx *cli.Context) error {
+		require.NoError(t, cliconfig.Load(ctx, path, ctx.App.Flags))
+		require.Equal(t, 42, ctx.Int("port"))
+		require.Equal(t, 90*time.Second, ctx.Duration("timeout"))
+		return nil
+	})
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func runApp(t *testing.T, args []string, action cli.ActionFunc) {
+	t.Helper()
+	require.NoError(t, runAppErr(t, args, action))
+}
+
+func runAppErr(t *testing.T, args []string, action cli.ActionFunc) error {
+	t.Helper()
+
+	app := &cli.App{
+		Name: "test",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "file-only"},
+			&cli.StringFlag{Name: "env-and-file", EnvVars: []string{"TEST_ENV_AND_FILE"}},
+			&cli.StringFlag{Name: "flag-and-file"},
+			&cli.IntFlag{Name: "port"},
+			&cli.DurationFlag{Name: "timeout"},
+			&cli.StringSliceFlag{Name: "list"},
+		},
+		Action:    action,
+		Writer:    &bytes.Buffer{},
+		ErrWriter: &bytes.Buffer{},
+	}
+	return app.Run(append([]string{"test"}, args...))
+}
@@ -0,0 +1,133 @@
+// Package keyfile reads and writes the private key files used by tunnel and
+// tunneld. Key files contain either a plain base64 encoded key or a key
+// encrypted with a passphrase, see tunnelsdk.EncryptPrivateKey.
+package keyfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/term"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+// ErrNoPassphrase is returned by PassphraseSource.Passphrase when no
+// passphrase is configured and it can't prompt for one.
+var ErrNoPassphrase = xerrors.New("no passphrase provided")
+
+// PassphraseSource describes where the passphrase for encrypted key files
+// comes from. File takes precedence over EnvVar, and the terminal is only used
+// if neither is set.
+type PassphraseSource struct {
+	// EnvVar is the name of an environment variable containing the passphrase.
+	EnvVar string
+	// File is the path of a file containing the passphrase. Trailing newlines
+	// are ignored.
+	File string
+	// Interactive allows prompting for the passphrase if stdin is a terminal.
+	Interactive bool
+}
+
+// Configured returns true if the passphrase is read from a file or an
+// environment variable rather than prompted for.
+func (s PassphraseSource) Configured() bool {
+	return s.File != "" || (s.EnvVar != "" && os.Getenv(s.EnvVar) != "")
+}
+
+// Passphrase returns the passphrase. If it has to prompt and confirm is true,
+// the passphrase is asked for twice, which should be done when encrypting.
+func (s PassphraseSource) Passphrase(confirm bool) ([]byte, error) {
+	if s.File != "" {
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return nil, xerrors.Errorf("read passphrase file %q: %w", s.File, err)
+		}
+		return nonEmpty(bytes.TrimRight(data, "\r\n"))
+	}
+	if s.EnvVar != "" {
+		if v := os.Getenv(s.EnvVar); v != "" {
+			return []byte(v), nil
+		}
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !s.Interactive || !term.IsTerminal(fd) {
+		return nil, ErrNoPassphrase
+	}
+	passphrase, err := prompt(fd, os.Stderr, "Key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		again, err := prompt(fd, os.Stderr, "Confirm key passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, xerrors.New("passphrases do not match")
+		}
+	}
+	return nonEmpty(passphrase)
+}
+
+func prompt(fd int, w io.Writer, message string) ([]byte, error) {
+	_, _ = fmt.Fprint(w, message)
+	passphrase, err := term.ReadPassword(fd)
+	_, _ = fmt.Fprintln(w)
+	if err != nil {
+		return nil, xerrors.Errorf("read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
+
+func nonEmpty(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, xerrors.New("passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+// Encode returns the contents of a key file for key. If passphrase is not
+// nil, the key is encrypted with it.
+func Encode(key tunnelsdk.Key, passphrase []byte) ([]byte, error) {
+	if passphrase == nil {
+		return []byte(key.String()), nil
+	}
+	return tunnelsdk.EncryptPrivateKey(key, passphrase)
+}
+
+// Write replaces the file at path with data. The file is written to a
+// temporary file in the same directory first and then renamed, so the
+// existing key isn't lost if writing fails. The file is only readable by the
+// current user.
+func Write(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return xerrors.Errorf("create temporary key file: %w", err)
+	}
+	defer func() {
+		// Fails harmlessly once the file has been renamed.
+		_ = os.Remove(f.Name())
+	}()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return xerrors.Errorf("write temporary key file: %w", err)
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return xerrors.Errorf("rename temporary key file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package keyfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/wgtunnel/internal/keyfile"
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	t.Run("Plain", func(t *testing.T) {
+		t.Parallel()
+
+		data, err := keyfile.Encode(key, nil)
+		require.NoError(t, err)
+		require.False(t, tunnelsdk.IsEncryptedPrivateKey(data))
+
+		parsed, err := tunnelsdk.ParsePrivateKeyFile(append(data, '\n'), nil)
+		require.NoError(t, err)
+		require.Equal(t, key.String(), parsed.String())
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		t.Parallel()
+
+		data, err := keyfile.Encode(key, []byte("hunter2"))
+		require.NoError(t, err)
+		require.True(t, tunnelsdk.IsEncryptedPrivateKey(data))
+		require.NotContains(t, string(data), key.String())
+
+		parsed, err := tunnelsdk.ParsePrivateKeyFile(data, func() ([]byte, error) {
+			return []byte("hunter2"), nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, key.String(), parsed.String())
+
+		_, err = tunnelsdk.DecryptPrivateKey(data, []byte("hunter3"))
+		require.ErrorIs(t, err, tunnelsdk.ErrIncorrectPassphrase)
+
+		_, err = tunnelsdk.ParsePrivateKeyFile(data, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("UnsupportedVersion", func(t *testing.T) {
+		t.Parallel()
+
+		data, err := keyfile.Encode(key, []byte("hunter2"))
+		require.NoError(t, err)
+		_, err = tunnelsdk.DecryptPrivateKey([]byte("wgtunnel-encrypted-key-v2"+string(data[len("wgtunnel-encrypted-key-v1"):])), []byte("hunter2"))
+		require.ErrorContains(t, err, "unsupported encrypted key file version")
+	})
+}
+
+// Not parallel because it sets environment variables.
+func TestPassphrase(t *testing.T) {
+	const envVar = "KEYFILE_TEST_PASSPHRASE"
+
+	t.Run("File", func(t *testing.T) {
+		t.Setenv(envVar, "from-env")
+		path := filepath.Join(t.TempDir(), "passphrase")
+		require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0600))
+
+		source := keyfile.PassphraseSource{EnvVar: envVar, File: path}
+		require.True(t, source.Configured())
+		passphrase, err := source.Passphrase(true)
+		require.NoError(t, err)
+		require.Equal(t, "from-file", string(passphrase))
+	})
+
+	t.Run("EnvVar", func(t *testing.T) {
+		t.Setenv(envVar, "from-env")
+
+		source := keyfile.PassphraseSource{EnvVar: envVar}
+		require.True(t, source.Configured())
+		passphrase, err := source.Passphrase(false)
+		require.NoError(t, err)
+		require.Equal(t, "from-env", string(passphrase))
+	})
+
+	t.Run("EmptyFile", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "passphrase")
+		require.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+
+		_, err := keyfile.PassphraseSource{File: path}.Passphrase(false)
+		require.ErrorContains(t, err, "passphrase is empty")
+	})
+
+	t.Run("None", func(t *testing.T) {
+		t.Setenv(envVar, "")
+
+		source := keyfile.PassphraseSource{EnvVar: envVar}
+		require.False(t, source.Configured())
+		_, err := source.Passphrase(false)
+		require.ErrorIs(t, err, keyfile.ErrNoPassphrase)
+	})
+}
+
+func TestWrite(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wireguard.key")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+
+	require.NoError(t, keyfile.Write(path, []byte("new")))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
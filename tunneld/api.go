@@ -18,13 +18,23 @@ import (
 	"github.com/tailscale/wireguard-go/device"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/mod/semver"
 	"golang.org/x/xerrors"
 
+	"cdr.dev/slog"
+	"github.com/coder/wgtunnel/buildinfo"
 	"github.com/coder/wgtunnel/tunneld/httpapi"
 	"github.com/coder/wgtunnel/tunneld/httpmw"
 	"github.com/coder/wgtunnel/tunnelsdk"
 )
 
+const (
+	// apiMaxBodySize and proxyMaxBodySize limit the size of request bodies to
+	// the API and to tunnels.
+	apiMaxBodySize   = 1 << 20  // 1MB
+	proxyMaxBodySize = 50 << 20 // 50MB
+)
+
 func (api *API) Router() http.Handler {
 	var (
 		hr            = hostrouter.New()
@@ -39,31 +49,58 @@ func (api *API) Router() http.Handler {
 
 	proxyRouter.Use(
 		otelchi.Middleware("proxy"),
-		httpmw.LimitBody(50*1<<20), // 50MB
+		api.reloadable(func(options *Options) func(http.Handler) http.Handler {
+			return httpmw.AccessLog(httpmw.AccessLogConfig{
+				Log:          api.Log.Named("proxy_access"),
+				SampleRate:   options.ProxyAccessLogSampleRate,
+				Disabled:     options.DisableProxyAccessLogs,
+				RealIPHeader: options.RealIPHeader,
+			})
+		}),
+		httpmw.LimitBody(proxyMaxBodySize),
 	)
 	proxyRouter.Mount("/", http.HandlerFunc(api.handleTunnel))
 
 	apiRouter.Use(
 		otelchi.Middleware("api", otelchi.WithChiRoutes(apiRouter)),
-		httpmw.LimitBody(1<<20), // 1MB
-		httpmw.RateLimit(httpmw.RateLimitConfig{
-			Log:          api.Log.Named("ratelimier"),
-			Count:        10,
-			Window:       10 * time.Second,
-			RealIPHeader: api.Options.RealIPHeader,
+		api.reloadable(func(options *Options) func(http.Handler) http.Handler {
+			return httpmw.AccessLog(httpmw.AccessLogConfig{
+				Log:          api.Log.Named("api_access"),
+				IncludePath:  true,
+				RealIPHeader: options.RealIPHeader,
+			})
 		}),
+		httpmw.LimitBody(apiMaxBodySize),
 	)
 
-	apiRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("https://coder.com"))
+	// Server info and challenges don't change any state and are needed before
+	// every registration, so they don't count towards the rate limit.
+	apiRouter.Get("/api/v2/info", api.getInfo)
+	apiRouter.Post("/api/v2/clients/challenge", api.postClientsChallenge)
+
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(api.reloadable(func(options *Options) func(http.Handler) http.Handler {
+			return httpmw.RateLimit(httpmw.RateLimitConfig{
+				Log:          api.Log.Named("ratelimier"),
+				Count:        options.APIRateLimit,
+				Window:       options.APIRateLimitWindow,
+				RealIPHeader: options.RealIPHeader,
+			})
+		}))
+
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("https://coder.com"))
+		})
+		r.Post("/tun", api.postTun)
+		r.Post("/api/v2/clients", api.postClients)
+		r.Delete("/api/v2/clients", api.deleteClients)
 	})
-	apiRouter.Post("/tun", api.postTun)
-	apiRouter.Post("/api/v2/clients", api.postClients)
 
 	notFound := func(rw http.ResponseWriter, r *http.Request) {
 		httpapi.Write(r.Context(), rw, http.StatusNotFound, tunnelsdk.Response{
 			Message: "Not found.",
+			Code:    tunnelsdk.ErrorCodeNotFound,
 		})
 	}
 	apiRouter.NotFound(notFound)
@@ -76,6 +113,13 @@ type LegacyPostTunRequest struct {
 	PublicKey device.NoisePublicKey `json:"public_key"`
 }
 
+func (r LegacyPostTunRequest) Validate() []tunnelsdk.ValidationError {
+	if detail := tunnelsdk.ValidatePublicKey(r.PublicKey); detail != "" {
+		return []tunnelsdk.ValidationError{{Field: "public_key", Detail: detail}}
+	}
+	return nil
+}
+
 type LegacyPostTunResponse struct {
 	Hostname        string     `json:"hostname"`
 	ServerEndpoint  string     `json:"server_endpoint"`
@@ -90,20 +134,45 @@ type LegacyPostTunResponse struct {
 func (api *API) postTun(rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	api.legacy.addEndpointRequest(time.Now())
+	if api.CurrentOptions().DisableLegacyEndpoint {
+		httpapi.Write(ctx, rw, http.StatusNotFound, tunnelsdk.Response{
+			Message: "Not found.",
+			Code:    tunnelsdk.ErrorCodeNotFound,
+			Detail:  "the legacy tunnel endpoint is disabled, upgrade the client",
+		})
+		return
+	}
+
 	var req LegacyPostTunRequest
 	if !httpapi.Read(ctx, rw, r, &req) {
 		return
 	}
+	if !api.checkClientVersion(rw, r, "") {
+		return
+	}
 
 	registerReq := tunnelsdk.ClientRegisterRequest{
 		Version:   tunnelsdk.TunnelVersion1,
 		PublicKey: req.PublicKey,
 	}
 
-	resp, exists, err := api.registerClient(registerReq)
+	resp, exists, err := api.registerClient(registerReq, false)
+	if xerrors.Is(err, errProofRequired) {
+		httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+			Message: "Public key is in use by a client that proved possession of the private key.",
+			Code:    tunnelsdk.ErrorCodeKeyInUse,
+		})
+		return
+	}
+	if xerrors.Is(err, errTunnelIDInUse) {
+		writeTunnelIDInUse(ctx, rw)
+		return
+	}
 	if err != nil {
 		httpapi.Write(ctx, rw, http.StatusInternalServerError, tunnelsdk.Response{
 			Message: "Failed to register client.",
+			Code:    tunnelsdk.ErrorCodeInternal,
 			Detail:  err.Error(),
 		})
 		return
@@ -112,6 +181,7 @@ func (api *API) postTun(rw http.ResponseWriter, r *http.Request) {
 	if len(resp.TunnelURLs) == 0 {
 		httpapi.Write(ctx, rw, http.StatusInternalServerError, tunnelsdk.Response{
 			Message: "No tunnel URLs found.",
+			Code:    tunnelsdk.ErrorCodeInternal,
 		})
 		return
 	}
@@ -120,6 +190,7 @@ func (api *API) postTun(rw http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		httpapi.Write(ctx, rw, http.StatusInternalServerError, tunnelsdk.Response{
 			Message: "Failed to parse tunnel URL.",
+			Code:    tunnelsdk.ErrorCodeInternal,
 			Detail:  err.Error(),
 		})
 		return
@@ -145,11 +216,69 @@ func (api *API) postClients(rw http.ResponseWriter, r *http.Request) {
 	if !httpapi.Read(r.Context(), rw, r, &req) {
 		return
 	}
+	if !api.checkClientVersion(rw, r, req.ClientVersion) {
+		return
+	}
+
+	req.Version = normalizeVersion(req.Version)
+	if !api.supportsTunnelVersion(req.Version) {
+		detail := fmt.Sprintf("version %d is not supported, supported versions are %v", req.Version, api.tunnelVersions())
+		httpapi.Write(ctx, rw, http.StatusBadRequest, tunnelsdk.Response{
+			Message: "Unsupported tunnel version.",
+			Code:    tunnelsdk.ErrorCodeUnsupportedVersion,
+			Detail:  detail,
+			Validations: []tunnelsdk.ValidationError{{
+				Field:  "version",
+				Detail: detail,
+			}},
+		})
+		return
+	}
+	proven := false
+	if req.Version >= tunnelsdk.TunnelVersion3 {
+		issuedAt, err := api.verifyNonce(req.Nonce)
+		if err != nil {
+			httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+				Message: "Invalid registration nonce.",
+				Code:    tunnelsdk.ErrorCodeInvalidNonce,
+				Detail:  err.Error(),
+			})
+			return
+		}
+		if !verifyProof(api.CurrentOptions(), req.PublicKey, req.ProofMessage(), req.Proof) {
+			httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+				Message: "Invalid proof of private key possession.",
+				Code:    tunnelsdk.ErrorCodeInvalidProof,
+			})
+			return
+		}
+		if !api.useProof(req.Nonce, issuedAt) {
+			httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+				Message: "Registration nonce has already been used.",
+				Code:    tunnelsdk.ErrorCodeNonceUsed,
+			})
+			return
+		}
+		proven = true
+	}
 
-	resp, _, err := api.registerClient(req)
+	resp, _, err := api.registerClient(req, proven)
+	if xerrors.Is(err, errProofRequired) {
+		httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+			Message: "Public key is in use by a client that proved possession of the private key.",
+			Code:    tunnelsdk.ErrorCodeKeyInUse,
+			Detail:  fmt.Sprintf("register with version %d or later to prove possession of the private key", tunnelsdk.TunnelVersion3),
+		})
+		return
+	}
+	if xerrors.Is(err, errTunnelIDInUse) {
+		writeTunnelIDInUse(ctx, rw)
+		return
+	}
 	if err != nil {
 		httpapi.Write(ctx, rw, http.StatusInternalServerError, tunnelsdk.Response{
 			Message: "Failed to register client.",
+			Code:    tunnelsdk.ErrorCodeInternal,
 			Detail:  err.Error(),
 		})
 		return
@@ -158,20 +287,260 @@ func (api *API) postClients(rw http.ResponseWriter, r *http.Request) {
 	httpapi.Write(ctx, rw, http.StatusOK, resp)
 }
 
-func (api *API) registerClient(req tunnelsdk.ClientRegisterRequest) (tunnelsdk.ClientRegisterResponse, bool, error) {
-	if req.Version <= 0 || req.Version > tunnelsdk.TunnelVersionLatest {
-		req.Version = tunnelsdk.TunnelVersionLatest
+// checkClientVersion records the client's version and rejects the request if
+// the client is older than MinimumClientVersion. The version is taken from the
+// request body if the client sent one, and from the version header otherwise.
+// It returns false if a response was written.
+func (api *API) checkClientVersion(rw http.ResponseWriter, r *http.Request, version string) bool {
+	ctx := r.Context()
+	if version == "" {
+		version = r.Header.Get(tunnelsdk.ClientVersionHeader)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("client_version", version))
+	httpmw.AddAccessLogFields(ctx, slog.F("client_version", version))
+
+	options := api.CurrentOptions()
+	minimum := options.MinimumClientVersion
+	if minimum == "" {
+		return true
+	}
+	// Invalid and missing versions compare as older than any valid version.
+	if semver.Compare(version, minimum) >= 0 {
+		return true
+	}
+
+	reported := version
+	if reported == "" {
+		reported = "an unknown version"
+	}
+	httpapi.Write(ctx, rw, http.StatusBadRequest, tunnelsdk.Response{
+		Message: fmt.Sprintf("This client is outdated. Download version %s or later from %s.", minimum, options.ClientDownloadURL),
+		Code:    tunnelsdk.ErrorCodeClientOutdated,
+		Detail:  fmt.Sprintf("client reported %s, the server requires %s or later", reported, minimum),
+	})
+	return false
+}
+
+func (api *API) getInfo(rw http.ResponseWriter, r *http.Request) {
+	options := api.CurrentOptions()
+	apiRateLimit := options.APIRateLimit
+	if apiRateLimit < 0 {
+		apiRateLimit = 0
+	}
+
+	httpapi.Write(r.Context(), rw, http.StatusOK, tunnelsdk.ServerInfo{
+		Version:        buildinfo.Version(),
+		TunnelVersions: api.tunnelVersions(),
+		Capabilities: tunnelsdk.ServerCapabilities{
+			HTTP:        true,
+			TCP:         false,
+			UDP:         false,
+			AuthModes:   []tunnelsdk.AuthMode{tunnelsdk.AuthModeNone, tunnelsdk.AuthModeProof},
+			VanityNames: false,
+		},
+		Limits: tunnelsdk.ServerLimits{
+			APIRateLimit:         apiRateLimit,
+			APIRateLimitWindow:   options.APIRateLimitWindow,
+			MaxRequestBodyBytes:  proxyMaxBodySize,
+			PeerRegisterInterval: options.PeerRegisterInterval,
+			PeerTimeout:          options.PeerTimeout,
+			WireguardMTU:         api.WireguardMTU,
+		},
+		WireguardEndpoint:      options.WireguardEndpoint,
+		BaseURL:                api.BaseURL.String(),
+		WireguardNetworkPrefix: api.WireguardNetworkPrefix,
+	})
+}
+
+// tunnelVersions returns the tunnel versions accepted by the server in
+// ascending order.
+func (*API) tunnelVersions() []tunnelsdk.TunnelVersion {
+	return []tunnelsdk.TunnelVersion{
+		tunnelsdk.TunnelVersion1,
+		tunnelsdk.TunnelVersion2,
+		tunnelsdk.TunnelVersion3,
+	}
+}
+
+func (api *API) supportsTunnelVersion(version tunnelsdk.TunnelVersion) bool {
+	for _, v := range api.tunnelVersions() {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (api *API) postClientsChallenge(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	nonce, expiresAt, err := api.newNonce()
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, tunnelsdk.Response{
+			Message: "Failed to generate nonce.",
+			Code:    tunnelsdk.ErrorCodeInternal,
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, tunnelsdk.ClientChallengeResponse{
+		Nonce:           nonce,
+		ExpiresAt:       expiresAt,
+		ServerPublicKey: api.CurrentOptions().WireguardKey.NoisePublicKey(),
+	})
+}
+
+func (api *API) deleteClients(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req tunnelsdk.ClientDeregisterRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+
+	skew := time.Since(req.Timestamp)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > tunnelsdk.ProofMaxClockSkew {
+		httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+			Message: "Request timestamp is too far from the server's clock.",
+			Code:    tunnelsdk.ErrorCodeClockSkew,
+			Detail:  fmt.Sprintf("timestamp %s differs from server time by %s, maximum is %s", req.Timestamp.Format(time.RFC3339), skew, tunnelsdk.ProofMaxClockSkew),
+		})
+		return
+	}
+	if !verifyProof(api.CurrentOptions(), req.PublicKey, req.ProofMessage(), req.Proof) {
+		httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+			Message: "Invalid proof of private key possession.",
+			Code:    tunnelsdk.ErrorCodeInvalidProof,
+		})
+		return
+	}
+
+	if !api.useProof(req.Proof, req.Timestamp) {
+		httpapi.Write(ctx, rw, http.StatusUnauthorized, tunnelsdk.Response{
+			Message: "Proof of private key possession has already been used.",
+			Code:    tunnelsdk.ErrorCodeProofUsed,
+		})
+		return
+	}
+
+	api.deregisterClient(req.PublicKey)
+	httpapi.Write(ctx, rw, http.StatusOK, tunnelsdk.Response{
+		Message: "Client deregistered.",
+	})
+}
+
+// useProof records a verified proof or nonce as used. It returns false if it
+// has been used before. Proofs are forgotten once their timestamp is too old
+// to be accepted again.
+func (api *API) useProof(proof []byte, timestamp time.Time) bool {
+	api.usedProofsMu.Lock()
+	defer api.usedProofsMu.Unlock()
+
+	for k, ts := range api.usedProofs {
+		if time.Since(ts) > tunnelsdk.ProofMaxClockSkew {
+			delete(api.usedProofs, k)
+		}
+	}
+
+	if _, ok := api.usedProofs[string(proof)]; ok {
+		return false
+	}
+	api.usedProofs[string(proof)] = timestamp
+	return true
+}
+
+// deregisterClient removes the client's peer from the wireguard device and the
+// peer cache so traffic is no longer routed to it.
+func (api *API) deregisterClient(publicKey device.NoisePublicKey) {
+	// The version only affects the URLs, not the IP.
+	options := api.CurrentOptions()
+	ip, urls := options.WireguardPublicKeyToIPAndURLs(publicKey, tunnelsdk.TunnelVersionLatest)
+	if api.ipv4 != nil {
+		// Don't assign an IP to a client that's going away.
+		label, _ := splitHostname(urls[0].Host)
+		ip, _ = api.ipv4.lookup(label)
 	}
 
-	ip, urls := api.WireguardPublicKeyToIPAndURLs(req.PublicKey, req.Version)
+	api.pkeyCacheMu.Lock()
+	if cached, ok := api.pkeyCache[ip]; ok && cached.key == publicKey {
+		delete(api.pkeyCache, ip)
+	}
+	api.pkeyCacheMu.Unlock()
+
+	api.wgDevice.RemovePeer(publicKey)
+}
+
+// errProofRequired is returned by registerClient when a registration without
+// proof of possession is made for a key that is connected with proof.
+var errProofRequired = xerrors.New("proof of private key possession required")
+
+// errTunnelIDInUse is returned by registerClient when the client IP derived
+// from the key is in use by a connected client with a different key.
+var errTunnelIDInUse = xerrors.New("tunnel identifier is in use by another key")
+
+// writeTunnelIDInUse writes the response for errTunnelIDInUse.
+func writeTunnelIDInUse(ctx context.Context, rw http.ResponseWriter) {
+	httpapi.Write(ctx, rw, http.StatusConflict, tunnelsdk.Response{
+		Message: "Tunnel identifier is in use by another public key.",
+		Code:    tunnelsdk.ErrorCodeTunnelIDInUse,
+		Detail:  "the hash of the public key collides with the hash of a connected client's key, generate a new key",
+	})
+}
+
+// normalizeVersion returns the version to use for a registration request.
+// Clients that predate tunnel versions send no version and get the URL format
+// from before proofs were required.
+func normalizeVersion(version tunnelsdk.TunnelVersion) tunnelsdk.TunnelVersion {
+	if version == 0 {
+		return tunnelsdk.TunnelVersion2
+	}
+	return version
+}
+
+// registerClient adds the client as a peer, or refreshes it if it already
+// exists. proven should be true if the request included a valid proof of
+// possession of the private key.
+func (api *API) registerClient(req tunnelsdk.ClientRegisterRequest, proven bool) (tunnelsdk.ClientRegisterResponse, bool, error) {
+	req.Version = normalizeVersion(req.Version)
+	options := api.CurrentOptions()
+
+	ip, urls, err := api.clientIPAndURLs(options, req.PublicKey, req.Version)
+	if err != nil {
+		return tunnelsdk.ClientRegisterResponse{}, false, err
+	}
 
 	api.pkeyCacheMu.Lock()
+	// Don't let clients without a proof keep a proven peer alive or take it
+	// over. Once the proven peer times out, the key is up for grabs again.
+	cached, ok := api.pkeyCache[ip]
+	if !proven && ok && cached.proven && cached.key == req.PublicKey && time.Since(cached.lastHandshake) <= options.PeerTimeout {
+		api.pkeyCacheMu.Unlock()
+		return tunnelsdk.ClientRegisterResponse{}, false, errProofRequired
+	}
+	// Client IPs only use 64 bits of the key hash, so two keys can map to the
+	// same IP. Don't let the second key take over a tunnel that's in use.
+	replaced := ok && cached.key != req.PublicKey
+	if replaced && time.Since(cached.lastHandshake) <= options.PeerTimeout {
+		api.pkeyCacheMu.Unlock()
+		return tunnelsdk.ClientRegisterResponse{}, false, errTunnelIDInUse
+	}
 	api.pkeyCache[ip] = cachedPeer{
 		key:           req.PublicKey,
 		lastHandshake: time.Now(),
+		proven:        proven,
 	}
 	api.pkeyCacheMu.Unlock()
 
+	if replaced {
+		// The previous owner of the IP timed out, remove its peer so it can't
+		// route traffic for the IP anymore.
+		api.wgDevice.RemovePeer(cached.key)
+	}
+
 	exists := true
 	if api.wgDevice.LookupPeer(req.PublicKey) == nil {
 		exists = false
@@ -180,34 +549,54 @@ func (api *API) registerClient(req tunnelsdk.ClientRegisterRequest) (tunnelsdk.C
 		api.pkeyCache[ip] = cachedPeer{
 			key:           req.PublicKey,
 			lastHandshake: time.Now(),
+			proven:        proven,
 		}
 		api.pkeyCacheMu.Unlock()
 
 		err := api.wgDevice.IpcSet(fmt.Sprintf(`public_key=%x
-allowed_ip=%s/128`,
+allowed_ip=%s/%d`,
 			req.PublicKey,
 			ip.String(),
+			ip.BitLen(),
 		))
 		if err != nil {
 			return tunnelsdk.ClientRegisterResponse{}, false, xerrors.Errorf("register client with wireguard: %w", err)
 		}
 	}
 
+	// New peers can't have completed a handshake yet.
+	handshaken := false
+	if exists {
+		var err error
+		handshaken, err = api.handshakes.handshaken(api.wgDevice, req.PublicKey, time.Now())
+		if err != nil {
+			return tunnelsdk.ClientRegisterResponse{}, false, xerrors.Errorf("get peer handshake: %w", err)
+		}
+	}
+	wait := reregisterWait(options, handshaken, api.registrations.add(time.Now()))
+
 	urlsStr := make([]string, len(urls))
 	for i, u := range urls {
 		urlsStr[i] = u.String()
 	}
 
-	return tunnelsdk.ClientRegisterResponse{
+	res := tunnelsdk.ClientRegisterResponse{
 		Version:         req.Version,
-		ReregisterWait:  api.PeerRegisterInterval,
+		ReregisterWait:  wait,
 		TunnelURLs:      urlsStr,
 		ClientIP:        ip,
-		ServerEndpoint:  api.WireguardEndpoint,
+		ServerEndpoint:  options.WireguardEndpoint,
 		ServerIP:        api.WireguardServerIP,
-		ServerPublicKey: api.WireguardKey.NoisePublicKey(),
+		ServerPublicKey: options.WireguardKey.NoisePublicKey(),
 		WireguardMTU:    api.WireguardMTU,
-	}, exists, nil
+	}
+	if !options.WireguardNextKey.IsZero() {
+		nextKey := options.WireguardNextKey.NoisePublicKey()
+		rotationTime := options.WireguardKeyRotationTime
+		res.NextServerPublicKey = &nextKey
+		res.ServerKeyRotationTime = &rotationTime
+	}
+	return res, exists, nil
 }
 
 type ipPortKey struct{}
@@ -215,6 +604,15 @@ type ipPortKey struct{}
 func (api *API) handleTunnel(rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	if !api.proxyRequests.start() {
+		httpapi.Write(ctx, rw, http.StatusServiceUnavailable, tunnelsdk.Response{
+			Message: "Server is shutting down.",
+			Code:    tunnelsdk.ErrorCodeShuttingDown,
+		})
+		return
+	}
+	defer api.proxyRequests.done()
+
 	host := r.Host
 	subdomain, _ := splitHostname(host)
 	subdomainParts := strings.Split(subdomain, "-")
@@ -226,22 +624,30 @@ func (api *API) handleTunnel(rw http.ResponseWriter, r *http.Request) {
 		attribute.String("user", user),
 	)
 
-	ip, err := api.HostnameToWireguardIP(user)
+	httpmw.AddAccessLogFields(ctx, slog.F("tunnel_label", user))
+
+	if isOldFormatHostname(user) {
+		api.legacy.addHostnameRequest(time.Now())
+	}
+	ip, err := api.hostnameToIP(api.CurrentOptions(), user)
 	if err != nil {
 		httpapi.Write(ctx, rw, http.StatusBadRequest, tunnelsdk.Response{
 			Message: "Invalid tunnel URL.",
+			Code:    tunnelsdk.ErrorCodeInvalidTunnelURL,
 			Detail:  err.Error(),
 		})
 		return
 	}
+	httpmw.AddAccessLogFields(ctx, slog.F("peer_ip", ip.String()))
 
 	api.pkeyCacheMu.RLock()
 	pkey, ok := api.pkeyCache[ip]
 	api.pkeyCacheMu.RUnlock()
 
-	if !ok || time.Since(pkey.lastHandshake) > api.PeerTimeout {
+	if !ok || time.Since(pkey.lastHandshake) > api.CurrentOptions().PeerTimeout {
 		httpapi.Write(ctx, rw, http.StatusBadGateway, tunnelsdk.Response{
 			Message: "Peer is not connected.",
+			Code:    tunnelsdk.ErrorCodePeerNotConnected,
 			Detail:  "",
 		})
 		return
@@ -257,6 +663,7 @@ func (api *API) handleTunnel(rw http.ResponseWriter, r *http.Request) {
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			httpapi.Write(ctx, rw, http.StatusBadGateway, tunnelsdk.Response{
 				Message: "Failed to dial peer.",
+				Code:    tunnelsdk.ErrorCodePeerDialFailed,
 				Detail:  err.Error(),
 			})
 		},
@@ -6,12 +6,20 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tailscale/wireguard-go/device"
 
+	"github.com/coder/wgtunnel/buildinfo"
 	"github.com/coder/wgtunnel/tunneld"
 	"github.com/coder/wgtunnel/tunnelsdk"
 )
@@ -100,7 +108,10 @@ func Test_postClients(t *testing.T) {
 	require.Equal(t, td.WireguardServerIP, res.ServerIP)
 	require.Equal(t, td.WireguardKey.NoisePublicKey(), res.ServerPublicKey)
 	require.Equal(t, td.WireguardMTU, res.WireguardMTU)
-	require.Equal(t, td.PeerRegisterInterval, res.ReregisterWait)
+	// New peers can't have completed a handshake, so they're asked to check
+	// back sooner.
+	require.LessOrEqual(t, res.ReregisterWait, td.PeerRegisterInterval/4)
+	require.GreaterOrEqual(t, res.ReregisterWait, td.PeerRegisterInterval*3/16)
 
 	// Register the same client again.
 	res2, err := client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
@@ -108,6 +119,9 @@ func Test_postClients(t *testing.T) {
 		PublicKey: key.NoisePublicKey(),
 	})
 	require.NoError(t, err)
+	// The peer still hasn't completed a handshake.
+	require.LessOrEqual(t, res2.ReregisterWait, td.PeerRegisterInterval/4)
+	res2.ReregisterWait = res.ReregisterWait
 	require.Equal(t, res, res2)
 
 	// Register the same client with the old version.
@@ -121,9 +135,572 @@ func Test_postClients(t *testing.T) {
 	require.Equal(t, tunnelsdk.TunnelVersion1, res3.Version)
 	res3.TunnelURLs[0], res3.TunnelURLs[1] = res3.TunnelURLs[1], res3.TunnelURLs[0]
 	res3.Version = tunnelsdk.TunnelVersion2
+	res3.ReregisterWait = res.ReregisterWait
 	require.Equal(t, res, res3)
 }
 
+func Test_postClientsProof(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		challenge, err := client.ClientChallenge(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, td.WireguardKey.NoisePublicKey(), challenge.ServerPublicKey)
+
+		req, err := tunnelsdk.NewClientRegisterRequest(tunnelsdk.TunnelVersion3, key, challenge)
+		require.NoError(t, err)
+		res, err := client.ClientRegister(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, tunnelsdk.TunnelVersion3, res.Version)
+
+		// The nonce can only be used once.
+		_, err = client.ClientRegister(context.Background(), req)
+		require.Error(t, err)
+		var sdkErr *tunnelsdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusUnauthorized, sdkErr.StatusCode())
+		require.Equal(t, tunnelsdk.ErrorCodeNonceUsed, sdkErr.Code)
+		require.ErrorIs(t, err, tunnelsdk.ErrUnauthorized)
+
+		// Registering the key without a proof should fail now that it's
+		// connected with one, on both the new and legacy endpoints.
+		_, err = client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			Version:   tunnelsdk.TunnelVersion2,
+			PublicKey: key.NoisePublicKey(),
+		})
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusUnauthorized, sdkErr.StatusCode())
+		require.ErrorIs(t, err, tunnelsdk.ErrKeyInUse)
+
+		legacyRes, err := client.Request(context.Background(), http.MethodPost, "/tun", tunneld.LegacyPostTunRequest{
+			PublicKey: key.NoisePublicKey(),
+		})
+		require.NoError(t, err)
+		defer legacyRes.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, legacyRes.StatusCode)
+
+		// Re-registering with a new proof works.
+		challenge, err = client.ClientChallenge(context.Background())
+		require.NoError(t, err)
+		req, err = tunnelsdk.NewClientRegisterRequest(tunnelsdk.TunnelVersion3, key, challenge)
+		require.NoError(t, err)
+		res2, err := client.ClientRegister(context.Background(), req)
+		require.NoError(t, err)
+		// The re-register wait is jittered.
+		res2.ReregisterWait = res.ReregisterWait
+		require.Equal(t, res, res2)
+	})
+
+	t.Run("MissingProof", func(t *testing.T) {
+		t.Parallel()
+
+		_, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		_, err = client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			Version:   tunnelsdk.TunnelVersion3,
+			PublicKey: key.NoisePublicKey(),
+		})
+		var sdkErr *tunnelsdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusUnauthorized, sdkErr.StatusCode())
+		require.Equal(t, tunnelsdk.ErrorCodeInvalidNonce, sdkErr.Code)
+	})
+
+	t.Run("InvalidProof", func(t *testing.T) {
+		t.Parallel()
+
+		_, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+		otherKey, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		// Sign the request with a different private key.
+		challenge, err := client.ClientChallenge(context.Background())
+		require.NoError(t, err)
+		req, err := tunnelsdk.NewClientRegisterRequest(tunnelsdk.TunnelVersion3, otherKey, challenge)
+		require.NoError(t, err)
+		req.PublicKey = key.NoisePublicKey()
+
+		_, err = client.ClientRegister(context.Background(), req)
+		var sdkErr *tunnelsdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusUnauthorized, sdkErr.StatusCode())
+		require.Equal(t, tunnelsdk.ErrorCodeInvalidProof, sdkErr.Code)
+	})
+
+	t.Run("ForeignNonce", func(t *testing.T) {
+		t.Parallel()
+
+		_, client1 := createTestTunneld(t, nil)
+		_, client2 := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		// A nonce issued by another server isn't accepted.
+		challenge, err := client1.ClientChallenge(context.Background())
+		require.NoError(t, err)
+		challenge2, err := client2.ClientChallenge(context.Background())
+		require.NoError(t, err)
+		challenge.ServerPublicKey = challenge2.ServerPublicKey
+		req, err := tunnelsdk.NewClientRegisterRequest(tunnelsdk.TunnelVersion3, key, challenge)
+		require.NoError(t, err)
+
+		_, err = client2.ClientRegister(context.Background(), req)
+		var sdkErr *tunnelsdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusUnauthorized, sdkErr.StatusCode())
+	})
+}
+
+// Clients only fall back to registering without a proof if the server doesn't
+// advertise its supported versions.
+func Test_registerChallengeFallback(t *testing.T) {
+	t.Parallel()
+
+	td, _ := createTestTunneld(t, nil)
+	// newClient returns a client for td where the given paths respond with
+	// 404 like they would on an older server.
+	newClient := func(t *testing.T, missing ...string) *tunnelsdk.Client {
+		router := td.Router()
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			for _, p := range missing {
+				if r.URL.Path == p {
+					http.NotFound(rw, r)
+					return
+				}
+			}
+			router.ServeHTTP(rw, r)
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		client := tunnelsdk.New(td.BaseURL)
+		client.HTTPClient = tunnelHTTPClient(u)
+		return client
+	}
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	// The server advertises TunnelVersion3, so a missing challenge endpoint
+	// is an error rather than a reason to skip the proof.
+	client := newClient(t, "/api/v2/clients/challenge")
+	_, err = client.Register(context.Background(), tunnelsdk.TunnelConfig{PrivateKey: key})
+	require.Error(t, err)
+	require.ErrorContains(t, err, "get registration challenge")
+
+	// Servers without the info endpoint may predate proofs.
+	client = newClient(t, "/api/v2/info", "/api/v2/clients/challenge")
+	res, err := client.Register(context.Background(), tunnelsdk.TunnelConfig{PrivateKey: key})
+	require.NoError(t, err)
+	require.Equal(t, tunnelsdk.TunnelVersion2, res.Version)
+}
+
+func Test_postClientsValidation(t *testing.T) {
+	t.Parallel()
+
+	_, client := createTestTunneld(t, nil)
+
+	_, err := client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+		Version: tunnelsdk.TunnelVersion3,
+		Nonce:   []byte("nonce"),
+		Proof:   []byte("short"),
+	})
+	var sdkErr *tunnelsdk.Error
+	require.ErrorAs(t, err, &sdkErr)
+	require.Equal(t, http.StatusBadRequest, sdkErr.StatusCode())
+	require.Equal(t, tunnelsdk.ErrorCodeValidationFailed, sdkErr.Code)
+	require.ErrorIs(t, err, tunnelsdk.ErrInvalidRequest)
+	require.Equal(t, []tunnelsdk.ValidationError{
+		{Field: "public_key", Detail: "public key is required"},
+		{Field: "proof", Detail: "proof must be 32 bytes, got 5"},
+	}, tunnelsdk.Validations(err))
+
+	// Bodies that aren't JSON have their own code.
+	res, err := client.Request(context.Background(), http.MethodPost, "/api/v2/clients", []byte("{"))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	var resBody tunnelsdk.Response
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resBody))
+	require.Equal(t, tunnelsdk.ErrorCodeInvalidRequest, resBody.Code)
+}
+
+func Test_postClientsStrictDecoding(t *testing.T) {
+	t.Parallel()
+
+	_, client := createTestTunneld(t, nil)
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+	publicKey, err := json.Marshal(key.NoisePublicKey())
+	require.NoError(t, err)
+	zeroKey, err := json.Marshal([32]byte{})
+	require.NoError(t, err)
+	// The point of order 8 from https://cr.yp.to/ecdh.html#validate.
+	var lowOrderKey [32]byte
+	_, err = hex.Decode(lowOrderKey[:], []byte("e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800"))
+	require.NoError(t, err)
+	lowOrderKeyJSON, err := json.Marshal(lowOrderKey)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name        string
+		body        string
+		code        tunnelsdk.ErrorCode
+		validations []tunnelsdk.ValidationError
+	}{
+		{
+			name:        "UnknownField",
+			body:        `{"version": 2, "public_key": ` + string(publicKey) + `, "extra": true}`,
+			code:        tunnelsdk.ErrorCodeInvalidRequest,
+			validations: []tunnelsdk.ValidationError{{Field: "extra", Detail: "unknown field"}},
+		},
+		{
+			name:        "WrongType",
+			body:        `{"version": "2", "public_key": ` + string(publicKey) + `}`,
+			code:        tunnelsdk.ErrorCodeInvalidRequest,
+			validations: []tunnelsdk.ValidationError{{Field: "version", Detail: "must be a tunnelsdk.TunnelVersion, got string"}},
+		},
+		{
+			name: "TrailingValue",
+			body: `{"version": 2, "public_key": ` + string(publicKey) + `} {}`,
+			code: tunnelsdk.ErrorCodeInvalidRequest,
+		},
+		{
+			name: "TrailingGarbage",
+			body: `{"version": 2, "public_key": ` + string(publicKey) + `}}`,
+			code: tunnelsdk.ErrorCodeInvalidRequest,
+		},
+		{
+			name:        "ZeroPublicKey",
+			body:        `{"version": 2, "public_key": ` + string(zeroKey) + `}`,
+			code:        tunnelsdk.ErrorCodeValidationFailed,
+			validations: []tunnelsdk.ValidationError{{Field: "public_key", Detail: "public key is required"}},
+		},
+		{
+			name:        "LowOrderPublicKey",
+			body:        `{"version": 2, "public_key": ` + string(lowOrderKeyJSON) + `}`,
+			code:        tunnelsdk.ErrorCodeValidationFailed,
+			validations: []tunnelsdk.ValidationError{{Field: "public_key", Detail: "public key must not be a low order point"}},
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			res, err := client.Request(context.Background(), http.MethodPost, "/api/v2/clients", []byte(c.body))
+			require.NoError(t, err)
+			defer res.Body.Close()
+			require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+			var resBody tunnelsdk.Response
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&resBody))
+			require.Equal(t, c.code, resBody.Code)
+			require.Equal(t, c.validations, resBody.Validations)
+		})
+	}
+
+	// The legacy endpoint validates the public key too.
+	res, err := client.Request(context.Background(), http.MethodPost, "/tun", []byte(`{"public_key": `+string(lowOrderKeyJSON)+`}`))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func Test_postClientsUnsupportedVersion(t *testing.T) {
+	t.Parallel()
+
+	_, client := createTestTunneld(t, nil)
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	_, err = client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+		Version:   tunnelsdk.TunnelVersionLatest + 1,
+		PublicKey: key.NoisePublicKey(),
+	})
+	var sdkErr *tunnelsdk.Error
+	require.ErrorAs(t, err, &sdkErr)
+	require.Equal(t, http.StatusBadRequest, sdkErr.StatusCode())
+	require.Equal(t, tunnelsdk.ErrorCodeUnsupportedVersion, sdkErr.Code)
+	require.ErrorIs(t, err, tunnelsdk.ErrUnsupportedVersion)
+	require.ErrorIs(t, err, tunnelsdk.ErrInvalidRequest)
+	require.NotErrorIs(t, err, tunnelsdk.ErrUnauthorized)
+	validations := tunnelsdk.Validations(err)
+	require.Len(t, validations, 1)
+	require.Equal(t, "version", validations[0].Field)
+
+	// Negative versions are invalid rather than unsupported.
+	_, err = client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+		Version:   -1,
+		PublicKey: key.NoisePublicKey(),
+	})
+	require.ErrorAs(t, err, &sdkErr)
+	require.Equal(t, tunnelsdk.ErrorCodeValidationFailed, sdkErr.Code)
+	require.NotErrorIs(t, err, tunnelsdk.ErrUnsupportedVersion)
+
+	// LaunchTunnel should fail before registering.
+	_, err = client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Version:    tunnelsdk.TunnelVersionLatest + 1,
+		PrivateKey: key,
+	})
+	require.ErrorContains(t, err, "incompatible server")
+}
+
+func Test_postClientsMinimumClientVersion(t *testing.T) {
+	t.Parallel()
+
+	_, client := createTestTunneld(t, &tunneld.Options{
+		MinimumClientVersion: "v1.2.0",
+		ClientDownloadURL:    "https://example.com/download",
+	})
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	for _, version := range []string{"v1.2.0", "v1.3.0-rc.1"} {
+		_, err = client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			Version:       tunnelsdk.TunnelVersion2,
+			PublicKey:     key.NoisePublicKey(),
+			ClientVersion: version,
+		})
+		require.NoError(t, err, version)
+	}
+
+	// Development builds of the SDK report v0.0.0-devel.
+	for _, version := range []string{"v1.1.9", "v1.2.0-rc.1", "not-a-version", ""} {
+		_, err = client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			Version:       tunnelsdk.TunnelVersion2,
+			PublicKey:     key.NoisePublicKey(),
+			ClientVersion: version,
+		})
+		var sdkErr *tunnelsdk.Error
+		require.ErrorAs(t, err, &sdkErr, version)
+		require.Equal(t, http.StatusBadRequest, sdkErr.StatusCode(), version)
+		require.ErrorIs(t, err, tunnelsdk.ErrClientOutdated, version)
+		require.Contains(t, sdkErr.Message, "https://example.com/download", version)
+		require.Contains(t, sdkErr.Message, "v1.2.0", version)
+	}
+
+	// The legacy endpoint uses the version header, which is the SDK's
+	// development version here.
+	res, err := client.Request(context.Background(), http.MethodPost, "/tun", tunneld.LegacyPostTunRequest{
+		PublicKey: key.NoisePublicKey(),
+	})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	var resBody tunnelsdk.Response
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resBody))
+	require.Equal(t, tunnelsdk.ErrorCodeClientOutdated, resBody.Code)
+}
+
+func Test_legacyOptions(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Default", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+		_, urls := td.WireguardPublicKeyToIPAndURLs(key.NoisePublicKey(), tunnelsdk.TunnelVersion1)
+		require.Len(t, urls, 2)
+
+		// The old format is accepted, but the peer isn't registered.
+		res, err := client.Request(context.Background(), http.MethodGet, urls[0].String(), nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+		usage := td.LegacyUsage()
+		require.EqualValues(t, 1, usage.OldFormatHostnameRequests)
+		require.False(t, usage.LastOldFormatHostnameRequest.IsZero())
+		require.Zero(t, usage.LegacyEndpointRequests)
+		require.True(t, usage.LastLegacyEndpointRequest.IsZero())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, &tunneld.Options{
+			DisableLegacyEndpoint: true,
+			DisableOldFormatURLs:  true,
+			RejectOldFormatURLs:   true,
+		})
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		res, err := client.Request(context.Background(), http.MethodPost, "/tun", tunneld.LegacyPostTunRequest{
+			PublicKey: key.NoisePublicKey(),
+		})
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+		for _, version := range []tunnelsdk.TunnelVersion{tunnelsdk.TunnelVersion1, tunnelsdk.TunnelVersion2} {
+			regRes, err := client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+				Version:   version,
+				PublicKey: key.NoisePublicKey(),
+			})
+			require.NoError(t, err)
+			require.Len(t, regRes.TunnelURLs, 1)
+			u, err := url.Parse(regRes.TunnelURLs[0])
+			require.NoError(t, err)
+			require.Len(t, strings.Split(u.Host, ".")[0], 13)
+		}
+
+		_, urls := tunnelsdk.PublicKeyToIPAndURLs(key.NoisePublicKey(), td.WireguardNetworkPrefix, td.BaseURL, tunnelsdk.TunnelVersion1)
+		_, err = td.CurrentOptions().HostnameToWireguardIP(strings.Split(urls[0].Host, ".")[0])
+		require.Error(t, err)
+
+		res, err = client.Request(context.Background(), http.MethodGet, urls[0].String(), nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusBadRequest, res.StatusCode)
+		var resBody tunnelsdk.Response
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resBody))
+		require.Equal(t, tunnelsdk.ErrorCodeInvalidTunnelURL, resBody.Code)
+
+		usage := td.LegacyUsage()
+		require.EqualValues(t, 1, usage.LegacyEndpointRequests)
+		require.EqualValues(t, 1, usage.OldFormatHostnameRequests)
+	})
+}
+
+func Test_postClientsTunnelIDCollision(t *testing.T) {
+	t.Parallel()
+
+	// Every key hashes to the same value, so every key gets the same IP and
+	// URLs.
+	td, client := createTestTunneld(t, tunneld.WithPublicKeyHash(&tunneld.Options{}, func(device.NoisePublicKey) [32]byte {
+		return [32]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	}))
+
+	key1, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+	key2, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	register := func(key tunnelsdk.Key) (tunnelsdk.ClientRegisterResponse, error) {
+		return client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			Version:   tunnelsdk.TunnelVersion2,
+			PublicKey: key.NoisePublicKey(),
+		})
+	}
+
+	res1, err := register(key1)
+	require.NoError(t, err)
+
+	_, err = register(key2)
+	var sdkErr *tunnelsdk.Error
+	require.ErrorAs(t, err, &sdkErr)
+	require.Equal(t, http.StatusConflict, sdkErr.StatusCode())
+	require.ErrorIs(t, err, tunnelsdk.ErrTunnelIDInUse)
+
+	// The legacy endpoint rejects it too.
+	legacyRes, err := client.Request(context.Background(), http.MethodPost, "/tun", tunneld.LegacyPostTunRequest{
+		PublicKey: key2.NoisePublicKey(),
+	})
+	require.NoError(t, err)
+	defer legacyRes.Body.Close()
+	require.Equal(t, http.StatusConflict, legacyRes.StatusCode)
+
+	// The first key can keep re-registering.
+	_, err = register(key1)
+	require.NoError(t, err)
+
+	// Once the first key is gone, the second key can take over.
+	err = client.ClientDeregister(context.Background(), key1, td.WireguardKey.NoisePublicKey())
+	require.NoError(t, err)
+	res2, err := register(key2)
+	require.NoError(t, err)
+	require.Equal(t, res1.ClientIP, res2.ClientIP)
+	require.Equal(t, res1.TunnelURLs, res2.TunnelURLs)
+
+	// Clients that time out lose their IP too.
+	_, client = createTestTunneld(t, tunneld.WithPublicKeyHash(&tunneld.Options{
+		PeerRegisterInterval: 10 * time.Millisecond,
+		PeerTimeout:          50 * time.Millisecond,
+	}, func(device.NoisePublicKey) [32]byte {
+		return [32]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	}))
+	_, err = register(key1)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := register(key2)
+		return err == nil
+	}, 5*time.Second, 25*time.Millisecond)
+}
+
+func Test_getInfo(t *testing.T) {
+	t.Parallel()
+
+	td, client := createTestTunneld(t, nil)
+
+	info, err := client.ServerInfo(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, buildinfo.Version(), info.Version)
+	require.Equal(t, []tunnelsdk.TunnelVersion{
+		tunnelsdk.TunnelVersion1,
+		tunnelsdk.TunnelVersion2,
+		tunnelsdk.TunnelVersion3,
+	}, info.TunnelVersions)
+	require.True(t, info.SupportsTunnelVersion(tunnelsdk.TunnelVersionLatest))
+	require.True(t, info.Capabilities.HTTP)
+	require.ElementsMatch(t, []tunnelsdk.AuthMode{tunnelsdk.AuthModeNone, tunnelsdk.AuthModeProof}, info.Capabilities.AuthModes)
+	require.Equal(t, td.WireguardEndpoint, info.WireguardEndpoint)
+	require.Equal(t, td.BaseURL.String(), info.BaseURL)
+	require.Equal(t, td.WireguardNetworkPrefix, info.WireguardNetworkPrefix)
+	require.Equal(t, td.PeerRegisterInterval, info.Limits.PeerRegisterInterval)
+	require.Equal(t, td.PeerTimeout, info.Limits.PeerTimeout)
+	require.Equal(t, td.WireguardMTU, info.Limits.WireguardMTU)
+	require.NotZero(t, info.Limits.APIRateLimit)
+	require.NotZero(t, info.Limits.MaxRequestBodyBytes)
+}
+
+func Test_rateLimit(t *testing.T) {
+	t.Parallel()
+
+	_, client := createTestTunneld(t, &tunneld.Options{
+		APIRateLimit: 1,
+	})
+
+	// Registering takes an info and a challenge request, which don't count
+	// towards the limit.
+	for i := 0; i < 5; i++ {
+		_, err := client.ServerInfo(context.Background())
+		require.NoError(t, err)
+		_, err = client.ClientChallenge(context.Background())
+		require.NoError(t, err)
+	}
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+	_, err = client.Register(context.Background(), tunnelsdk.TunnelConfig{PrivateKey: key})
+	require.NoError(t, err)
+	_, err = client.Register(context.Background(), tunnelsdk.TunnelConfig{PrivateKey: key})
+	require.ErrorIs(t, err, tunnelsdk.ErrRateLimited)
+}
+
 func Test_getRoot(t *testing.T) {
 	t.Parallel()
 
@@ -137,3 +714,249 @@ func Test_getRoot(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "https://coder.com", string(out))
 }
+
+func Test_deleteClients(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		_, err = client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			PublicKey: key.NoisePublicKey(),
+		})
+		require.NoError(t, err)
+
+		err = client.ClientDeregister(context.Background(), key, td.WireguardKey.NoisePublicKey())
+		require.NoError(t, err)
+
+		// Deregistering an unknown client is a no-op.
+		err = client.ClientDeregister(context.Background(), key, td.WireguardKey.NoisePublicKey())
+		require.NoError(t, err)
+	})
+
+	t.Run("InvalidProof", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+		otherKey, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		// Sign the request with a different private key.
+		req, err := tunnelsdk.NewClientDeregisterRequest(otherKey, td.WireguardKey.NoisePublicKey())
+		require.NoError(t, err)
+		req.PublicKey = key.NoisePublicKey()
+
+		res, err := client.Request(context.Background(), http.MethodDelete, "/api/v2/clients", req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		req, err := tunnelsdk.NewClientDeregisterRequest(key, td.WireguardKey.NoisePublicKey())
+		require.NoError(t, err)
+
+		res, err := client.Request(context.Background(), http.MethodDelete, "/api/v2/clients", req)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		// The same request can't be used twice.
+		res, err = client.Request(context.Background(), http.MethodDelete, "/api/v2/clients", req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("StaleTimestamp", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, nil)
+
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		req := tunnelsdk.ClientDeregisterRequest{
+			PublicKey: key.NoisePublicKey(),
+			Timestamp: time.Now().Add(-2 * tunnelsdk.ProofMaxClockSkew),
+		}
+		req.Proof, err = tunnelsdk.ProofMAC(key, td.WireguardKey.NoisePublicKey(), req.ProofMessage())
+		require.NoError(t, err)
+
+		res, err := client.Request(context.Background(), http.MethodDelete, "/api/v2/clients", req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
+
+func Test_postClientsIPv4(t *testing.T) {
+	t.Parallel()
+
+	// Every key hashes to the start of the network, so the allocator has to
+	// probe for a free IP every time.
+	keyHash := func(pk device.NoisePublicKey) [32]byte {
+		hash := tunnelsdk.PublicKeyHash(pk)
+		hash[7] = 0
+		return hash
+	}
+	assignmentsFile := filepath.Join(t.TempDir(), "ips.json")
+	options := tunneld.WithPublicKeyHash(&tunneld.Options{
+		WireguardNetworkPrefix:     netip.MustParsePrefix("100.64.0.0/29"),
+		WireguardIPAssignmentsFile: assignmentsFile,
+	}, keyHash)
+	td, client := createTestTunneld(t, options)
+	require.Equal(t, netip.MustParseAddr("100.64.0.1"), td.WireguardServerIP)
+
+	register := func(client *tunnelsdk.Client, key tunnelsdk.Key) (tunnelsdk.ClientRegisterResponse, error) {
+		return client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			Version:   tunnelsdk.TunnelVersion2,
+			PublicKey: key.NoisePublicKey(),
+		})
+	}
+
+	// The network, broadcast and server addresses leave 5 usable IPs.
+	keys := make([]tunnelsdk.Key, 5)
+	ips := make(map[netip.Addr]bool)
+	for i := range keys {
+		var err error
+		keys[i], err = tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+
+		res, err := register(client, keys[i])
+		require.NoError(t, err)
+		require.True(t, res.ClientIP.Is4())
+		require.NotEqual(t, netip.MustParseAddr("100.64.0.0"), res.ClientIP)
+		require.NotEqual(t, netip.MustParseAddr("100.64.0.1"), res.ClientIP)
+		require.NotEqual(t, netip.MustParseAddr("100.64.0.7"), res.ClientIP)
+		require.False(t, ips[res.ClientIP], "IP assigned twice")
+		ips[res.ClientIP] = true
+		// Only "good format" URLs are issued.
+		require.Len(t, res.TunnelURLs, 1)
+	}
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+	_, err = register(client, key)
+	var sdkErr *tunnelsdk.Error
+	require.ErrorAs(t, err, &sdkErr)
+	require.Equal(t, http.StatusInternalServerError, sdkErr.StatusCode())
+	require.Contains(t, sdkErr.Detail, "no free client IPs")
+
+	// Assignments survive restarts.
+	res1, err := register(client, keys[2])
+	require.NoError(t, err)
+	require.NoError(t, td.Close())
+	_, client = createTestTunneld(t, tunneld.WithPublicKeyHash(&tunneld.Options{
+		WireguardNetworkPrefix:     netip.MustParsePrefix("100.64.0.0/29"),
+		WireguardIPAssignmentsFile: assignmentsFile,
+	}, keyHash))
+	res2, err := register(client, keys[2])
+	require.NoError(t, err)
+	require.Equal(t, res1.ClientIP, res2.ClientIP)
+	require.Equal(t, res1.TunnelURLs, res2.TunnelURLs)
+}
+
+func Test_postClientsIPv4Expiry(t *testing.T) {
+	t.Parallel()
+
+	assignmentsFile := filepath.Join(t.TempDir(), "ips.json")
+	newOptions := func() *tunneld.Options {
+		return &tunneld.Options{
+			WireguardNetworkPrefix:     netip.MustParsePrefix("100.64.0.0/29"),
+			WireguardIPAssignmentsFile: assignmentsFile,
+			WireguardIPAssignmentTTL:   24 * time.Hour,
+		}
+	}
+	td, client := createTestTunneld(t, newOptions())
+
+	register := func(client *tunnelsdk.Client, key tunnelsdk.Key) (tunnelsdk.ClientRegisterResponse, error) {
+		return client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+			Version:   tunnelsdk.TunnelVersion2,
+			PublicKey: key.NoisePublicKey(),
+		})
+	}
+
+	// Fill the network.
+	keys := make([]tunnelsdk.Key, 5)
+	responses := make([]tunnelsdk.ClientRegisterResponse, len(keys))
+	for i := range keys {
+		var err error
+		keys[i], err = tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+		responses[i], err = register(client, keys[i])
+		require.NoError(t, err)
+	}
+	newKey, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err)
+	_, err = register(client, newKey)
+	require.ErrorContains(t, err, "no free client IPs")
+
+	// Re-registering doesn't rewrite the file every time.
+	before, err := os.ReadFile(assignmentsFile)
+	require.NoError(t, err)
+	_, err = register(client, keys[0])
+	require.NoError(t, err)
+	after, err := os.ReadFile(assignmentsFile)
+	require.NoError(t, err)
+	require.Equal(t, string(before), string(after))
+	require.NoError(t, td.Close())
+
+	// Pretend one of the tunnels stopped registering two days ago.
+	var file struct {
+		Assignments map[string]netip.Addr `json:"assignments"`
+		LastSeen    map[string]time.Time  `json:"last_seen"`
+	}
+	require.NoError(t, json.Unmarshal(after, &file))
+	require.Len(t, file.Assignments, len(keys))
+	staleURL, err := url.Parse(responses[2].TunnelURLs[0])
+	require.NoError(t, err)
+	staleLabel := strings.Split(staleURL.Host, ".")[0]
+	require.Contains(t, file.LastSeen, staleLabel)
+	file.LastSeen[staleLabel] = time.Now().Add(-48 * time.Hour)
+	data, err := json.Marshal(file)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(assignmentsFile, data, 0o600))
+
+	// The stale IP is given to the next new tunnel, and the other tunnels keep
+	// their IPs.
+	_, client = createTestTunneld(t, newOptions())
+	res, err := register(client, newKey)
+	require.NoError(t, err)
+	require.Equal(t, responses[2].ClientIP, res.ClientIP)
+	for i, key := range keys {
+		if i == 2 {
+			continue
+		}
+		res, err := register(client, key)
+		require.NoError(t, err)
+		require.Equal(t, responses[i].ClientIP, res.ClientIP)
+	}
+
+	// The stale tunnel has to wait for another IP to expire.
+	_, err = register(client, keys[2])
+	require.ErrorContains(t, err, "no free client IPs")
+
+	// Assignments can be kept forever.
+	options := newOptions()
+	options.WireguardIPAssignmentTTL = -1
+	td, client = createTestTunneld(t, options)
+	_, err = register(client, keys[2])
+	require.ErrorContains(t, err, "no free client IPs")
+	require.NoError(t, td.Close())
+}
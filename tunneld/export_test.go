@@ -0,0 +1,14 @@
+package tunneld
+
+import (
+	"crypto/sha256"
+
+	"github.com/tailscale/wireguard-go/device"
+)
+
+// WithPublicKeyHash sets the hash that client IPs and tunnel URLs are derived
+// from and returns options.
+func WithPublicKeyHash(options *Options, hash func(device.NoisePublicKey) [sha256.Size]byte) *Options {
+	options.publicKeyHashFunc = hash
+	return options
+}
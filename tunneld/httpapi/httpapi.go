@@ -4,29 +4,113 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
 
 	"github.com/coder/wgtunnel/tunnelsdk"
 )
 
-// Read decodes JSON from the HTTP request into the value provided.
+// Validator is implemented by request types that can check their own fields.
+// Read calls Validate after decoding, and rejects the request if any problems
+// are returned.
+type Validator interface {
+	Validate() []tunnelsdk.ValidationError
+}
+
+// Read decodes JSON from the HTTP request into the value provided. The body
+// must contain a single JSON value without unknown fields, and if value is a
+// Validator it must be valid. Otherwise a 400 is written and false is
+// returned.
 func Read(ctx context.Context, rw http.ResponseWriter, r *http.Request, value interface{}) bool {
-	// TODO: tracing
-	err := json.NewDecoder(r.Body).Decode(value)
+	span := trace.SpanFromContext(ctx)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(value)
+	if err == nil && dec.More() {
+		err = xerrors.New("request body must contain a single JSON value")
+	}
+	if err == nil {
+		// Catch trailing garbage that isn't the start of a value, like "}".
+		_, err = dec.Token()
+		if errors.Is(err, io.EOF) {
+			err = nil
+		} else if err == nil {
+			err = xerrors.New("request body must contain a single JSON value")
+		}
+	}
 	if err != nil {
+		span.RecordError(err)
+		span.SetAttributes(attribute.String("request.decode_error", err.Error()))
 		Write(ctx, rw, http.StatusBadRequest, tunnelsdk.Response{
-			Message: "Request body must be valid JSON.",
-			Detail:  err.Error(),
+			Message:     "Request body must be valid JSON.",
+			Code:        tunnelsdk.ErrorCodeInvalidRequest,
+			Detail:      err.Error(),
+			Validations: decodeErrorValidations(err),
 		})
 		return false
 	}
 
+	if v, ok := value.(Validator); ok {
+		validations := v.Validate()
+		if len(validations) > 0 {
+			fields := make([]string, len(validations))
+			for i, v := range validations {
+				fields[i] = v.Field
+			}
+			span.SetAttributes(attribute.StringSlice("request.invalid_fields", fields))
+			Write(ctx, rw, http.StatusBadRequest, tunnelsdk.Response{
+				Message:     "Invalid request.",
+				Code:        tunnelsdk.ErrorCodeValidationFailed,
+				Validations: validations,
+			})
+			return false
+		}
+	}
+
 	return true
 }
 
-// Write outputs the given value as JSON to the response.
-func Write(_ context.Context, rw http.ResponseWriter, status int, response interface{}) {
-	// TODO: tracing
+// decodeErrorValidations returns a field-level description of a decode error
+// if it can be attributed to a field.
+func decodeErrorValidations(err error) []tunnelsdk.ValidationError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return []tunnelsdk.ValidationError{{
+			Field:  typeErr.Field,
+			Detail: "must be a " + typeErr.Type.String() + ", got " + typeErr.Value,
+		}}
+	}
+	// DisallowUnknownFields errors aren't typed.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return []tunnelsdk.ValidationError{{
+			Field:  strings.Trim(field, `"`),
+			Detail: "unknown field",
+		}}
+	}
+	return nil
+}
+
+// Write outputs the given value as JSON to the response. Error responses are
+// recorded on the request's span.
+func Write(ctx context.Context, rw http.ResponseWriter, status int, response interface{}) {
+	if status >= http.StatusBadRequest {
+		span := trace.SpanFromContext(ctx)
+		if res, ok := response.(tunnelsdk.Response); ok {
+			span.SetAttributes(attribute.String("response.error_code", string(res.Code)))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, res.Message)
+			}
+		}
+	}
+
 	buf := &bytes.Buffer{}
 	enc := json.NewEncoder(buf)
 	enc.SetEscapeHTML(true)
@@ -0,0 +1,161 @@
+package httpmw
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"cdr.dev/slog"
+)
+
+type AccessLogConfig struct {
+	Log slog.Logger
+
+	// SampleRate is the fraction of requests that are logged, between 0 and 1.
+	// If the SampleRate is zero, all requests are logged.
+	SampleRate float64
+	// Disabled disables access logs. Handlers can still call
+	// AddAccessLogFields.
+	Disabled bool
+	// IncludePath adds the request path to access logs. Tunnel request paths
+	// may contain sensitive information, so they should only be logged for
+	// the API.
+	IncludePath bool
+
+	// RealIPHeader is the header to use to get the real IP address of the
+	// request. If this is empty, the request's RemoteAddr is used.
+	RealIPHeader string
+}
+
+type accessLogKey struct{}
+
+// accessLogEntry collects fields from handlers further down the chain.
+type accessLogEntry struct {
+	mu          sync.Mutex
+	fields      []slog.Field
+	rateLimited bool
+}
+
+// AddAccessLogFields adds fields to the access log entry of the request that
+// ctx belongs to. It's a no-op if the request isn't being logged.
+func AddAccessLogFields(ctx context.Context, fields ...slog.Field) {
+	entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry)
+	if !ok {
+		return
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.fields = append(entry.fields, fields...)
+}
+
+// markRateLimited records that the request was rejected by the rate limiter.
+func markRateLimited(ctx context.Context) {
+	entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry)
+	if !ok {
+		return
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.rateLimited = true
+}
+
+// AccessLog returns a handler that logs a structured entry for each request
+// once it completes. It should be the outermost middleware after tracing so it
+// sees the final status of the request, including rate limited requests.
+func AccessLog(cfg AccessLogConfig) func(http.Handler) http.Handler {
+	if cfg.Disabled {
+		return func(handler http.Handler) http.Handler {
+			return handler
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if cfg.SampleRate > 0 && cfg.SampleRate < 1 && rand.Float64() >= cfg.SampleRate { //nolint:gosec
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			var (
+				start = time.Now()
+				entry = &accessLogEntry{}
+				ctx   = context.WithValue(r.Context(), accessLogKey{}, entry)
+				wrw   = middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+				body  *countingReadCloser
+			)
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingReadCloser{ReadCloser: r.Body}
+				r.Body = body
+			}
+
+			next.ServeHTTP(wrw, r.WithContext(ctx))
+
+			status := wrw.Status()
+			if status == 0 {
+				// Nothing was written, which net/http turns into a 200.
+				status = http.StatusOK
+			}
+			var requestBytes int64
+			if body != nil {
+				requestBytes = body.n.Load()
+			}
+
+			entry.mu.Lock()
+			fields := []any{
+				slog.F("method", r.Method),
+				slog.F("host", r.Host),
+				slog.F("remote_ip", realIP(r, cfg.RealIPHeader)),
+				slog.F("status", status),
+				slog.F("duration_ms", time.Since(start).Milliseconds()),
+				slog.F("request_bytes", requestBytes),
+				slog.F("response_bytes", wrw.BytesWritten()),
+				slog.F("rate_limited", entry.rateLimited),
+			}
+			for _, f := range entry.fields {
+				fields = append(fields, f)
+			}
+			entry.mu.Unlock()
+			if cfg.IncludePath {
+				fields = append(fields, slog.F("path", r.URL.Path))
+			}
+
+			cfg.Log.Info(ctx, "request", fields...)
+		})
+	}
+}
+
+// realIP returns the IP address of the client that made the request.
+func realIP(r *http.Request, realIPHeader string) string {
+	if realIPHeader != "" {
+		val := r.Header.Get(realIPHeader)
+		if val != "" {
+			return strings.TrimSpace(strings.Split(val, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// countingReadCloser counts the bytes read from the request body.
+type countingReadCloser struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,143 @@
+package httpmw_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog"
+	"github.com/coder/wgtunnel/tunneld/httpmw"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Fields", func(t *testing.T) {
+		t.Parallel()
+
+		sink := &recordSink{}
+		handler := httpmw.AccessLog(httpmw.AccessLogConfig{
+			Log:          slog.Make(sink),
+			IncludePath:  true,
+			RealIPHeader: "X-Real-Ip",
+		})(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			httpmw.AddAccessLogFields(r.Context(), slog.F("tunnel_label", "abc"))
+			rw.WriteHeader(http.StatusTeapot)
+			_, _ = rw.Write([]byte("hello"))
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/some/path", strings.NewReader("request body"))
+		req.Header.Set("X-Real-Ip", "1.2.3.4, 5.6.7.8")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		entries := sink.entries()
+		require.Len(t, entries, 1)
+		fields := entries[0]
+		require.Equal(t, http.MethodPost, fields["method"])
+		require.Equal(t, "example.com", fields["host"])
+		require.Equal(t, "/some/path", fields["path"])
+		require.Equal(t, "1.2.3.4", fields["remote_ip"])
+		require.Equal(t, http.StatusTeapot, fields["status"])
+		require.EqualValues(t, 0, fields["request_bytes"])
+		require.Equal(t, 5, fields["response_bytes"])
+		require.Equal(t, false, fields["rate_limited"])
+		require.Equal(t, "abc", fields["tunnel_label"])
+	})
+
+	t.Run("RateLimited", func(t *testing.T) {
+		t.Parallel()
+
+		sink := &recordSink{}
+		handler := httpmw.AccessLog(httpmw.AccessLogConfig{
+			Log: slog.Make(sink),
+		})(httpmw.RateLimit(httpmw.RateLimitConfig{
+			Count:  1,
+			Window: time.Minute,
+		})(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		})))
+
+		for i := 0; i < 2; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		}
+
+		entries := sink.entries()
+		require.Len(t, entries, 2)
+		require.Equal(t, http.StatusOK, entries[0]["status"])
+		require.Equal(t, false, entries[0]["rate_limited"])
+		require.Equal(t, http.StatusTooManyRequests, entries[1]["status"])
+		require.Equal(t, true, entries[1]["rate_limited"])
+		// The path is omitted unless requested.
+		require.NotContains(t, entries[0], "path")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+
+		sink := &recordSink{}
+		handler := httpmw.AccessLog(httpmw.AccessLogConfig{
+			Log:      slog.Make(sink),
+			Disabled: true,
+		})(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// Should not panic.
+			httpmw.AddAccessLogFields(r.Context(), slog.F("tunnel_label", "abc"))
+			rw.WriteHeader(http.StatusOK)
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		require.Empty(t, sink.entries())
+	})
+
+	t.Run("Sampled", func(t *testing.T) {
+		t.Parallel()
+
+		sink := &recordSink{}
+		handler := httpmw.AccessLog(httpmw.AccessLogConfig{
+			Log:        slog.Make(sink),
+			SampleRate: 0.5,
+		})(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}))
+
+		const requests = 1000
+		for i := 0; i < requests; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		}
+
+		// Very loose bounds to avoid flakes.
+		n := len(sink.entries())
+		require.Greater(t, n, requests/4)
+		require.Less(t, n, requests*3/4)
+	})
+}
+
+// recordSink records the fields of each log entry.
+type recordSink struct {
+	mu      sync.Mutex
+	records []map[string]interface{}
+}
+
+func (s *recordSink) LogEntry(_ context.Context, e slog.SinkEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := make(map[string]interface{}, len(e.Fields))
+	for _, f := range e.Fields {
+		fields[f.Name] = f.Value
+	}
+	s.records = append(s.records, fields)
+}
+
+func (*recordSink) Sync() {}
+
+func (s *recordSink) entries() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]interface{}(nil), s.records...)
+}
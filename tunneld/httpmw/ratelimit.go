@@ -57,8 +57,10 @@ func RateLimit(cfg RateLimitConfig) func(http.Handler) http.Handler {
 			return httprate.KeyByIP(r)
 		}),
 		httprate.WithLimitHandler(func(rw http.ResponseWriter, r *http.Request) {
+			markRateLimited(r.Context())
 			httpapi.Write(r.Context(), rw, http.StatusTooManyRequests, tunnelsdk.Response{
 				Message: fmt.Sprintf("You've been rate limited for sending more than %v requests in %v.", cfg.Count, cfg.Window),
+				Code:    tunnelsdk.ErrorCodeRateLimited,
 			})
 		}),
 	)
@@ -0,0 +1,277 @@
+package tunneld
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+// ipv4Allocator assigns client IPs in IPv4 networks. There's too little space
+// to derive IPs from key hashes without collisions, so each tunnel label is
+// assigned the first free IP at or after the one its hash points to.
+// Assignments are kept while their tunnel keeps registering so tunnel URLs keep
+// pointing at the same IP. Once a tunnel hasn't registered for the assignment
+// TTL, its IP can be given to another tunnel. Assignments are persisted to path
+// if it's set so they survive restarts.
+type ipv4Allocator struct {
+	prefix   netip.Prefix
+	serverIP netip.Addr
+	path     string
+
+	mu       sync.RWMutex
+	byLabel  map[string]netip.Addr
+	byIP     map[netip.Addr]string
+	lastSeen map[string]time.Time
+}
+
+// ipv4AssignmentsFile is the format of the file assignments are persisted to.
+type ipv4AssignmentsFile struct {
+	// Assignments maps tunnel labels to client IPs.
+	Assignments map[string]netip.Addr `json:"assignments"`
+	// LastSeen maps tunnel labels to when they last registered, give or take
+	// ipv4LastSeenInterval. Assignments without one are treated as seen when
+	// the file is loaded.
+	LastSeen map[string]time.Time `json:"last_seen,omitempty"`
+}
+
+// newIPv4Allocator creates an allocator for the IPv4 network prefix and loads
+// existing assignments from path. Assignments that don't fit the current
+// network are dropped.
+func newIPv4Allocator(prefix netip.Prefix, serverIP netip.Addr, path string) (*ipv4Allocator, error) {
+	a := &ipv4Allocator{
+		prefix:   prefix.Masked(),
+		serverIP: serverIP,
+		path:     path,
+		byLabel:  make(map[string]netip.Addr),
+		byIP:     make(map[netip.Addr]string),
+		lastSeen: make(map[string]time.Time),
+	}
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("read IP assignments file %q: %w", path, err)
+	}
+	var file ipv4AssignmentsFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, xerrors.Errorf("parse IP assignments file %q: %w", path, err)
+	}
+	now := time.Now()
+	for label, ip := range file.Assignments {
+		if !a.usable(ip) {
+			continue
+		}
+		if _, ok := a.byIP[ip]; ok {
+			continue
+		}
+		a.byLabel[label] = ip
+		a.byIP[ip] = label
+		a.lastSeen[label] = now
+		if seen, ok := file.LastSeen[label]; ok {
+			a.lastSeen[label] = seen
+		}
+	}
+	return a, nil
+}
+
+// usable returns true if ip can be assigned to a client.
+func (a *ipv4Allocator) usable(ip netip.Addr) bool {
+	return ip.Is4() && a.prefix.Contains(ip) &&
+		ip != a.prefix.Addr() && ip != a.broadcast() && ip != a.serverIP
+}
+
+// broadcast returns the last address in the network.
+func (a *ipv4Allocator) broadcast() netip.Addr {
+	b := a.prefix.Addr().As4()
+	n := binary.BigEndian.Uint32(b[:]) | uint32(a.size()-1)
+	binary.BigEndian.PutUint32(b[:], n)
+	return netip.AddrFrom4(b)
+}
+
+// size returns the number of addresses in the network.
+func (a *ipv4Allocator) size() uint64 {
+	return 1 << (32 - a.prefix.Bits())
+}
+
+// lookup returns the IP assigned to the tunnel label.
+func (a *ipv4Allocator) lookup(label string) (netip.Addr, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	ip, ok := a.byLabel[strings.ToLower(label)]
+	return ip, ok
+}
+
+// ipv4LastSeenInterval returns how often the time a tunnel was last seen is
+// updated. Every update rewrites the assignments file, so it's only updated
+// once per eighth of the TTL rather than on every registration. A negative TTL
+// disables expiry, in which case the default TTL is used so the times are still
+// useful if expiry is enabled later.
+func ipv4LastSeenInterval(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = DefaultWireguardIPAssignmentTTL
+	}
+	return ttl / 8
+}
+
+// expired returns true if the tunnel label hasn't registered within the TTL. It
+// must be called with mu held.
+func (a *ipv4Allocator) expired(label string, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(a.lastSeen[label]) > ttl
+}
+
+// assign returns the IP assigned to the tunnel label, assigning and persisting
+// a new one if there isn't one yet. Assignments that expired after ttl are
+// reclaimed while probing for a free IP.
+func (a *ipv4Allocator) assign(label string, keyHash [sha256.Size]byte, ttl time.Duration, now time.Time) (netip.Addr, error) {
+	label = strings.ToLower(label)
+	a.mu.RLock()
+	ip, ok := a.byLabel[label]
+	fresh := ok && now.Sub(a.lastSeen[label]) < ipv4LastSeenInterval(ttl)
+	a.mu.RUnlock()
+	if fresh {
+		return ip, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ip, ok := a.byLabel[label]; ok {
+		if now.Sub(a.lastSeen[label]) < ipv4LastSeenInterval(ttl) {
+			return ip, nil
+		}
+		prev := a.lastSeen[label]
+		a.lastSeen[label] = now
+		err := a.save()
+		if err != nil {
+			a.lastSeen[label] = prev
+			return netip.Addr{}, err
+		}
+		return ip, nil
+	}
+
+	base := a.prefix.Addr().As4()
+	start := binary.BigEndian.Uint64(keyHash[:8]) % a.size()
+	for i := uint64(0); i < a.size(); i++ {
+		b := base
+		n := binary.BigEndian.Uint32(b[:]) + uint32((start+i)%a.size())
+		binary.BigEndian.PutUint32(b[:], n)
+		ip := netip.AddrFrom4(b)
+		if !a.usable(ip) {
+			continue
+		}
+		staleLabel, used := a.byIP[ip]
+		if used && !a.expired(staleLabel, ttl, now) {
+			continue
+		}
+		staleSeen := a.lastSeen[staleLabel]
+		if used {
+			delete(a.byLabel, staleLabel)
+			delete(a.lastSeen, staleLabel)
+		}
+
+		a.byLabel[label] = ip
+		a.byIP[ip] = label
+		a.lastSeen[label] = now
+		err := a.save()
+		if err != nil {
+			delete(a.byLabel, label)
+			delete(a.byIP, ip)
+			delete(a.lastSeen, label)
+			if used {
+				a.byLabel[staleLabel] = ip
+				a.byIP[ip] = staleLabel
+				a.lastSeen[staleLabel] = staleSeen
+			}
+			return netip.Addr{}, err
+		}
+		return ip, nil
+	}
+	return netip.Addr{}, xerrors.Errorf("no free client IPs left in network %s", a.prefix)
+}
+
+// save writes the assignments to path. It must be called with mu held.
+func (a *ipv4Allocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ipv4AssignmentsFile{
+		Assignments: a.byLabel,
+		LastSeen:    a.lastSeen,
+	}, "", "\t")
+	if err != nil {
+		return xerrors.Errorf("marshal IP assignments: %w", err)
+	}
+	// Write to a temporary file first so a crash can't leave a truncated file
+	// behind.
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*.tmp")
+	if err != nil {
+		return xerrors.Errorf("create temporary IP assignments file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	_, err = tmp.Write(data)
+	if err != nil {
+		return xerrors.Errorf("write temporary IP assignments file: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return xerrors.Errorf("close temporary IP assignments file: %w", err)
+	}
+	err = os.Rename(tmp.Name(), a.path)
+	if err != nil {
+		return xerrors.Errorf("write IP assignments file %q: %w", a.path, err)
+	}
+	return nil
+}
+
+// clientIPAndURLs returns the client IP and tunnel URLs for the public key. In
+// IPv4 networks the IP is assigned by the allocator.
+func (api *API) clientIPAndURLs(options *Options, publicKey device.NoisePublicKey, version tunnelsdk.TunnelVersion) (netip.Addr, []*url.URL, error) {
+	ip, urls := options.WireguardPublicKeyToIPAndURLs(publicKey, version)
+	if api.ipv4 == nil {
+		return ip, urls, nil
+	}
+
+	// Only the "good format" URL is issued in IPv4 networks.
+	label, _ := splitHostname(urls[0].Host)
+	ip, err := api.ipv4.assign(label, options.publicKeyHash(publicKey), options.WireguardIPAssignmentTTL, time.Now())
+	if err != nil {
+		return netip.Addr{}, nil, xerrors.Errorf("assign client IP: %w", err)
+	}
+	return ip, urls, nil
+}
+
+// hostnameToIP returns the client IP for a tunnel hostname label. In IPv4
+// networks the IP must have been assigned by the allocator.
+func (api *API) hostnameToIP(options *Options, hostname string) (netip.Addr, error) {
+	if api.ipv4 == nil {
+		return options.HostnameToWireguardIP(hostname)
+	}
+
+	ip, ok := api.ipv4.lookup(hostname)
+	if !ok {
+		return netip.Addr{}, xerrors.Errorf("no client IP is assigned to hostname %q", hostname)
+	}
+	return ip, nil
+}
@@ -0,0 +1,91 @@
+package tunneld
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+
+	"cdr.dev/slog"
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+// applyDueKeyRotation switches to the next key if its rotation time has
+// passed.
+func (options *Options) applyDueKeyRotation(now time.Time) {
+	if options.WireguardNextKey.IsZero() || now.Before(options.WireguardKeyRotationTime) {
+		return
+	}
+	options.WireguardKey = options.WireguardNextKey
+	options.WireguardNextKey = tunnelsdk.Key{}
+	options.WireguardKeyRotationTime = time.Time{}
+}
+
+// scheduleKeyRotation replaces the pending key rotation, if any, with one for
+// the current options. The caller must hold reloadMu.
+func (api *API) scheduleKeyRotation() {
+	if api.keyRotationTimer != nil {
+		api.keyRotationTimer.Stop()
+		api.keyRotationTimer = nil
+	}
+
+	options := api.CurrentOptions()
+	if options.WireguardNextKey.IsZero() {
+		return
+	}
+	at := options.WireguardKeyRotationTime
+	api.keyRotationTimer = time.AfterFunc(time.Until(at), func() {
+		api.rotateKey(at)
+	})
+	api.Log.Info(context.Background(), "scheduled wireguard key rotation",
+		slog.F("next_public_key", publicKeyString(options.WireguardNextKey)),
+		slog.F("rotation_time", at),
+	)
+}
+
+// rotateKey switches the wireguard device to the next key if the rotation
+// scheduled for at is still pending.
+func (api *API) rotateKey(at time.Time) {
+	api.reloadMu.Lock()
+	defer api.reloadMu.Unlock()
+
+	current := api.CurrentOptions()
+	if current.WireguardNextKey.IsZero() || !current.WireguardKeyRotationTime.Equal(at) {
+		// The rotation was changed by a reload.
+		return
+	}
+
+	err := api.wgDevice.IpcSet(fmt.Sprintf("private_key=%s", current.WireguardNextKey.HexString()))
+	if err != nil {
+		api.Log.Error(context.Background(), "rotate wireguard key", slog.Error(err))
+		return
+	}
+
+	next := *current
+	next.WireguardKey = current.WireguardNextKey
+	next.WireguardNextKey = tunnelsdk.Key{}
+	next.WireguardKeyRotationTime = time.Time{}
+	api.liveOptions.Store(&next)
+	api.keyRotationTimer = nil
+
+	api.Log.Info(context.Background(), "rotated wireguard key",
+		slog.F("public_key", publicKeyString(next.WireguardKey)),
+	)
+}
+
+// verifyProof checks a proof of private key possession made by a client. Both
+// the current and the next server key are accepted, since clients may have
+// computed the proof with either around the time of a rotation.
+func verifyProof(options *Options, publicKey device.NoisePublicKey, message, proof []byte) bool {
+	if tunnelsdk.VerifyProofMAC(options.WireguardKey, publicKey, message, proof) {
+		return true
+	}
+	return !options.WireguardNextKey.IsZero() &&
+		tunnelsdk.VerifyProofMAC(options.WireguardNextKey, publicKey, message, proof)
+}
+
+// publicKeyString returns the base64 encoded public key of a private key.
+func publicKeyString(key tunnelsdk.Key) string {
+	return tunnelsdk.FromNoisePublicKey(key.NoisePublicKey()).String()
+}
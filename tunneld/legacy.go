@@ -0,0 +1,78 @@
+package tunneld
+
+import (
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// oldFormatHostnameLength is the length of the 32 character hex "old format"
+// hostname label. See tunnelsdk.PublicKeyToIPAndURLs.
+const oldFormatHostnameLength = 32
+
+// isOldFormatHostname returns true if the hostname label is in the "old
+// format".
+func isOldFormatHostname(label string) bool {
+	return len(label) == oldFormatHostnameLength
+}
+
+// isOldFormatURL returns true if the URL's tunnel label is in the "old format".
+func isOldFormatURL(u *url.URL) bool {
+	label, _ := splitHostname(u.Host)
+	return isOldFormatHostname(label)
+}
+
+// LegacyUsage counts requests that depend on legacy behavior, so operators can
+// tell when it's safe to disable it. Counts start at zero when the server
+// starts.
+type LegacyUsage struct {
+	// LegacyEndpointRequests is the number of requests to the legacy /tun
+	// endpoint, including ones rejected because it's disabled.
+	LegacyEndpointRequests int64 `json:"legacy_endpoint_requests"`
+	// LastLegacyEndpointRequest is when the last request to /tun was made,
+	// or zero if there hasn't been one.
+	LastLegacyEndpointRequest time.Time `json:"last_legacy_endpoint_request"`
+	// OldFormatHostnameRequests is the number of requests proxied to tunnels
+	// with "old format" hostnames, including ones rejected because they're no
+	// longer accepted.
+	OldFormatHostnameRequests int64 `json:"old_format_hostname_requests"`
+	// LastOldFormatHostnameRequest is when the last request with an "old
+	// format" hostname was made, or zero if there hasn't been one.
+	LastOldFormatHostnameRequest time.Time `json:"last_old_format_hostname_request"`
+}
+
+// legacyCounters is the internal, concurrency-safe version of LegacyUsage.
+type legacyCounters struct {
+	endpointRequests    atomic.Int64
+	lastEndpointRequest atomic.Int64 // unix nanoseconds
+	hostnameRequests    atomic.Int64
+	lastHostnameRequest atomic.Int64 // unix nanoseconds
+}
+
+func (c *legacyCounters) addEndpointRequest(now time.Time) {
+	c.endpointRequests.Add(1)
+	c.lastEndpointRequest.Store(now.UnixNano())
+}
+
+func (c *legacyCounters) addHostnameRequest(now time.Time) {
+	c.hostnameRequests.Add(1)
+	c.lastHostnameRequest.Store(now.UnixNano())
+}
+
+// LegacyUsage returns how often legacy behavior has been used since the server
+// started.
+func (api *API) LegacyUsage() LegacyUsage {
+	return LegacyUsage{
+		LegacyEndpointRequests:       api.legacy.endpointRequests.Load(),
+		LastLegacyEndpointRequest:    unixNanoTime(api.legacy.lastEndpointRequest.Load()),
+		OldFormatHostnameRequests:    api.legacy.hostnameRequests.Load(),
+		LastOldFormatHostnameRequest: unixNanoTime(api.legacy.lastHostnameRequest.Load()),
+	}
+}
+
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
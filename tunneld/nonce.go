@@ -0,0 +1,60 @@
+package tunneld
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// nonceLifetime is how long a registration nonce can be used after it was
+// issued.
+const nonceLifetime = time.Minute
+
+const (
+	nonceRandomLen = 16
+	nonceExpiryLen = 8
+	nonceLen       = nonceRandomLen + nonceExpiryLen + sha256.Size
+)
+
+// newNonce creates a nonce that expires after nonceLifetime. Nonces are
+// stateless: they consist of random bytes, the expiry time and a MAC over both
+// using the server's nonce secret.
+func (api *API) newNonce() ([]byte, time.Time, error) {
+	expiresAt := time.Now().Add(nonceLifetime)
+
+	nonce := make([]byte, nonceRandomLen+nonceExpiryLen, nonceLen)
+	_, err := rand.Read(nonce[:nonceRandomLen])
+	if err != nil {
+		return nil, time.Time{}, xerrors.Errorf("read random bytes: %w", err)
+	}
+	binary.BigEndian.PutUint64(nonce[nonceRandomLen:], uint64(expiresAt.Unix()))
+
+	mac := hmac.New(sha256.New, api.nonceSecret)
+	_, _ = mac.Write(nonce)
+	return mac.Sum(nonce), expiresAt, nil
+}
+
+// verifyNonce checks that the nonce was issued by this server and hasn't
+// expired. It returns the time the nonce was issued.
+func (api *API) verifyNonce(nonce []byte) (time.Time, error) {
+	if len(nonce) != nonceLen {
+		return time.Time{}, xerrors.New("invalid nonce length")
+	}
+
+	data := nonce[:nonceRandomLen+nonceExpiryLen]
+	mac := hmac.New(sha256.New, api.nonceSecret)
+	_, _ = mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), nonce[len(data):]) {
+		return time.Time{}, xerrors.New("nonce was not issued by this server")
+	}
+
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(data[nonceRandomLen:])), 0)
+	if time.Now().After(expiresAt) {
+		return time.Time{}, xerrors.New("nonce has expired")
+	}
+	return expiresAt.Add(-nonceLifetime), nil
+}
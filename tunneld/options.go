@@ -2,16 +2,15 @@ package tunneld
 
 import (
 	"crypto/sha256"
-	"encoding/base32"
 	"encoding/hex"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/mod/semver"
 	"golang.org/x/xerrors"
 
 	"cdr.dev/slog"
@@ -19,10 +18,15 @@ import (
 )
 
 const (
-	DefaultWireguardMTU     = 1280
-	DefaultPeerDialTimeout  = 10 * time.Second
-	DefaultPeerPollDuration = 30 * time.Second
-	DefaultPeerTimeout      = 2 * time.Minute
+	DefaultWireguardMTU       = 1280
+	DefaultPeerDialTimeout    = 10 * time.Second
+	DefaultPeerPollDuration   = 30 * time.Second
+	DefaultPeerTimeout        = 2 * time.Minute
+	DefaultAPIRateLimit       = 10
+	DefaultAPIRateLimitWindow = 10 * time.Second
+	DefaultClientDownloadURL  = "https://github.com/coder/wgtunnel/releases"
+
+	DefaultWireguardIPAssignmentTTL = 30 * 24 * time.Hour
 )
 
 var (
@@ -30,8 +34,6 @@ var (
 	DefaultWireguardNetworkPrefix = netip.MustParsePrefix("fcca::/16")
 )
 
-var newHostnameEncoder = base32.HexEncoding.WithPadding(base32.NoPadding)
-
 type Options struct {
 	Log slog.Logger
 
@@ -50,18 +52,49 @@ type Options struct {
 	WireguardPort uint16
 	// WireguardKey is the private key for the wireguard server.
 	WireguardKey tunnelsdk.Key
+	// WireguardNextKey is the private key the server switches to at
+	// WireguardKeyRotationTime. Its public key is advertised to clients when
+	// they register so they can update their peer configuration once the
+	// server cuts over. Optional.
+	WireguardNextKey tunnelsdk.Key
+	// WireguardKeyRotationTime is when the server switches to
+	// WireguardNextKey. Required if WireguardNextKey is set.
+	WireguardKeyRotationTime time.Time
 
 	// WireguardMTU is the MTU to use for the wireguard interface. Defaults to
 	// 1280.
 	WireguardMTU int
 	// WireguardServerIP is the virtual IP address of this server in the
-	// wireguard network. Must be an IPv6 address contained within
-	// WireguardNetworkPrefix. Defaults to fcca::1.
+	// wireguard network. Must be an address of the same family contained
+	// within WireguardNetworkPrefix. Defaults to fcca::1, or the first address
+	// in WireguardNetworkPrefix if it's an IPv4 CIDR.
 	WireguardServerIP netip.Addr
 	// WireguardNetworkPrefix is the CIDR of the wireguard network. All client
-	// IPs will be generated within this network. Must be a IPv6 CIDR and have
-	// at least 64 bits of space available. Defaults to fcca::/16.
+	// IPs will be generated within this network. IPv6 CIDRs must have at least
+	// 64 bits of space available. Defaults to fcca::/16.
+	//
+	// IPv4 CIDRs such as 100.64.0.0/10 are supported for clients that can't
+	// use IPv6 inside the tunnel. They're too small to derive client IPs from
+	// public keys, so each client is assigned the next free IP after the one
+	// its key hashes to, and only "good format" URLs are issued.
 	WireguardNetworkPrefix netip.Prefix
+	// WireguardIPAssignmentsFile is where client IPs assigned in IPv4 networks
+	// are stored, so clients keep their IPs across restarts. Assignments are
+	// only kept in memory if it's empty.
+	WireguardIPAssignmentsFile string
+	// WireguardIPAssignmentTTL is how long a client IP assigned in an IPv4
+	// network is kept for a tunnel that stops registering. Once it expires, the
+	// IP can be assigned to a new tunnel so keys that register once, such as
+	// ones generated for every run, can't use up the network. Must be at least
+	// twice PeerTimeout. Negative values keep assignments forever. Defaults to
+	// 30 days.
+	WireguardIPAssignmentTTL time.Duration
+	// WireguardPreviousNetworkPrefixes are network prefixes that
+	// WireguardNetworkPrefix was changed from. "Old format" hostnames embed the
+	// network prefix, so hostnames issued under these prefixes are still
+	// accepted and routed to the client's IP in the current prefix. Clients
+	// are moved to the current prefix when they re-register. Optional.
+	WireguardPreviousNetworkPrefixes []netip.Prefix
 
 	// RealIPHeader is the header to use for getting a request's IP address. If
 	// not set, the request's RemoteAddr will be used.
@@ -78,6 +111,46 @@ type Options struct {
 
 	// PeerTimeout is how long the server will wait before removing the peer.
 	PeerTimeout time.Duration
+
+	// APIRateLimit is the number of API requests allowed per client IP in each
+	// APIRateLimitWindow. Server info and registration challenge requests
+	// aren't counted. Defaults to 10. Set to a negative value to disable rate
+	// limiting.
+	APIRateLimit int
+	// APIRateLimitWindow defaults to 10 seconds.
+	APIRateLimitWindow time.Duration
+
+	// DisableProxyAccessLogs disables access logs for requests proxied to
+	// tunnels. API requests are always logged.
+	DisableProxyAccessLogs bool
+	// ProxyAccessLogSampleRate is the fraction of proxied requests that are
+	// logged, between 0 and 1. Defaults to 1.
+	ProxyAccessLogSampleRate float64
+
+	// DisableLegacyEndpoint makes the legacy /tun endpoint used by old
+	// versions of coder/coder respond with a 404.
+	DisableLegacyEndpoint bool
+	// DisableOldFormatURLs stops including the 32 character "old format" URL
+	// in registration responses. See tunnelsdk.PublicKeyToIPAndURLs. Old format
+	// hostnames are still accepted unless RejectOldFormatURLs is set.
+	DisableOldFormatURLs bool
+	// RejectOldFormatURLs rejects requests to tunnels that use "old format"
+	// hostnames. Requires DisableOldFormatURLs.
+	RejectOldFormatURLs bool
+
+	// MinimumClientVersion is the oldest client version allowed to register,
+	// as a semantic version such as "v0.2.0". Clients that don't report a
+	// version, like the ones using the legacy /tun endpoint, and development
+	// builds are treated as older than any minimum. Optional.
+	MinimumClientVersion string
+	// ClientDownloadURL is where outdated clients are told to download a newer
+	// version. Defaults to the wgtunnel releases page.
+	ClientDownloadURL string
+
+	// publicKeyHashFunc derives the hash that client IPs and tunnel URLs are
+	// generated from. Defaults to tunnelsdk.PublicKeyHash. Clients assume the
+	// default, so it can only be set by tests, e.g. to force collisions.
+	publicKeyHashFunc func(publicKey device.NoisePublicKey) [sha256.Size]byte
 }
 
 // Validate checks that the options are valid and populates default values for
@@ -105,28 +178,64 @@ func (options *Options) Validate() error {
 	if !options.WireguardKey.IsPrivate() {
 		return xerrors.New("WireguardKey must be a private key")
 	}
+	if !options.WireguardNextKey.IsZero() {
+		if !options.WireguardNextKey.IsPrivate() {
+			return xerrors.New("WireguardNextKey must be a private key")
+		}
+		if options.WireguardNextKey.NoisePublicKey() == options.WireguardKey.NoisePublicKey() {
+			return xerrors.New("WireguardNextKey must be different from WireguardKey")
+		}
+		if options.WireguardKeyRotationTime.IsZero() {
+			return xerrors.New("WireguardKeyRotationTime is required when WireguardNextKey is set")
+		}
+	} else if !options.WireguardKeyRotationTime.IsZero() {
+		return xerrors.New("WireguardKeyRotationTime requires WireguardNextKey")
+	}
 	// Key is parsed and validated when the server is started.
 	if options.WireguardMTU <= 0 {
 		options.WireguardMTU = DefaultWireguardMTU
 	}
-	if options.WireguardServerIP.BitLen() == 0 {
-		options.WireguardServerIP = DefaultWireguardServerIP
-	}
-	if options.WireguardServerIP.BitLen() != 128 {
-		return xerrors.New("WireguardServerIP must be an IPv6 address")
-	}
 	if options.WireguardNetworkPrefix.Bits() <= 0 {
 		options.WireguardNetworkPrefix = DefaultWireguardNetworkPrefix
 	}
-	if options.WireguardNetworkPrefix.Bits() > 64 {
-		return xerrors.New("WireguardNetworkPrefix must have at least 64 bits available")
-	}
-	if options.WireguardNetworkPrefix.Bits()%8 != 0 {
-		return xerrors.New("WireguardNetworkPrefix must be a multiple of 8 bits")
+	if options.WireguardNetworkPrefix.Addr().Is4() {
+		if options.WireguardServerIP.BitLen() == 0 {
+			options.WireguardServerIP = options.WireguardNetworkPrefix.Masked().Addr().Next()
+		}
+		if !options.WireguardServerIP.Is4() {
+			return xerrors.New("WireguardServerIP must be an IPv4 address when WireguardNetworkPrefix is IPv4")
+		}
+		if options.WireguardNetworkPrefix.Bits() > 30 {
+			return xerrors.New("WireguardNetworkPrefix must have at least 2 bits available")
+		}
+		if len(options.WireguardPreviousNetworkPrefixes) > 0 {
+			return xerrors.New("WireguardPreviousNetworkPrefixes is not supported when WireguardNetworkPrefix is IPv4")
+		}
+	} else {
+		if options.WireguardServerIP.BitLen() == 0 {
+			options.WireguardServerIP = DefaultWireguardServerIP
+		}
+		if options.WireguardServerIP.BitLen() != 128 {
+			return xerrors.New("WireguardServerIP must be an IPv6 address when WireguardNetworkPrefix is IPv6")
+		}
+		if options.WireguardNetworkPrefix.Bits() > 64 {
+			return xerrors.New("WireguardNetworkPrefix must have at least 64 bits available")
+		}
+		if options.WireguardNetworkPrefix.Bits()%8 != 0 {
+			return xerrors.New("WireguardNetworkPrefix must be a multiple of 8 bits")
+		}
 	}
 	if !options.WireguardNetworkPrefix.Contains(options.WireguardServerIP) {
 		return xerrors.New("WireguardServerIP must be contained within WireguardNetworkPrefix")
 	}
+	for _, prefix := range options.WireguardPreviousNetworkPrefixes {
+		if !prefix.Addr().Is6() || prefix.Bits() <= 0 || prefix.Bits() > 64 || prefix.Bits()%8 != 0 {
+			return xerrors.Errorf("WireguardPreviousNetworkPrefixes entry %s must be an IPv6 CIDR with a multiple of 8 bits and at least 64 bits available", prefix)
+		}
+		if prefix.Masked() == options.WireguardNetworkPrefix.Masked() {
+			return xerrors.Errorf("WireguardPreviousNetworkPrefixes entry %s must be different from WireguardNetworkPrefix", prefix)
+		}
+	}
 
 	if options.RealIPHeader != "" {
 		options.RealIPHeader = http.CanonicalHeaderKey(options.RealIPHeader)
@@ -148,101 +257,131 @@ func (options *Options) Validate() error {
 		)
 	}
 
+	if options.WireguardIPAssignmentTTL == 0 {
+		options.WireguardIPAssignmentTTL = DefaultWireguardIPAssignmentTTL
+	}
+	if options.WireguardIPAssignmentTTL > 0 && options.WireguardIPAssignmentTTL < 2*options.PeerTimeout {
+		return xerrors.Errorf("WireguardIPAssignmentTTL(%s) must be at least twice PeerTimeout(%s)",
+			options.WireguardIPAssignmentTTL.String(),
+			options.PeerTimeout.String(),
+		)
+	}
+
+	if options.APIRateLimit == 0 {
+		options.APIRateLimit = DefaultAPIRateLimit
+	}
+	if options.APIRateLimitWindow <= 0 {
+		options.APIRateLimitWindow = DefaultAPIRateLimitWindow
+	}
+
+	if options.ProxyAccessLogSampleRate == 0 {
+		options.ProxyAccessLogSampleRate = 1
+	}
+	if options.ProxyAccessLogSampleRate < 0 || options.ProxyAccessLogSampleRate > 1 {
+		return xerrors.Errorf("ProxyAccessLogSampleRate(%v) must be between 0 and 1", options.ProxyAccessLogSampleRate)
+	}
+
+	if options.RejectOldFormatURLs && !options.DisableOldFormatURLs {
+		return xerrors.New("RejectOldFormatURLs requires DisableOldFormatURLs")
+	}
+
+	if options.MinimumClientVersion != "" && !semver.IsValid(options.MinimumClientVersion) {
+		return xerrors.Errorf("MinimumClientVersion %q is not a valid semantic version, e.g. v0.2.0", options.MinimumClientVersion)
+	}
+	if options.ClientDownloadURL == "" {
+		options.ClientDownloadURL = DefaultClientDownloadURL
+	}
+
 	return nil
 }
 
 // WireguardPublicKeyToIPAndURLs returns the IP address that corresponds to the
 // given wireguard public key, as well as all accepted tunnel URLs for the key.
-//
-// We support an older 32 character format ("old format") and a newer 12
-// character format ("good format") which is preferred. The first URL returned
-// should be considered "preferred", and all other URLs are provided for
-// compatibility with older deployments only. The "good format" is preferred as
-// it's shorter to avoid issues with hostname length limits when apps prefixes
-// are added to the equation.
-//
-// "good format":
-//
-//	Take the first 8 bytes of the hash of the public key, and convert to
-//	base32.
-//
-// "old format":
-//
-//	Take the network prefix, and create a new address filling the last n bytes
-//	with the first n bytes of the hash of the public key. Then convert to hex.
+// See tunnelsdk.PublicKeyToIPAndURLs for the formats. The "old format" URLs
+// for WireguardPreviousNetworkPrefixes are appended, and all "old format" URLs
+// are left out if DisableOldFormatURLs is set.
 func (options *Options) WireguardPublicKeyToIPAndURLs(publicKey device.NoisePublicKey, version tunnelsdk.TunnelVersion) (netip.Addr, []*url.URL) {
-	var (
-		keyHash   = sha256.Sum256(publicKey[:])
-		addrBytes = options.WireguardNetworkPrefix.Addr().As16()
-	)
-
-	// IPv6 address:
-	// For the IP address, we take the first 64 bits of the network prefix and
-	// the first 64 bits of the hash of the public key.
-	copy(addrBytes[8:], keyHash[:8])
-
-	// Good format:
-	goodFormatBytes := make([]byte, 8)
-	copy(goodFormatBytes, keyHash[:8])
-	goodFormat := newHostnameEncoder.EncodeToString(goodFormatBytes)
-	goodFormatURL := *options.BaseURL
-	goodFormatURL.Host = strings.ToLower(goodFormat) + "." + goodFormatURL.Host
-
-	// Old format:
-	oldFormatBytes := make([]byte, 16)
-	copy(oldFormatBytes, addrBytes[:])
-	prefixLenBytes := options.WireguardNetworkPrefix.Bits() / 8
-	copy(oldFormatBytes[prefixLenBytes:], keyHash[:16-prefixLenBytes])
-	oldFormat := hex.EncodeToString(oldFormatBytes)
-	oldFormatURL := *options.BaseURL
-	oldFormatURL.Host = strings.ToLower(oldFormat) + "." + oldFormatURL.Host
-
-	urls := []*url.URL{&goodFormatURL, &oldFormatURL}
-	if version == tunnelsdk.TunnelVersion1 {
-		// Return the old format first for backwards compatibility.
-		urls = []*url.URL{&oldFormatURL, &goodFormatURL}
-	}
-
-	return netip.AddrFrom16(addrBytes), urls
-}
-
-// HostnameToWireguardIP returns the wireguard IP address that corresponds to a
-// given encoded hostname label as returned by WireguardPublicKeyToIPAndURLs.
-func (options *Options) HostnameToWireguardIP(hostname string) (netip.Addr, error) {
-	var addrLast8Bytes []byte
+	hash := options.publicKeyHash(publicKey)
 
-	if len(hostname) == 32 {
-		// "Old format":
-		decoded, err := hex.DecodeString(hostname)
-		if err != nil {
-			return netip.Addr{}, xerrors.Errorf("decode old hostname %q as hex: %w", hostname, err)
-		}
-		if len(decoded) != 16 {
-			return netip.Addr{}, xerrors.Errorf("invalid old hostname length: got %d, expected 16", len(decoded))
+	ip, urls := tunnelsdk.KeyHashToIPAndURLs(hash, options.WireguardNetworkPrefix, options.BaseURL, version)
+	for _, prefix := range options.WireguardPreviousNetworkPrefixes {
+		_, prevURLs := tunnelsdk.KeyHashToIPAndURLs(hash, prefix, options.BaseURL, tunnelsdk.TunnelVersion1)
+		oldFormatURL := prevURLs[0]
+		duplicate := false
+		for _, u := range urls {
+			if u.String() == oldFormatURL.String() {
+				duplicate = true
+				break
+			}
 		}
-
-		// Even though the hostname will have the entire old IP address, we only
-		// care about the first 8 bytes after the prefix length.
-		prefixLenBytes := options.WireguardNetworkPrefix.Bits() / 8
-		addrLast8Bytes = decoded[prefixLenBytes : prefixLenBytes+8]
-	} else {
-		// "Good format":
-		decoded, err := newHostnameEncoder.DecodeString(strings.ToUpper(hostname))
-		if err != nil {
-			return netip.Addr{}, xerrors.Errorf("decode new hostname %q as base32: %w", hostname, err)
+		if !duplicate {
+			urls = append(urls, oldFormatURL)
 		}
-		if len(decoded) != 8 {
-			return netip.Addr{}, xerrors.Errorf("invalid new hostname length: got %d, expected 8", len(decoded))
+	}
+	if options.DisableOldFormatURLs {
+		filtered := make([]*url.URL, 0, len(urls))
+		for _, u := range urls {
+			if !isOldFormatURL(u) {
+				filtered = append(filtered, u)
+			}
 		}
+		urls = filtered
+	}
+	return ip, urls
+}
 
-		addrLast8Bytes = decoded
+// publicKeyHash returns the hash that client IPs and tunnel URLs are derived
+// from.
+func (options *Options) publicKeyHash(publicKey device.NoisePublicKey) [sha256.Size]byte {
+	if options.publicKeyHashFunc != nil {
+		return options.publicKeyHashFunc(publicKey)
 	}
+	return tunnelsdk.PublicKeyHash(publicKey)
+}
 
-	if addrLast8Bytes == nil {
-		return netip.Addr{}, xerrors.Errorf("invalid hostname %q, does not match new or old format", hostname)
+// HostnameToWireguardIP returns the wireguard IP address that corresponds to a
+// given encoded hostname label as returned by WireguardPublicKeyToIPAndURLs.
+// "Old format" labels are rejected if RejectOldFormatURLs is set, and labels
+// issued under one of WireguardPreviousNetworkPrefixes are mapped to the IP in
+// the current prefix.
+func (options *Options) HostnameToWireguardIP(hostname string) (netip.Addr, error) {
+	if !isOldFormatHostname(hostname) {
+		return tunnelsdk.HostnameToIP(hostname, options.WireguardNetworkPrefix)
+	}
+	if options.RejectOldFormatURLs {
+		return netip.Addr{}, xerrors.Errorf("old format hostname %q is no longer accepted", hostname)
 	}
 
+	ip, err := tunnelsdk.HostnameToIP(hostname, options.oldFormatHostnamePrefix(hostname))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	// Client IPs are the first 64 bits of the network prefix followed by 64
+	// bits of the public key hash, so moving the IP to the current prefix is a
+	// matter of replacing the first half.
 	addrBytes := options.WireguardNetworkPrefix.Addr().As16()
-	copy(addrBytes[8:], addrLast8Bytes[:])
+	ipBytes := ip.As16()
+	copy(addrBytes[8:], ipBytes[8:])
 	return netip.AddrFrom16(addrBytes), nil
 }
+
+// oldFormatHostnamePrefix returns the network prefix an "old format" hostname
+// was issued under, which determines where the public key hash starts in the
+// label. The current prefix is preferred, and also returned for labels that
+// don't match any prefix since the hostname prefix was never checked.
+func (options *Options) oldFormatHostnamePrefix(hostname string) netip.Prefix {
+	decoded, err := hex.DecodeString(hostname)
+	if err != nil || len(decoded) != 16 {
+		return options.WireguardNetworkPrefix
+	}
+	addr := netip.AddrFrom16(*(*[16]byte)(decoded))
+	if options.WireguardNetworkPrefix.Contains(addr) {
+		return options.WireguardNetworkPrefix
+	}
+	for _, prefix := range options.WireguardPreviousNetworkPrefixes {
+		if prefix.Contains(addr) {
+			return prefix
+		}
+	}
+	return options.WireguardNetworkPrefix
+}
@@ -33,16 +33,22 @@ func Test_Option(t *testing.T) {
 					Scheme: "http",
 					Host:   "localhost",
 				},
-				WireguardEndpoint:      "localhost:1234",
-				WireguardPort:          1234,
-				WireguardKey:           key,
-				WireguardMTU:           tunneld.DefaultWireguardMTU + 1,
-				WireguardServerIP:      netip.MustParseAddr("feed::1"),
-				WireguardNetworkPrefix: netip.MustParsePrefix("feed::1/64"),
-				RealIPHeader:           "X-Real-Ip",
-				PeerDialTimeout:        1 * time.Second,
-				PeerRegisterInterval:   time.Second,
-				PeerTimeout:            2 * time.Second,
+				WireguardEndpoint:        "localhost:1234",
+				WireguardPort:            1234,
+				WireguardKey:             key,
+				WireguardMTU:             tunneld.DefaultWireguardMTU + 1,
+				WireguardServerIP:        netip.MustParseAddr("feed::1"),
+				WireguardNetworkPrefix:   netip.MustParsePrefix("feed::1/64"),
+				RealIPHeader:             "X-Real-Ip",
+				PeerDialTimeout:          1 * time.Second,
+				PeerRegisterInterval:     time.Second,
+				PeerTimeout:              2 * time.Second,
+				WireguardIPAssignmentTTL: time.Hour,
+				APIRateLimit:             5,
+				APIRateLimitWindow:       time.Minute,
+				ProxyAccessLogSampleRate: 0.5,
+				MinimumClientVersion:     "v0.2.0",
+				ClientDownloadURL:        "https://example.com/download",
 			}
 
 			clone := o
@@ -84,6 +90,33 @@ func Test_Option(t *testing.T) {
 			require.Equal(t, tunneld.DefaultWireguardNetworkPrefix, o.WireguardNetworkPrefix)
 			// should be canonicalized.
 			require.Equal(t, "X-Real-Ip", o.RealIPHeader)
+			require.EqualValues(t, 1, o.ProxyAccessLogSampleRate)
+			require.Equal(t, tunneld.DefaultClientDownloadURL, o.ClientDownloadURL)
+			require.Equal(t, tunneld.DefaultWireguardIPAssignmentTTL, o.WireguardIPAssignmentTTL)
+		})
+
+		t.Run("ValidIPv4", func(t *testing.T) {
+			t.Parallel()
+
+			o := &tunneld.Options{
+				BaseURL: &url.URL{
+					Scheme: "http",
+					Host:   "localhost",
+				},
+				WireguardEndpoint:      "localhost:1234",
+				WireguardPort:          1234,
+				WireguardKey:           key,
+				WireguardNetworkPrefix: netip.MustParsePrefix("100.64.0.0/10"),
+			}
+
+			err := o.Validate()
+			require.NoError(t, err)
+			require.Equal(t, netip.MustParseAddr("100.64.0.1"), o.WireguardServerIP)
+
+			ip, urls := o.WireguardPublicKeyToIPAndURLs(key.NoisePublicKey(), tunnelsdk.TunnelVersion1)
+			require.False(t, ip.IsValid(), "IPv4 IPs are assigned by the server")
+			require.Len(t, urls, 1)
+			require.Len(t, strings.Split(urls[0].Host, ".")[0], 13)
 		})
 
 		t.Run("Invalid", func(t *testing.T) {
@@ -179,6 +212,116 @@ func Test_Option(t *testing.T) {
 				require.ErrorContains(t, err, "WireguardKey must be a private key")
 			})
 
+			t.Run("WireguardNextKey", func(t *testing.T) {
+				t.Parallel()
+
+				o := &tunneld.Options{
+					BaseURL: &url.URL{
+						Scheme: "http",
+						Host:   "localhost",
+					},
+					WireguardEndpoint: "localhost:1234",
+					WireguardPort:     1234,
+					WireguardKey:      key,
+					WireguardNextKey:  key,
+				}
+
+				err := o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardNextKey must be different from WireguardKey")
+
+				o.WireguardNextKey, err = tunnelsdk.GeneratePrivateKey()
+				require.NoError(t, err)
+
+				err = o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardKeyRotationTime is required")
+
+				o.WireguardNextKey = tunnelsdk.Key{}
+				o.WireguardKeyRotationTime = time.Now()
+
+				err = o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardKeyRotationTime requires WireguardNextKey")
+			})
+
+			t.Run("ProxyAccessLogSampleRate", func(t *testing.T) {
+				t.Parallel()
+
+				o := &tunneld.Options{
+					BaseURL: &url.URL{
+						Scheme: "http",
+						Host:   "localhost",
+					},
+					WireguardEndpoint:        "localhost:1234",
+					WireguardPort:            1234,
+					WireguardKey:             key,
+					ProxyAccessLogSampleRate: 1.5,
+				}
+
+				err := o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "ProxyAccessLogSampleRate")
+			})
+
+			t.Run("RejectOldFormatURLs", func(t *testing.T) {
+				t.Parallel()
+
+				o := &tunneld.Options{
+					BaseURL: &url.URL{
+						Scheme: "http",
+						Host:   "localhost",
+					},
+					WireguardEndpoint:   "localhost:1234",
+					WireguardPort:       1234,
+					WireguardKey:        key,
+					RejectOldFormatURLs: true,
+				}
+
+				err := o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "RejectOldFormatURLs")
+			})
+
+			t.Run("WireguardIPAssignmentTTL", func(t *testing.T) {
+				t.Parallel()
+
+				o := &tunneld.Options{
+					BaseURL: &url.URL{
+						Scheme: "http",
+						Host:   "localhost",
+					},
+					WireguardEndpoint:        "localhost:1234",
+					WireguardPort:            1234,
+					WireguardKey:             key,
+					PeerTimeout:              time.Minute,
+					WireguardIPAssignmentTTL: time.Minute,
+				}
+
+				err := o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardIPAssignmentTTL")
+			})
+
+			t.Run("MinimumClientVersion", func(t *testing.T) {
+				t.Parallel()
+
+				o := &tunneld.Options{
+					BaseURL: &url.URL{
+						Scheme: "http",
+						Host:   "localhost",
+					},
+					WireguardEndpoint:    "localhost:1234",
+					WireguardPort:        1234,
+					WireguardKey:         key,
+					MinimumClientVersion: "0.2.0",
+				}
+
+				err := o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "MinimumClientVersion")
+			})
+
 			t.Run("WireguardServerIP", func(t *testing.T) {
 				t.Parallel()
 
@@ -224,6 +367,62 @@ func Test_Option(t *testing.T) {
 				require.Error(t, err)
 				require.ErrorContains(t, err, "WireguardServerIP must be contained within WireguardNetworkPrefix")
 			})
+
+			t.Run("WireguardNetworkPrefixIPv4", func(t *testing.T) {
+				t.Parallel()
+
+				o := &tunneld.Options{
+					BaseURL: &url.URL{
+						Scheme: "http",
+						Host:   "localhost",
+					},
+					WireguardEndpoint:      "localhost:1234",
+					WireguardPort:          1234,
+					WireguardKey:           key,
+					WireguardServerIP:      netip.MustParseAddr("fcca::1"),
+					WireguardNetworkPrefix: netip.MustParsePrefix("100.64.0.0/10"),
+				}
+
+				err := o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardServerIP must be an IPv4 address")
+
+				o.WireguardServerIP = netip.MustParseAddr("100.64.0.1")
+				o.WireguardNetworkPrefix = netip.MustParsePrefix("100.64.0.0/31")
+				err = o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardNetworkPrefix must have at least 2 bits available")
+
+				o.WireguardNetworkPrefix = netip.MustParsePrefix("100.64.0.0/10")
+				o.WireguardPreviousNetworkPrefixes = []netip.Prefix{tunneld.DefaultWireguardNetworkPrefix}
+				err = o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardPreviousNetworkPrefixes is not supported")
+			})
+
+			t.Run("WireguardPreviousNetworkPrefixes", func(t *testing.T) {
+				t.Parallel()
+
+				o := &tunneld.Options{
+					BaseURL: &url.URL{
+						Scheme: "http",
+						Host:   "localhost",
+					},
+					WireguardEndpoint:                "localhost:1234",
+					WireguardPort:                    1234,
+					WireguardKey:                     key,
+					WireguardPreviousNetworkPrefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+				}
+
+				err := o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "WireguardPreviousNetworkPrefixes")
+
+				o.WireguardPreviousNetworkPrefixes = []netip.Prefix{tunneld.DefaultWireguardNetworkPrefix}
+				err = o.Validate()
+				require.Error(t, err)
+				require.ErrorContains(t, err, "must be different from WireguardNetworkPrefix")
+			})
 		})
 	})
 
@@ -530,6 +729,37 @@ func Test_Option(t *testing.T) {
 					require.NoError(t, err)
 					require.Equal(t, "feed:beef:deaf:deed:"+c.ip, ip.String())
 				})
+
+				t.Run("PreviousPrefix", func(t *testing.T) {
+					t.Parallel()
+
+					// Hostnames issued under the default prefix should map to
+					// the same client in the new prefix.
+					options := &tunneld.Options{
+						BaseURL: &url.URL{
+							Scheme: "http",
+							Host:   "localhost.com",
+						},
+						WireguardEndpoint:                "localhost:1234",
+						WireguardPort:                    1234,
+						WireguardKey:                     key,
+						WireguardServerIP:                netip.MustParseAddr("feed:beef:deaf:deed::1"),
+						WireguardNetworkPrefix:           netip.MustParsePrefix("feed:beef:deaf:deed::1/64"),
+						WireguardPreviousNetworkPrefixes: []netip.Prefix{tunneld.DefaultWireguardNetworkPrefix},
+					}
+					err := options.Validate()
+					require.NoError(t, err)
+
+					ip, err := options.HostnameToWireguardIP(c.hostname)
+					if c.errContains != "" {
+						require.Error(t, err)
+						require.ErrorContains(t, err, c.errContains)
+						return
+					}
+
+					require.NoError(t, err)
+					require.Equal(t, "feed:beef:deaf:deed:"+c.ip, ip.String())
+				})
 			})
 		}
 	})
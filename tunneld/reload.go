@@ -0,0 +1,126 @@
+package tunneld
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// restartRequiredOptions are the options that are baked into the wireguard
+// device or the router when the API is created, so changing them only takes
+// effect after a restart.
+var restartRequiredOptions = map[string]bool{
+	"BaseURL":                true,
+	"WireguardPort":          true,
+	"WireguardKey":           true,
+	"WireguardMTU":           true,
+	"WireguardServerIP":      true,
+	"WireguardNetworkPrefix": true,
+	// The IPv4 allocator loads and writes the file from New.
+	"WireguardIPAssignmentsFile": true,
+}
+
+// ReloadResult describes the settings that differed between the current
+// options and the options passed to Reload.
+type ReloadResult struct {
+	// Changed are the settings that were applied.
+	Changed []string
+	// RestartRequired are the settings that changed but were not applied
+	// because they require a restart.
+	RestartRequired []string
+}
+
+// CurrentOptions returns the options currently in effect, including changes
+// applied by Reload. The returned options must not be modified.
+func (api *API) CurrentOptions() *Options {
+	return api.liveOptions.Load()
+}
+
+// Reload validates options and atomically applies every setting that can be
+// changed while the server is running. Settings that require a restart are
+// left unchanged and reported in the result. If options are invalid, nothing
+// is applied. The logger is never replaced.
+func (api *API) Reload(options *Options) (ReloadResult, error) {
+	if options == nil {
+		return ReloadResult{}, xerrors.New("options is nil")
+	}
+	// Validate a copy since Validate populates defaults.
+	newOptions := *options
+	err := newOptions.Validate()
+	if err != nil {
+		return ReloadResult{}, xerrors.Errorf("invalid options: %w", err)
+	}
+	newOptions.applyDueKeyRotation(time.Now())
+
+	api.reloadMu.Lock()
+	defer api.reloadMu.Unlock()
+
+	var (
+		res     ReloadResult
+		current = api.CurrentOptions()
+		next    = *current
+
+		currentVal = reflect.ValueOf(current).Elem()
+		newVal     = reflect.ValueOf(&newOptions).Elem()
+		nextVal    = reflect.ValueOf(&next).Elem()
+	)
+	for i := 0; i < currentVal.NumField(); i++ {
+		field := currentVal.Type().Field(i)
+		name := field.Name
+		// Unexported fields can only be set before the API is created.
+		if name == "Log" || !field.IsExported() {
+			continue
+		}
+		if reflect.DeepEqual(currentVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			continue
+		}
+		if restartRequiredOptions[name] {
+			res.RestartRequired = append(res.RestartRequired, name)
+			continue
+		}
+		nextVal.Field(i).Set(newVal.Field(i))
+		res.Changed = append(res.Changed, name)
+	}
+
+	if len(res.Changed) > 0 {
+		api.liveOptions.Store(&next)
+		api.reloads.Add(1)
+		if !reflect.DeepEqual(current.WireguardNextKey, next.WireguardNextKey) ||
+			!current.WireguardKeyRotationTime.Equal(next.WireguardKeyRotationTime) {
+			api.scheduleKeyRotation()
+		}
+	}
+	return res, nil
+}
+
+// reloadable returns a middleware that wraps the middleware built from the
+// current options, and rebuilds it after Reload changes the options. Any state
+// kept by the middleware, like rate limit counters, is reset when it's
+// rebuilt. Key rotations replace the options too, but don't rebuild it.
+func (api *API) reloadable(build func(options *Options) func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		var (
+			mu      sync.Mutex
+			built   bool
+			reloads uint64
+			handler http.Handler
+		)
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// Options are stored before the reload is counted, so they're at
+			// least as new as the count.
+			current := api.reloads.Load()
+			mu.Lock()
+			if !built || current != reloads {
+				built, reloads = true, current
+				handler = build(api.CurrentOptions())(next)
+			}
+			h := handler
+			mu.Unlock()
+
+			h.ServeHTTP(rw, r)
+		})
+	}
+}
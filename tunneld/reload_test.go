@@ -0,0 +1,103 @@
+package tunneld_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+
+		td, client := createTestTunneld(t, nil)
+		startBaseURL := td.BaseURL
+
+		options := *td.Options
+		options.WireguardEndpoint = "tunnel.example.com:55551"
+		options.PeerRegisterInterval = 10 * time.Second
+		options.PeerTimeout = time.Minute
+		options.APIRateLimit = 1
+		options.BaseURL = &url.URL{Scheme: "https", Host: "other.dev"}
+
+		res, err := td.Reload(&options)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{
+			"WireguardEndpoint",
+			"PeerRegisterInterval",
+			"PeerTimeout",
+			"APIRateLimit",
+		}, res.Changed)
+		require.Equal(t, []string{"BaseURL"}, res.RestartRequired)
+
+		current := td.CurrentOptions()
+		require.Equal(t, "tunnel.example.com:55551", current.WireguardEndpoint)
+		require.Equal(t, time.Minute, current.PeerTimeout)
+		require.Equal(t, startBaseURL, current.BaseURL)
+		require.Equal(t, startBaseURL, td.BaseURL)
+
+		// The new settings are reported to clients.
+		info, err := client.ServerInfo(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "tunnel.example.com:55551", info.WireguardEndpoint)
+		require.Equal(t, 10*time.Second, info.Limits.PeerRegisterInterval)
+		require.Equal(t, time.Minute, info.Limits.PeerTimeout)
+		require.Equal(t, 1, info.Limits.APIRateLimit)
+
+		// The new rate limit is enforced. Server info isn't rate limited.
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+		register := func() error {
+			_, err := client.ClientRegister(context.Background(), tunnelsdk.ClientRegisterRequest{
+				Version:   tunnelsdk.TunnelVersion2,
+				PublicKey: key.NoisePublicKey(),
+			})
+			return err
+		}
+		require.NoError(t, register())
+		err = register()
+		require.Error(t, err)
+		var sdkErr *tunnelsdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusTooManyRequests, sdkErr.StatusCode())
+		require.Equal(t, tunnelsdk.ErrorCodeRateLimited, sdkErr.Code)
+		require.ErrorIs(t, err, tunnelsdk.ErrRateLimited)
+		require.Positive(t, tunnelsdk.RetryAfter(err))
+	})
+
+	t.Run("NoChanges", func(t *testing.T) {
+		t.Parallel()
+
+		td, _ := createTestTunneld(t, nil)
+		current := td.CurrentOptions()
+
+		options := *td.Options
+		res, err := td.Reload(&options)
+		require.NoError(t, err)
+		require.Empty(t, res.Changed)
+		require.Empty(t, res.RestartRequired)
+		require.Same(t, current, td.CurrentOptions())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+
+		td, _ := createTestTunneld(t, nil)
+		current := td.CurrentOptions()
+
+		options := *td.Options
+		options.PeerRegisterInterval = time.Minute
+		options.PeerTimeout = time.Second
+		_, err := td.Reload(&options)
+		require.Error(t, err)
+		require.Same(t, current, td.CurrentOptions())
+	})
+}
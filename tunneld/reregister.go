@@ -0,0 +1,156 @@
+package tunneld
+
+import (
+	"bufio"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// reregisterJitter is the fraction of the wait that's randomly taken off
+	// so clients that registered at the same time spread out.
+	reregisterJitter = 0.25
+	// reregisterLoadJitter replaces reregisterJitter when the server is under
+	// load, so re-registrations are spread over a wider window.
+	reregisterLoadJitter = 0.5
+	// reregisterNoHandshakeDivisor shortens the wait for peers that haven't
+	// completed a handshake, so clients that can't complete one find out
+	// quickly.
+	reregisterNoHandshakeDivisor = 4
+	// handshakeCacheTTL is how long handshake times read from the wireguard
+	// device are reused. Reading them lists every peer, so it's too expensive
+	// to do for each registration.
+	handshakeCacheTTL = time.Second
+	// reregisterLoadThreshold is the number of registrations per second above
+	// which the server is considered to be under load.
+	reregisterLoadThreshold = 100
+)
+
+// registrationRate counts registrations per second.
+type registrationRate struct {
+	mu     sync.Mutex
+	second time.Time
+	count  int
+	prev   int
+}
+
+// add records a registration at now and returns the number of registrations
+// in the last full second or the current one, whichever is higher.
+func (r *registrationRate) add(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	second := now.Truncate(time.Second)
+	switch {
+	case second.Equal(r.second):
+	case second.Sub(r.second) == time.Second:
+		r.second, r.prev, r.count = second, r.count, 0
+	default:
+		r.second, r.prev, r.count = second, 0, 0
+	}
+	r.count++
+
+	if r.prev > r.count {
+		return r.prev
+	}
+	return r.count
+}
+
+// peerHandshakes caches the last handshake time of every peer on the wireguard
+// device.
+type peerHandshakes struct {
+	mu      sync.Mutex
+	updated time.Time
+	times   map[device.NoisePublicKey]time.Time
+}
+
+// handshaken returns true if the peer has completed a handshake. The result
+// may be up to handshakeCacheTTL out of date.
+func (p *peerHandshakes) handshaken(dev *device.Device, publicKey device.NoisePublicKey, now time.Time) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now.Sub(p.updated) >= handshakeCacheTTL {
+		times, err := readPeerHandshakes(dev)
+		if err != nil {
+			return false, err
+		}
+		p.times, p.updated = times, now
+	}
+	_, ok := p.times[publicKey]
+	return ok, nil
+}
+
+// readPeerHandshakes returns the last handshake time of the peers on the
+// device that have completed one.
+func readPeerHandshakes(dev *device.Device) (map[device.NoisePublicKey]time.Time, error) {
+	out, err := dev.IpcGet()
+	if err != nil {
+		return nil, xerrors.Errorf("get wireguard device config: %w", err)
+	}
+
+	var (
+		times   = make(map[device.NoisePublicKey]time.Time)
+		peer    device.NoisePublicKey
+		sec     int64
+		scanner = bufio.NewScanner(strings.NewReader(out))
+	)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "public_key":
+			b, err := hex.DecodeString(value)
+			if err != nil || len(b) != len(peer) {
+				return nil, xerrors.Errorf("parse public key %q", value)
+			}
+			copy(peer[:], b)
+		case "last_handshake_time_sec":
+			sec, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, xerrors.Errorf("parse %q: %w", key, err)
+			}
+		case "last_handshake_time_nsec":
+			nsec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, xerrors.Errorf("parse %q: %w", key, err)
+			}
+			// The nanoseconds always follow the seconds.
+			if sec != 0 || nsec != 0 {
+				times[peer] = time.Unix(sec, nsec)
+			}
+		}
+	}
+	return times, nil
+}
+
+// reregisterWait returns how long a client should wait before registering
+// again. The register interval is jittered so re-registrations don't line up,
+// shortened for peers that haven't completed a handshake yet, and jittered
+// further when the server is handling more registrations than
+// reregisterLoadThreshold per second. The wait never exceeds the register
+// interval, so clients that fail to re-register have time to retry before they
+// time out.
+func reregisterWait(options *Options, handshaken bool, load int) time.Duration {
+	wait := options.PeerRegisterInterval
+	if !handshaken {
+		wait /= reregisterNoHandshakeDivisor
+	}
+	jitter := reregisterJitter
+	if load > reregisterLoadThreshold {
+		jitter = reregisterLoadJitter
+	}
+
+	// Only jitter downwards so the wait never exceeds the register interval.
+	return wait - time.Duration(rand.Int63n(int64(float64(wait)*jitter)+1)) //nolint:gosec
+}
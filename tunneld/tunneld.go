@@ -2,11 +2,13 @@ package tunneld
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"net"
 	"net/http"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/wireguard-go/conn"
@@ -16,23 +18,71 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/wgtunnel/tunneld/httpmw"
 )
 
-// TODO: add logging to API
 type API struct {
+	// Options are the options the API was created with. Settings that can be
+	// changed with Reload must be read with CurrentOptions.
 	*Options
 
+	// liveOptions are the current options, including changes applied by
+	// Reload.
+	liveOptions atomic.Pointer[Options]
+	reloadMu    sync.Mutex
+	// keyRotationTimer switches to the next wireguard key when it fires. It's
+	// guarded by reloadMu.
+	keyRotationTimer *time.Timer
+	// reloads counts the reloads that changed the options, so middleware built
+	// from them is only rebuilt by reloads and not by key rotations.
+	reloads atomic.Uint64
+
 	wgNet     *netstack.Net
 	wgDevice  *device.Device
 	transport *http.Transport
 
 	pkeyCacheMu sync.RWMutex
 	pkeyCache   map[netip.Addr]cachedPeer
+
+	// registrations measures registration load to adapt how long clients wait
+	// before re-registering.
+	registrations registrationRate
+	// handshakes caches when peers last completed a handshake, which also
+	// affects how long clients wait before re-registering.
+	handshakes peerHandshakes
+
+	// usedProofs contains proofs of private key possession that have already
+	// been accepted, keyed by the proof, so requests can't be replayed while
+	// their timestamp is still valid.
+	usedProofsMu sync.Mutex
+	usedProofs   map[string]time.Time
+
+	// nonceSecret is used to authenticate registration nonces issued by this
+	// server. It's random, so nonces don't survive restarts.
+	nonceSecret []byte
+
+	// proxyRequests tracks in-flight proxied requests, including upgraded
+	// connections which http.Server.Shutdown doesn't wait for.
+	proxyRequests requestTracker
+
+	// legacy counts usage of the legacy endpoint and hostname format.
+	legacy legacyCounters
+
+	// ipv4 assigns client IPs if WireguardNetworkPrefix is an IPv4 network.
+	// It's nil otherwise.
+	ipv4 *ipv4Allocator
+
+	closeOnce sync.Once
 }
 
 type cachedPeer struct {
 	key           device.NoisePublicKey
 	lastHandshake time.Time
+	// proven is true if the peer was registered with a proof of possession of
+	// its private key.
+	proven bool
 }
 
 func New(options *Options) (*API, error) {
@@ -43,6 +93,15 @@ func New(options *Options) (*API, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("invalid options: %w", err)
 	}
+	options.applyDueKeyRotation(time.Now())
+
+	var ipv4 *ipv4Allocator
+	if options.WireguardNetworkPrefix.Addr().Is4() {
+		ipv4, err = newIPv4Allocator(options.WireguardNetworkPrefix, options.WireguardServerIP, options.WireguardIPAssignmentsFile)
+		if err != nil {
+			return nil, xerrors.Errorf("create IPv4 allocator: %w", err)
+		}
+	}
 
 	// Create the wireguard virtual TUN adapter and netstack.
 	tun, wgNet, err := netstack.CreateNetTUN(
@@ -80,61 +139,157 @@ listen_port=%d`,
 		return nil, xerrors.Errorf("start wireguard device: %w", err)
 	}
 
-	return &API{
-		Options:   options,
-		wgNet:     wgNet,
-		wgDevice:  dev,
-		pkeyCache: make(map[netip.Addr]cachedPeer),
-		transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (nc net.Conn, err error) {
-				ctx, span := otel.GetTracerProvider().Tracer("").Start(ctx, "(http.Transport).DialContext")
-				defer span.End()
-				defer func() {
-					if err != nil {
-						span.RecordError(err)
-						span.SetStatus(codes.Error, err.Error())
-					}
-				}()
-
-				ip := ctx.Value(ipPortKey{})
-				if ip == nil {
-					err = xerrors.New("no ip on context")
-					return nil, err
-				}
+	nonceSecret := make([]byte, 32)
+	_, err = rand.Read(nonceSecret)
+	if err != nil {
+		return nil, xerrors.Errorf("generate nonce secret: %w", err)
+	}
+
+	api := &API{
+		Options:     options,
+		nonceSecret: nonceSecret,
+		wgNet:       wgNet,
+		wgDevice:    dev,
+		pkeyCache:   make(map[netip.Addr]cachedPeer),
+		usedProofs:  make(map[string]time.Time),
+		ipv4:        ipv4,
+	}
+	// Copy the options so changes made by the caller aren't picked up.
+	liveOptions := *options
+	api.liveOptions.Store(&liveOptions)
+	api.reloadMu.Lock()
+	api.scheduleKeyRotation()
+	api.reloadMu.Unlock()
 
-				ipp, ok := ip.(netip.AddrPort)
-				if !ok {
-					err = xerrors.Errorf("ip is incorrect type, got %T", ipp)
-					return nil, err
+	api.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (nc net.Conn, err error) {
+			ctx, span := otel.GetTracerProvider().Tracer("").Start(ctx, "(http.Transport).DialContext")
+			defer span.End()
+			defer func() {
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
 				}
+			}()
 
-				span.SetAttributes(attribute.String("wireguard_addr", ipp.Addr().String()))
+			ip := ctx.Value(ipPortKey{})
+			if ip == nil {
+				err = xerrors.New("no ip on context")
+				return nil, err
+			}
 
-				dialCtx, dialCancel := context.WithTimeout(ctx, options.PeerDialTimeout)
-				defer dialCancel()
+			ipp, ok := ip.(netip.AddrPort)
+			if !ok {
+				err = xerrors.Errorf("ip is incorrect type, got %T", ipp)
+				return nil, err
+			}
 
-				nc, err = wgNet.DialContextTCPAddrPort(dialCtx, ipp)
-				if err != nil {
-					return nil, err
-				}
+			span.SetAttributes(attribute.String("wireguard_addr", ipp.Addr().String()))
+
+			dialCtx, dialCancel := context.WithTimeout(ctx, api.CurrentOptions().PeerDialTimeout)
+			defer dialCancel()
+
+			start := time.Now()
+			nc, err = wgNet.DialContextTCPAddrPort(dialCtx, ipp)
+			httpmw.AddAccessLogFields(ctx, slog.F("upstream_dial_ms", time.Since(start).Milliseconds()))
+			if err != nil {
+				return nil, err
+			}
 
-				return nc, nil
-			},
-			ForceAttemptHTTP2:     false,
-			MaxIdleConns:          0,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
+			return nc, nil
 		},
-	}, nil
+		ForceAttemptHTTP2:     false,
+		MaxIdleConns:          0,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return api, nil
+}
+
+// Shutdown rejects new proxied requests and waits for in-flight proxied
+// requests to finish, including upgraded connections such as websockets. It
+// then closes the API. The caller should shut down the HTTP server serving the
+// API first so no new API requests are accepted.
+//
+// If ctx expires first, the API is closed anyway, which terminates the
+// remaining requests, and ctx's error is returned.
+func (api *API) Shutdown(ctx context.Context) error {
+	err := api.proxyRequests.wait(ctx)
+	closeErr := api.Close()
+	if err != nil {
+		return xerrors.Errorf("drain proxied requests: %w", err)
+	}
+	return closeErr
 }
 
 func (api *API) Close() error {
-	// Remove peers before closing to avoid a race condition between dev.Close()
-	// and the peer goroutines which results in segfault.
-	api.wgDevice.RemoveAllPeers()
-	api.wgDevice.Close()
+	api.closeOnce.Do(func() {
+		api.reloadMu.Lock()
+		if api.keyRotationTimer != nil {
+			api.keyRotationTimer.Stop()
+		}
+		api.reloadMu.Unlock()
+
+		// Remove peers before closing to avoid a race condition between
+		// dev.Close() and the peer goroutines which results in segfault.
+		api.wgDevice.RemoveAllPeers()
+		api.wgDevice.Close()
+	})
 	<-api.wgDevice.Wait()
 
 	return nil
 }
+
+// requestTracker counts in-flight requests so they can be drained on shutdown.
+type requestTracker struct {
+	mu      sync.Mutex
+	n       int
+	closing bool
+	// idle is closed when n reaches zero after closing is set.
+	idle chan struct{}
+}
+
+// start records a new request. It returns false if the tracker is draining and
+// the request should be rejected.
+func (r *requestTracker) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		return false
+	}
+	r.n++
+	return true
+}
+
+func (r *requestTracker) done() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.n--
+	if r.closing && r.n == 0 {
+		close(r.idle)
+	}
+}
+
+// wait stops new requests from starting and waits for in-flight requests to
+// finish or ctx to expire.
+func (r *requestTracker) wait(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closing {
+		r.closing = true
+		r.idle = make(chan struct{})
+		if r.n == 0 {
+			close(r.idle)
+		}
+	}
+	idle := r.idle
+	r.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
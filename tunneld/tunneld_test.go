@@ -105,6 +105,134 @@ func TestEndToEnd(t *testing.T) {
 	<-tunnel.Wait()
 }
 
+// Clients are asked to re-register sooner until their peer completes a
+// handshake.
+func TestReregisterWaitHandshake(t *testing.T) {
+	t.Parallel()
+
+	td, client := createTestTunneld(t, &tunneld.Options{
+		APIRateLimit: -1,
+	})
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	res, err := client.Register(context.Background(), tunnelsdk.TunnelConfig{PrivateKey: key})
+	require.NoError(t, err)
+	require.LessOrEqual(t, res.ReregisterWait, td.PeerRegisterInterval/4)
+
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	})
+	require.NoError(t, err, "launch tunnel")
+	defer func() {
+		_ = tunnel.Close()
+		<-tunnel.Wait()
+	}()
+	serveTunnel(t, tunnel)
+	waitForTunnelReady(t, client, tunnel)
+
+	// Handshake times are cached briefly.
+	require.Eventually(t, func() bool {
+		res, err := client.Register(context.Background(), tunnelsdk.TunnelConfig{PrivateKey: key})
+		return err == nil && res.ReregisterWait >= td.PeerRegisterInterval*3/4
+	}, 15*time.Second, 100*time.Millisecond)
+}
+
+// Under load, clients are asked to re-register over a wider window that still
+// ends at the register interval.
+func TestReregisterWaitLoad(t *testing.T) {
+	t.Parallel()
+
+	td, client := createTestTunneld(t, &tunneld.Options{
+		APIRateLimit: -1,
+	})
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	})
+	require.NoError(t, err, "launch tunnel")
+	defer func() {
+		_ = tunnel.Close()
+		<-tunnel.Wait()
+	}()
+	serveTunnel(t, tunnel)
+	waitForTunnelReady(t, client, tunnel)
+
+	register := func() (time.Duration, error) {
+		res, err := client.Register(context.Background(), tunnelsdk.TunnelConfig{PrivateKey: key})
+		return res.ReregisterWait, err
+	}
+	require.Eventually(t, func() bool {
+		wait, err := register()
+		return err == nil && wait >= td.PeerRegisterInterval*3/4
+	}, 15*time.Second, 100*time.Millisecond)
+
+	// Registering in a tight loop puts the server over the load threshold,
+	// after which waits below the usual jitter show up.
+	loaded := false
+	for i := 0; i < 1000 && !loaded; i++ {
+		wait, err := register()
+		require.NoError(t, err)
+		require.LessOrEqual(t, wait, td.PeerRegisterInterval)
+		loaded = wait < td.PeerRegisterInterval*3/4
+	}
+	require.True(t, loaded, "no shortened wait under load")
+}
+
+func TestIPv4Network(t *testing.T) {
+	t.Parallel()
+
+	td, client := createTestTunneld(t, &tunneld.Options{
+		WireguardNetworkPrefix: netip.MustParsePrefix("100.64.0.0/10"),
+	})
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	})
+	require.NoError(t, err, "launch tunnel")
+	defer func() {
+		_ = tunnel.Close()
+		<-tunnel.Wait()
+	}()
+
+	require.NotNil(t, tunnel.URL)
+	require.Empty(t, tunnel.OtherURLs)
+
+	serveTunnel(t, tunnel)
+	waitForTunnelReady(t, client, tunnel)
+
+	u, err := tunnel.URL.Parse("/test")
+	require.NoError(t, err)
+	res, err := client.Request(context.Background(), http.MethodGet, u.String(), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello world /test", string(body))
+
+	// Unknown labels aren't routed anywhere.
+	unknown := *tunnel.URL
+	unknown.Host = "aaaaaaaaaaaaa." + td.BaseURL.Host
+	res, err = client.Request(context.Background(), http.MethodGet, unknown.String(), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
 // This test ensures that wgtunnel is compatible with the old closed-source
 // wgtunnel when register requests are made with version 1.
 //
@@ -415,6 +543,589 @@ func TestPeerTimeout(t *testing.T) {
 	}
 }
 
+// TestKeyRotation ensures that tunnels keep working when the server switches to
+// its next key.
+func TestKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	nextKey, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate next private key")
+	rotationTime := time.Now().Add(3 * time.Second)
+	td, client := createTestTunneld(t, &tunneld.Options{
+		WireguardNextKey:         nextKey,
+		WireguardKeyRotationTime: rotationTime,
+	})
+	startKey := td.WireguardKey.NoisePublicKey()
+
+	// The next key is advertised, and proofs made with either key are
+	// accepted.
+	var (
+		registeredKeys []tunnelsdk.Key
+		registrations  []tunnelsdk.ClientRegisterResponse
+	)
+	for _, serverKey := range []tunnelsdk.Key{td.WireguardKey, nextKey} {
+		key, err := tunnelsdk.GeneratePrivateKey()
+		require.NoError(t, err)
+		registeredKeys = append(registeredKeys, key)
+		challenge, err := client.ClientChallenge(context.Background())
+		require.NoError(t, err)
+		challenge.ServerPublicKey = serverKey.NoisePublicKey()
+		req, err := tunnelsdk.NewClientRegisterRequest(tunnelsdk.TunnelVersion3, key, challenge)
+		require.NoError(t, err)
+		res, err := client.ClientRegister(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, startKey, res.ServerPublicKey)
+		require.NotNil(t, res.NextServerPublicKey)
+		require.Equal(t, nextKey.NoisePublicKey(), *res.NextServerPublicKey)
+		require.NotNil(t, res.ServerKeyRotationTime)
+		require.True(t, rotationTime.Equal(*res.ServerKeyRotationTime))
+		registrations = append(registrations, res)
+	}
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	})
+	require.NoError(t, err, "launch tunnel")
+	defer func() {
+		_ = tunnel.Close()
+		<-tunnel.Wait()
+	}()
+	serveTunnel(t, tunnel)
+	waitForTunnelReady(t, client, tunnel)
+
+	require.Eventually(t, func() bool {
+		return td.CurrentOptions().WireguardKey.NoisePublicKey() == nextKey.NoisePublicKey()
+	}, 10*time.Second, 100*time.Millisecond, "server did not rotate key")
+	require.True(t, td.CurrentOptions().WireguardNextKey.IsZero())
+
+	// Clients that haven't re-registered since the rotation can still
+	// deregister.
+	err = client.ClientDeregister(context.Background(), registeredKeys[0], registrations[0].ServerPublicKey)
+	require.Error(t, err)
+	err = client.ClientDeregister(context.Background(), registeredKeys[0], registrations[0].ProofServerPublicKey())
+	require.NoError(t, err)
+
+	// The client re-registers after the rotation and picks up the new key.
+	u, err := tunnel.URL.Parse("/test/1")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		res, err := client.Request(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}, 20*time.Second, 250*time.Millisecond, "tunnel did not recover after key rotation")
+}
+
+// Tunnels that learn about a key rotation after they were launched deregister
+// with the next key once the server switched to it.
+func TestKeyRotationAnnouncedAfterLaunch(t *testing.T) {
+	t.Parallel()
+
+	td, client := createTestTunneld(t, &tunneld.Options{
+		PeerRegisterInterval: time.Second,
+		APIRateLimit:         -1,
+	})
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	})
+	require.NoError(t, err, "launch tunnel")
+	defer func() {
+		_ = tunnel.Close()
+		<-tunnel.Wait()
+	}()
+
+	// The tunnel re-registers before the rotation, which doesn't change
+	// anything it has to reconfigure.
+	nextKey, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate next private key")
+	options := *td.CurrentOptions()
+	options.WireguardNextKey = nextKey
+	options.WireguardKeyRotationTime = time.Now().Add(3 * time.Second)
+	_, err = td.Reload(&options)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return td.CurrentOptions().WireguardKey.NoisePublicKey() == nextKey.NoisePublicKey()
+	}, 10*time.Second, 50*time.Millisecond, "server did not rotate key")
+
+	// Clients re-register up to a few seconds after the rotation, so this
+	// usually deregisters before the tunnel saw the new key. Nothing was
+	// accepted from the listener, so there's nothing to drain.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, tunnel.Shutdown(ctx))
+}
+
+// Rotating the key doesn't reset the API rate limit.
+func TestKeyRotationRateLimit(t *testing.T) {
+	t.Parallel()
+
+	nextKey, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate next private key")
+	td, client := createTestTunneld(t, &tunneld.Options{
+		WireguardNextKey:         nextKey,
+		WireguardKeyRotationTime: time.Now().Add(time.Second),
+		APIRateLimit:             2,
+		APIRateLimitWindow:       time.Minute,
+	})
+
+	get := func() int {
+		res, err := client.Request(context.Background(), http.MethodGet, "/", nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusOK, get())
+	require.Equal(t, http.StatusOK, get())
+
+	require.Eventually(t, func() bool {
+		return td.CurrentOptions().WireguardKey.NoisePublicKey() == nextKey.NoisePublicKey()
+	}, 10*time.Second, 50*time.Millisecond, "server did not rotate key")
+	require.Equal(t, http.StatusTooManyRequests, get())
+}
+
+// TestReconnect ensures that tunnels survive tunneld restarting with a
+// different configuration.
+func TestReconnect(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		mutate        func(t *testing.T, o *tunneld.Options)
+		expectedEvent tunnelsdk.TunnelEventType
+		// oldURLWorks is true if the old format URL issued before the restart
+		// should still reach the tunnel.
+		oldURLWorks bool
+	}{
+		{
+			name: "NewKey",
+			mutate: func(t *testing.T, o *tunneld.Options) {
+				key, err := tunnelsdk.GeneratePrivateKey()
+				require.NoError(t, err, "generate wireguard private key")
+				o.WireguardKey = key
+			},
+			expectedEvent: tunnelsdk.TunnelEventReconfigured,
+		},
+		{
+			name: "NewNetwork",
+			mutate: func(t *testing.T, o *tunneld.Options) {
+				o.WireguardServerIP = netip.MustParseAddr("fccb::1")
+				o.WireguardNetworkPrefix = netip.MustParsePrefix("fccb::/16")
+			},
+			expectedEvent: tunnelsdk.TunnelEventRebuilt,
+		},
+		{
+			// The prefix length changes, so old format hostnames can only be
+			// decoded with the previous prefix.
+			name: "NewNetworkPreviousPrefix",
+			mutate: func(t *testing.T, o *tunneld.Options) {
+				o.WireguardServerIP = netip.MustParseAddr("fccb:1::1")
+				o.WireguardNetworkPrefix = netip.MustParsePrefix("fccb:1::/32")
+				o.WireguardPreviousNetworkPrefixes = []netip.Prefix{tunneld.DefaultWireguardNetworkPrefix}
+			},
+			expectedEvent: tunnelsdk.TunnelEventRebuilt,
+			oldURLWorks:   true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			port := freeUDPPort(t)
+			key, err := tunnelsdk.GeneratePrivateKey()
+			require.NoError(t, err, "generate wireguard private key")
+			options := &tunneld.Options{
+				Log: slogtest.
+					Make(t, &slogtest.Options{IgnoreErrors: true}).
+					Named("tunneld"),
+				BaseURL: &url.URL{
+					Scheme: "http",
+					Host:   "tunnel.dev",
+				},
+				WireguardEndpoint:    "127.0.0.1:" + strconv.Itoa(int(port)),
+				WireguardPort:        port,
+				WireguardKey:         key,
+				PeerRegisterInterval: 100 * time.Millisecond,
+			}
+
+			td1, err := tunneld.New(options)
+			require.NoError(t, err, "create tunneld")
+			t.Cleanup(func() {
+				_ = td1.Close()
+			})
+
+			// The server handler is swapped out when the server "restarts".
+			// Requests are held while the server restarts.
+			var (
+				handlerMu sync.RWMutex
+				handler   = td1.Router()
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				handlerMu.RLock()
+				h := handler
+				handlerMu.RUnlock()
+				h.ServeHTTP(rw, r)
+			}))
+			t.Cleanup(srv.Close)
+			u, err := url.Parse(srv.URL)
+			require.NoError(t, err, "parse server URL")
+			client := tunnelsdk.New(options.BaseURL)
+			client.HTTPClient = tunnelHTTPClient(u)
+
+			events := make(chan tunnelsdk.TunnelEvent, 128)
+			tunnelKey, err := tunnelsdk.GeneratePrivateKey()
+			require.NoError(t, err, "generate private key")
+			tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+				Log: slogtest.
+					Make(t, &slogtest.Options{IgnoreErrors: true}).
+					Named("tunnel_client"),
+				PrivateKey: tunnelKey,
+				EventHandler: func(ev tunnelsdk.TunnelEvent) {
+					select {
+					case events <- ev:
+					default:
+					}
+				},
+			})
+			require.NoError(t, err, "launch tunnel")
+			defer func() {
+				_ = tunnel.Close()
+				<-tunnel.Wait()
+			}()
+
+			serveTunnel(t, tunnel)
+			waitForTunnelReady(t, client, tunnel)
+			_, oldURLs := td1.WireguardPublicKeyToIPAndURLs(tunnelKey.NoisePublicKey(), tunnelsdk.TunnelVersion1)
+
+			// Restart the server with the new configuration.
+			handlerMu.Lock()
+			require.NoError(t, td1.Close(), "close tunneld")
+			options2 := *options
+			c.mutate(t, &options2)
+			td2, err := tunneld.New(&options2)
+			require.NoError(t, err, "create tunneld")
+			t.Cleanup(func() {
+				_ = td2.Close()
+			})
+			handler = td2.Router()
+			handlerMu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			for {
+				var ev tunnelsdk.TunnelEvent
+				select {
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for %q event", c.expectedEvent)
+				case ev = <-events:
+				}
+				if ev.Type == c.expectedEvent {
+					break
+				}
+			}
+
+			waitForTunnelReady(t, client, tunnel)
+
+			if c.oldURLWorks {
+				res, err := client.Request(ctx, http.MethodGet, oldURLs[0].String(), nil)
+				require.NoError(t, err)
+				defer res.Body.Close()
+				require.Equal(t, http.StatusOK, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestTunnelStats(t *testing.T) {
+	t.Parallel()
+
+	td, client := createTestTunneld(t, nil)
+	require.NotNil(t, td)
+
+	var (
+		statesMu sync.Mutex
+		states   []tunnelsdk.TunnelState
+	)
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+		EventHandler: func(ev tunnelsdk.TunnelEvent) {
+			if ev.Type != tunnelsdk.TunnelEventStateChanged {
+				return
+			}
+			statesMu.Lock()
+			defer statesMu.Unlock()
+			states = append(states, ev.State)
+		},
+	})
+	require.NoError(t, err, "launch tunnel")
+
+	require.Equal(t, tunnelsdk.TunnelStateHandshaking, tunnel.State())
+
+	serveTunnel(t, tunnel)
+	waitForTunnelReady(t, client, tunnel)
+
+	require.Eventually(t, func() bool {
+		return tunnel.State() == tunnelsdk.TunnelStateConnected
+	}, 15*time.Second, 100*time.Millisecond)
+
+	stats := tunnel.Stats()
+	require.Equal(t, tunnelsdk.TunnelStateConnected, stats.State)
+	require.WithinDuration(t, time.Now(), stats.LastHandshake, time.Minute)
+	require.NotZero(t, stats.RxBytes)
+	require.NotZero(t, stats.TxBytes)
+	require.Equal(t, td.WireguardEndpoint, stats.Endpoint)
+	require.NoError(t, stats.LastRegistrationError)
+	require.False(t, stats.LastRegistration.IsZero())
+
+	err = tunnel.Close()
+	require.NoError(t, err, "close tunnel")
+	<-tunnel.Wait()
+	require.Equal(t, tunnelsdk.TunnelStateClosed, tunnel.State())
+
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	require.Equal(t, []tunnelsdk.TunnelState{
+		tunnelsdk.TunnelStateRegistering,
+		tunnelsdk.TunnelStateHandshaking,
+		tunnelsdk.TunnelStateConnected,
+		tunnelsdk.TunnelStateClosed,
+	}, states)
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	_, client := createTestTunneld(t, nil)
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	})
+	require.NoError(t, err, "launch tunnel")
+	t.Cleanup(func() {
+		_ = tunnel.Close()
+	})
+
+	var (
+		entered = make(chan struct{}, 1)
+		release = make(chan struct{})
+	)
+	srv := &http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				entered <- struct{}{}
+				<-release
+			}
+			rw.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() {
+		_ = srv.Serve(tunnel.Listener)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+	waitForTunnelReady(t, client, tunnel)
+
+	// Start a request that doesn't complete until it's released.
+	slowDone := make(chan int, 1)
+	go func() {
+		res, err := client.Request(context.Background(), http.MethodGet, tunnel.URL.String()+"/slow", nil)
+		if err != nil {
+			slowDone <- 0
+			return
+		}
+		_ = res.Body.Close()
+		slowDone <- res.StatusCode
+	}()
+	<-entered
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		shutdownDone <- tunnel.Shutdown(ctx)
+	}()
+
+	// Shutdown should wait for the in-flight request.
+	select {
+	case <-shutdownDone:
+		t.Fatal("shutdown returned before the request finished")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-slowDone)
+	require.NoError(t, <-shutdownDone)
+	<-tunnel.Wait()
+
+	// The client was deregistered, so the server should stop routing to it
+	// immediately.
+	res, err := client.Request(context.Background(), http.MethodGet, tunnel.URL.String(), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	var resBody tunnelsdk.Response
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resBody))
+	require.Equal(t, "Peer is not connected.", resBody.Message)
+	require.Equal(t, tunnelsdk.ErrorCodePeerNotConnected, resBody.Code)
+}
+
+func TestCloseDeregisters(t *testing.T) {
+	t.Parallel()
+
+	_, client := createTestTunneld(t, nil)
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	tunnel, err := client.LaunchTunnel(context.Background(), tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	})
+	require.NoError(t, err, "launch tunnel")
+
+	serveTunnel(t, tunnel)
+	waitForTunnelReady(t, client, tunnel)
+
+	err = tunnel.Close()
+	require.NoError(t, err, "close tunnel")
+	<-tunnel.Wait()
+
+	// The peer should be gone right away instead of after PeerTimeout.
+	res, err := client.Request(context.Background(), http.MethodGet, tunnel.URL.String(), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	var resBody tunnelsdk.Response
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&resBody))
+	require.Equal(t, "Peer is not connected.", resBody.Message)
+}
+
+// TestKeepRegistered registers a client without a wireguard device, like it's
+// done for kernel wireguard interfaces, and checks that the client stays
+// registered and learns about server key rotations.
+func TestKeepRegistered(t *testing.T) {
+	t.Parallel()
+
+	nextKey, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate next private key")
+	_, client := createTestTunneld(t, &tunneld.Options{
+		PeerDialTimeout:          500 * time.Millisecond,
+		PeerRegisterInterval:     time.Second,
+		PeerTimeout:              2 * time.Second,
+		WireguardNextKey:         nextKey,
+		WireguardKeyRotationTime: time.Now().Add(2 * time.Second),
+		// The peer never completes a handshake, so the client re-registers
+		// often.
+		APIRateLimit: -1,
+	})
+
+	key, err := tunnelsdk.GeneratePrivateKey()
+	require.NoError(t, err, "generate private key")
+	cfg := tunnelsdk.TunnelConfig{
+		Log: slogtest.
+			Make(t, &slogtest.Options{IgnoreErrors: true}).
+			Named("tunnel_client"),
+		PrivateKey: key,
+	}
+	res, err := client.Register(context.Background(), cfg)
+	require.NoError(t, err, "register")
+
+	config, err := res.WireguardConfig(key)
+	require.NoError(t, err, "create wireguard config")
+	for _, line := range []string{
+		"[Interface]",
+		"PrivateKey = " + key.String(),
+		"Address = " + res.ClientIP.String() + "/128",
+		"MTU = " + strconv.Itoa(res.WireguardMTU),
+		"[Peer]",
+		"PublicKey = " + tunnelsdk.FromNoisePublicKey(res.ServerPublicKey).String(),
+		"Endpoint = " + res.ServerEndpoint,
+		"AllowedIPs = " + res.ServerIP.String() + "/128",
+		"PersistentKeepalive = 21",
+	} {
+		require.Contains(t, config, line+"\n")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		changed = make(chan tunnelsdk.ClientRegisterResponse, 1)
+		done    = make(chan error, 1)
+	)
+	go func() {
+		done <- client.KeepRegistered(ctx, cfg, res, func(res tunnelsdk.ClientRegisterResponse, changes []string) {
+			for _, c := range changes {
+				if c == "server_public_key" {
+					select {
+					case changed <- res:
+					default:
+					}
+				}
+			}
+		})
+	}()
+
+	select {
+	case res := <-changed:
+		require.Equal(t, nextKey.NoisePublicKey(), res.ServerPublicKey)
+	case <-time.After(15 * time.Second):
+		t.Fatal("client did not pick up the rotated server key")
+	}
+
+	tunnelStatus := func() string {
+		res, err := client.Request(context.Background(), http.MethodGet, res.TunnelURLs[0], nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+		var resBody tunnelsdk.Response
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resBody))
+		return resBody.Message
+	}
+
+	// The peer is still registered after PeerTimeout, but nothing is
+	// listening on the other end.
+	time.Sleep(2 * time.Second)
+	require.Equal(t, "Failed to dial peer.", tunnelStatus())
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	require.Equal(t, "Peer is not connected.", tunnelStatus())
+}
+
 func freeUDPPort(t *testing.T) uint16 {
 	t.Helper()
 
@@ -3,21 +3,64 @@ package tunnelsdk
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/netip"
 	"time"
 
 	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/wgtunnel/buildinfo"
 )
 
 type Response struct {
 	Message string `json:"message"`
 	Detail  string `json:"detail,omitempty"`
+	// Code identifies the reason for an error. It's empty for successful
+	// responses and for errors from servers that predate error codes.
+	Code ErrorCode `json:"code,omitempty"`
+	// Validations lists the invalid fields for ErrorCodeValidationFailed and
+	// ErrorCodeUnsupportedVersion errors.
+	Validations []ValidationError `json:"validations,omitempty"`
 }
 
 type ClientRegisterRequest struct {
 	Version   TunnelVersion         `json:"version"`
 	PublicKey device.NoisePublicKey `json:"public_key"`
+
+	// Nonce and Proof are required for TunnelVersion3 and above. Nonce is
+	// obtained from ClientChallenge and Proof proves possession of the private
+	// key for PublicKey. See NewClientRegisterRequest.
+	Nonce []byte `json:"nonce,omitempty"`
+	Proof []byte `json:"proof,omitempty"`
+
+	// ClientVersion is the semantic version of the client. ClientRegister
+	// fills it in with the version of this package if it's empty. Servers may
+	// reject clients that are too old.
+	ClientVersion string `json:"client_version,omitempty"`
+}
+
+// NewClientRegisterRequest creates a registration request for the client's
+// private key, with a proof of possession over the nonce in the challenge.
+func NewClientRegisterRequest(version TunnelVersion, privateKey Key, challenge ClientChallengeResponse) (ClientRegisterRequest, error) {
+	req := ClientRegisterRequest{
+		Version:   version,
+		PublicKey: privateKey.NoisePublicKey(),
+		Nonce:     challenge.Nonce,
+	}
+
+	var err error
+	req.Proof, err = ProofMAC(privateKey, challenge.ServerPublicKey, req.ProofMessage())
+	if err != nil {
+		return ClientRegisterRequest{}, err
+	}
+	return req, nil
+}
+
+// ProofMessage returns the message that Proof is computed over.
+func (r ClientRegisterRequest) ProofMessage() []byte {
+	return []byte(fmt.Sprintf("register\n%d\n%x\n%x", r.Version, r.PublicKey[:], r.Nonce))
 }
 
 type ClientRegisterResponse struct {
@@ -36,9 +79,54 @@ type ClientRegisterResponse struct {
 	ServerIP        netip.Addr            `json:"server_ip"`
 	ServerPublicKey device.NoisePublicKey `json:"server_public_key"`
 	WireguardMTU    int                   `json:"wireguard_mtu"`
+
+	// NextServerPublicKey is set if the server is going to switch to a new
+	// key at ServerKeyRotationTime. Clients should re-register after that
+	// time to pick up the new ServerPublicKey.
+	NextServerPublicKey   *device.NoisePublicKey `json:"next_server_public_key,omitempty"`
+	ServerKeyRotationTime *time.Time             `json:"server_key_rotation_time,omitempty"`
+}
+
+// ProofServerPublicKey returns the server key that proofs of private key
+// possession should be made for. The server accepts proofs for both its
+// current and its next key, and the next key stays valid after the rotation,
+// so it's preferred while a rotation is scheduled.
+func (r ClientRegisterResponse) ProofServerPublicKey() device.NoisePublicKey {
+	if r.NextServerPublicKey != nil {
+		return *r.NextServerPublicKey
+	}
+	return r.ServerPublicKey
+}
+
+type ClientChallengeResponse struct {
+	// Nonce must be included in the next registration request. It can only be
+	// used once.
+	Nonce     []byte    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ServerPublicKey is the key the proof must be computed for.
+	ServerPublicKey device.NoisePublicKey `json:"server_public_key"`
+}
+
+// ClientChallenge requests a nonce from the server for use in a registration
+// request. Servers that don't support TunnelVersion3 respond with a 404.
+func (c *Client) ClientChallenge(ctx context.Context) (ClientChallengeResponse, error) {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/clients/challenge", nil)
+	if err != nil {
+		return ClientChallengeResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ClientChallengeResponse{}, readBodyAsError(res)
+	}
+
+	var resp ClientChallengeResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
 }
 
 func (c *Client) ClientRegister(ctx context.Context, req ClientRegisterRequest) (ClientRegisterResponse, error) {
+	if req.ClientVersion == "" {
+		req.ClientVersion = buildinfo.Version()
+	}
 	res, err := c.Request(ctx, http.MethodPost, "/api/v2/clients", req)
 	if err != nil {
 		return ClientRegisterResponse{}, err
@@ -51,3 +139,100 @@ func (c *Client) ClientRegister(ctx context.Context, req ClientRegisterRequest)
 	var resp ClientRegisterResponse
 	return resp, json.NewDecoder(res.Body).Decode(&resp)
 }
+
+type ClientDeregisterRequest struct {
+	PublicKey device.NoisePublicKey `json:"public_key"`
+	// Timestamp is when the request was created. The server rejects requests
+	// with timestamps more than ProofMaxClockSkew away from its own clock.
+	Timestamp time.Time `json:"timestamp"`
+	// Proof proves possession of the private key for PublicKey. See
+	// NewClientDeregisterRequest.
+	Proof []byte `json:"proof"`
+}
+
+// NewClientDeregisterRequest creates a deregistration request for the client's
+// private key, signed for the server with the given public key.
+func NewClientDeregisterRequest(privateKey Key, serverPublicKey device.NoisePublicKey) (ClientDeregisterRequest, error) {
+	req := ClientDeregisterRequest{
+		PublicKey: privateKey.NoisePublicKey(),
+		Timestamp: time.Now().UTC(),
+	}
+
+	var err error
+	req.Proof, err = ProofMAC(privateKey, serverPublicKey, req.ProofMessage())
+	if err != nil {
+		return ClientDeregisterRequest{}, err
+	}
+	return req, nil
+}
+
+// ProofMessage returns the message that Proof is computed over.
+func (r ClientDeregisterRequest) ProofMessage() []byte {
+	return []byte(fmt.Sprintf("deregister\n%x\n%d", r.PublicKey[:], r.Timestamp.UnixNano()))
+}
+
+// registerKey registers the client's key with the given version, including a
+// proof of possession if the version requires it. If fallback is true and the
+// server doesn't support proofs, it falls back to TunnelVersion2. Fallback
+// must only be allowed when the server's supported versions are unknown,
+// otherwise a misrouted challenge endpoint would silently disable proofs.
+func (c *Client) registerKey(ctx context.Context, version TunnelVersion, privateKey Key, fallback bool) (ClientRegisterResponse, error) {
+	if version < TunnelVersion3 {
+		return c.ClientRegister(ctx, ClientRegisterRequest{
+			Version:   version,
+			PublicKey: privateKey.NoisePublicKey(),
+		})
+	}
+
+	var (
+		res ClientRegisterResponse
+		err error
+	)
+	// If the server restarted or changed its key between issuing the nonce
+	// and the registration, the proof is rejected. Try once more with a fresh
+	// nonce.
+	for i := 0; i < 2; i++ {
+		var challenge ClientChallengeResponse
+		challenge, err = c.ClientChallenge(ctx)
+		if err != nil {
+			if fallback && isStatusCode(err, http.StatusNotFound) {
+				return c.ClientRegister(ctx, ClientRegisterRequest{
+					Version:   TunnelVersion2,
+					PublicKey: privateKey.NoisePublicKey(),
+				})
+			}
+			return ClientRegisterResponse{}, xerrors.Errorf("get registration challenge: %w", err)
+		}
+
+		var req ClientRegisterRequest
+		req, err = NewClientRegisterRequest(version, privateKey, challenge)
+		if err != nil {
+			return ClientRegisterResponse{}, xerrors.Errorf("create register request: %w", err)
+		}
+		res, err = c.ClientRegister(ctx, req)
+		if !isStatusCode(err, http.StatusUnauthorized) {
+			break
+		}
+	}
+	return res, err
+}
+
+// ClientDeregister removes the client's peer from the server. The server stops
+// routing traffic to the tunnel immediately rather than waiting for the peer to
+// time out.
+func (c *Client) ClientDeregister(ctx context.Context, privateKey Key, serverPublicKey device.NoisePublicKey) error {
+	req, err := NewClientDeregisterRequest(privateKey, serverPublicKey)
+	if err != nil {
+		return xerrors.Errorf("create deregister request: %w", err)
+	}
+
+	res, err := c.Request(ctx, http.MethodDelete, "/api/v2/clients", req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
@@ -10,11 +10,19 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
+
+	"github.com/coder/wgtunnel/buildinfo"
 )
 
+// ClientVersionHeader is the header that the client sends its semantic
+// version in with every request.
+const ClientVersionHeader = "Wgtunnel-Client-Version"
+
 // New creates a tunneld client for the provided URL.
 func New(serverURL *url.URL) *Client {
 	return &Client{
@@ -61,6 +69,7 @@ func (c *Client) Request(ctx context.Context, method, path string, body interfac
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	req.Header.Set(ClientVersionHeader, buildinfo.Version())
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
@@ -90,6 +99,7 @@ func readBodyAsError(res *http.Response) error {
 	if err != nil {
 		return xerrors.Errorf("read body: %w", err)
 	}
+	retryAfter := parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
 
 	mimeType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
@@ -104,6 +114,7 @@ func readBodyAsError(res *http.Response) error {
 		}
 		return &Error{
 			statusCode: res.StatusCode,
+			retryAfter: retryAfter,
 			Response: Response{
 				Message: "unexpected non-JSON response",
 				Detail:  string(resp),
@@ -117,6 +128,7 @@ func readBodyAsError(res *http.Response) error {
 		if errors.Is(err, io.EOF) {
 			return &Error{
 				statusCode: res.StatusCode,
+				retryAfter: retryAfter,
 				Response: Response{
 					Message: "empty response body",
 				},
@@ -135,16 +147,38 @@ func readBodyAsError(res *http.Response) error {
 	return &Error{
 		Response:   m,
 		statusCode: res.StatusCode,
+		retryAfter: retryAfter,
 		method:     method,
 		url:        u,
 	}
 }
 
+// parseRetryAfter parses a Retry-After header value, which is either a number
+// of seconds or an HTTP date. It returns zero if the value is missing or
+// invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
 // Error represents an unaccepted or invalid request to the API.
 type Error struct {
 	Response
 
 	statusCode int
+	retryAfter time.Duration
 	method     string
 	url        string
 }
@@ -153,6 +187,18 @@ func (e *Error) StatusCode() int {
 	return e.statusCode
 }
 
+// RetryAfter returns how long the server asked the client to wait before
+// retrying the request, or zero if it didn't say.
+func (e *Error) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// isStatusCode returns true if err is an *Error with the given status code.
+func isStatusCode(err error, statusCode int) bool {
+	var sdkErr *Error
+	return xerrors.As(err, &sdkErr) && sdkErr.StatusCode() == statusCode
+}
+
 func (e *Error) Friendly() string {
 	return e.Message
 }
@@ -0,0 +1,47 @@
+package tunnelsdk
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MinKeySeedSize is the minimum size of a secret passed to DeriveKey.
+const MinKeySeedSize = 32
+
+const deriveKeyInfo = "wgtunnel service key v1\n"
+
+// DeriveKey deterministically derives a private key for a service from a
+// secret shared between machines. The same secret and service name always
+// produce the same key, and so the same tunnel hostname, while keys for
+// different services can't be linked to each other or to the secret.
+//
+// The key is derived with HKDF-SHA256 using the secret as the input key
+// material and the service name in the info parameter, then clamped like any
+// other Curve25519 private key.
+func DeriveKey(secret []byte, serviceName string) (Key, error) {
+	if len(secret) < MinKeySeedSize {
+		return Key{}, xerrors.Errorf("secret must be at least %d bytes, got %d", MinKeySeedSize, len(secret))
+	}
+	if serviceName == "" {
+		return Key{}, xerrors.New("service name is required")
+	}
+
+	var k wgtypes.Key
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(deriveKeyInfo+serviceName)), k[:])
+	if err != nil {
+		return Key{}, xerrors.Errorf("derive key: %w", err)
+	}
+
+	// Clamp the key as described in RFC 7748.
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+
+	return Key{
+		k:         k,
+		isPrivate: true,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package tunnelsdk_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/coder/wgtunnel/tunnelsdk"
+)
+
+func TestDeriveKey(t *testing.T) {
+	t.Parallel()
+
+	secret := bytes.Repeat([]byte{0x01}, tunnelsdk.MinKeySeedSize)
+
+	t.Run("KnownAnswer", func(t *testing.T) {
+		t.Parallel()
+
+		// Changing the derivation changes every derived tunnel hostname, so the
+		// output is pinned.
+		key, err := tunnelsdk.DeriveKey(secret, "api")
+		require.NoError(t, err)
+		require.True(t, key.IsPrivate())
+		require.Equal(t, "10938d12cb46237f4a2ecf0a175aaa27ec5749c77d64a3095e4b38e58444677e", key.HexString())
+		pub, err := key.PublicKey()
+		require.NoError(t, err)
+		require.Equal(t, "919I587fbJCFzE+vQf/reiuGoO+UcMbFxE4jZKuPrw0=", pub.String())
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		t.Parallel()
+
+		a, err := tunnelsdk.DeriveKey(secret, "api")
+		require.NoError(t, err)
+		b, err := tunnelsdk.DeriveKey(secret, "api")
+		require.NoError(t, err)
+		require.Equal(t, a.String(), b.String())
+
+		other, err := tunnelsdk.DeriveKey(secret, "web")
+		require.NoError(t, err)
+		require.NotEqual(t, a.String(), other.String())
+
+		otherSecret := bytes.Repeat([]byte{0x02}, tunnelsdk.MinKeySeedSize)
+		other, err = tunnelsdk.DeriveKey(otherSecret, "api")
+		require.NoError(t, err)
+		require.NotEqual(t, a.String(), other.String())
+	})
+
+	t.Run("Clamped", func(t *testing.T) {
+		t.Parallel()
+
+		for _, name := range []string{"api", "web", "db", "a-much-longer-service-name"} {
+			key, err := tunnelsdk.DeriveKey(secret, name)
+			require.NoError(t, err)
+			k, err := wgtypes.ParseKey(key.String())
+			require.NoError(t, err)
+			require.Zero(t, k[0]&7, name)
+			require.Zero(t, k[31]&128, name)
+			require.NotZero(t, k[31]&64, name)
+		}
+	})
+
+	t.Run("ShortSecret", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := tunnelsdk.DeriveKey(secret[:tunnelsdk.MinKeySeedSize-1], "api")
+		require.ErrorContains(t, err, "secret must be at least 32 bytes, got 31")
+		_, err = tunnelsdk.DeriveKey(nil, "api")
+		require.Error(t, err)
+	})
+
+	t.Run("EmptyServiceName", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := tunnelsdk.DeriveKey(secret, "")
+		require.ErrorContains(t, err, "service name is required")
+	})
+}
@@ -0,0 +1,151 @@
+package tunnelsdk
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrorCode is a stable, machine-readable identifier for the reason an API
+// request failed. Clients should compare codes instead of messages, and treat
+// unknown codes like errors without a code since new codes may be added.
+type ErrorCode string
+
+const (
+	// ErrorCodeNotFound means the API route doesn't exist.
+	ErrorCodeNotFound ErrorCode = "not_found"
+	// ErrorCodeInvalidRequest means the request body couldn't be decoded.
+	ErrorCodeInvalidRequest ErrorCode = "invalid_request"
+	// ErrorCodeValidationFailed means one or more fields in the request are
+	// invalid. Response.Validations lists them.
+	ErrorCodeValidationFailed ErrorCode = "validation_failed"
+	// ErrorCodeUnsupportedVersion means the server doesn't support the
+	// requested tunnel version.
+	ErrorCodeUnsupportedVersion ErrorCode = "unsupported_version"
+	// ErrorCodeClientOutdated means the client is older than the minimum
+	// version the server accepts and must be upgraded.
+	ErrorCodeClientOutdated ErrorCode = "client_outdated"
+	// ErrorCodeInvalidNonce means the registration nonce is malformed, expired
+	// or was issued by another server.
+	ErrorCodeInvalidNonce ErrorCode = "invalid_nonce"
+	// ErrorCodeNonceUsed means the registration nonce was already used.
+	ErrorCodeNonceUsed ErrorCode = "nonce_used"
+	// ErrorCodeInvalidProof means the proof of private key possession is
+	// invalid.
+	ErrorCodeInvalidProof ErrorCode = "invalid_proof"
+	// ErrorCodeProofUsed means the proof of private key possession was
+	// already used.
+	ErrorCodeProofUsed ErrorCode = "proof_used"
+	// ErrorCodeClockSkew means the request timestamp is too far from the
+	// server's clock.
+	ErrorCodeClockSkew ErrorCode = "clock_skew"
+	// ErrorCodeKeyInUse means the public key is in use by a client that
+	// proved possession of the private key, so it can only be registered with
+	// a proof.
+	ErrorCodeKeyInUse ErrorCode = "key_in_use"
+	// ErrorCodeTunnelIDInUse means the tunnel IP and URLs derived from the
+	// public key are in use by a connected client with a different key, because
+	// the hashes of the keys collide. Generate a new key.
+	ErrorCodeTunnelIDInUse ErrorCode = "tunnel_id_in_use"
+	// ErrorCodeRateLimited means the client sent too many requests. The
+	// Retry-After header says when to retry.
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	// ErrorCodeInvalidTunnelURL means the tunnel hostname couldn't be decoded.
+	ErrorCodeInvalidTunnelURL ErrorCode = "invalid_tunnel_url"
+	// ErrorCodePeerNotConnected means the tunnel's client isn't connected.
+	ErrorCodePeerNotConnected ErrorCode = "peer_not_connected"
+	// ErrorCodePeerDialFailed means the tunnel's client is registered but
+	// couldn't be reached.
+	ErrorCodePeerDialFailed ErrorCode = "peer_dial_failed"
+	// ErrorCodeShuttingDown means the server is shutting down.
+	ErrorCodeShuttingDown ErrorCode = "shutting_down"
+	// ErrorCodeInternal means the server failed to handle the request.
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
+// ValidationError describes a problem with a single field of a request.
+type ValidationError struct {
+	// Field is the JSON name of the field.
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+// Sentinel errors that API errors can be matched against with errors.Is. An
+// *Error can match more than one, e.g. an unsupported version error is also
+// an ErrInvalidRequest. Errors from servers that don't send codes are matched
+// by their status code where possible.
+var (
+	// ErrNotFound matches 404 responses.
+	ErrNotFound = xerrors.New("not found")
+	// ErrInvalidRequest matches 400 responses.
+	ErrInvalidRequest = xerrors.New("invalid request")
+	// ErrUnsupportedVersion matches errors for tunnel versions the server
+	// doesn't support.
+	ErrUnsupportedVersion = xerrors.New("unsupported tunnel version")
+	// ErrClientOutdated matches errors for clients that are older than the
+	// minimum version the server accepts. The error's message says where to
+	// download a newer version.
+	ErrClientOutdated = xerrors.New("client is outdated")
+	// ErrUnauthorized matches 401 responses, e.g. for invalid proofs or
+	// nonces.
+	ErrUnauthorized = xerrors.New("unauthorized")
+	// ErrKeyInUse matches errors for public keys that can only be registered
+	// with a proof of private key possession.
+	ErrKeyInUse = xerrors.New("public key is in use")
+	// ErrTunnelIDInUse matches errors for public keys whose tunnel IP and URLs
+	// are in use by another key.
+	ErrTunnelIDInUse = xerrors.New("tunnel identifier is in use by another key")
+	// ErrRateLimited matches 429 responses. Use RetryAfter to find out how
+	// long to wait before retrying.
+	ErrRateLimited = xerrors.New("rate limited")
+	// ErrServerError matches 5xx responses.
+	ErrServerError = xerrors.New("server error")
+)
+
+// Is reports whether the error matches one of the sentinel errors in this
+// package.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Code == ErrorCodeNotFound || e.statusCode == http.StatusNotFound
+	case ErrInvalidRequest:
+		return e.statusCode == http.StatusBadRequest
+	case ErrUnsupportedVersion:
+		return e.Code == ErrorCodeUnsupportedVersion
+	case ErrClientOutdated:
+		return e.Code == ErrorCodeClientOutdated
+	case ErrUnauthorized:
+		return e.statusCode == http.StatusUnauthorized
+	case ErrKeyInUse:
+		return e.Code == ErrorCodeKeyInUse
+	case ErrTunnelIDInUse:
+		return e.Code == ErrorCodeTunnelIDInUse
+	case ErrRateLimited:
+		return e.Code == ErrorCodeRateLimited || e.statusCode == http.StatusTooManyRequests
+	case ErrServerError:
+		return e.statusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// RetryAfter returns how long the server asked the client to wait before
+// retrying if err is or wraps an *Error, e.g. one that matches
+// ErrRateLimited. It returns zero otherwise.
+func RetryAfter(err error) time.Duration {
+	var sdkErr *Error
+	if xerrors.As(err, &sdkErr) {
+		return sdkErr.RetryAfter()
+	}
+	return 0
+}
+
+// Validations returns the field-level validation errors if err is or wraps
+// an *Error.
+func Validations(err error) []ValidationError {
+	var sdkErr *Error
+	if xerrors.As(err, &sdkErr) {
+		return sdkErr.Validations
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package tunnelsdk
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/xerrors"
+)
+
+var newHostnameEncoder = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// PublicKeyToIPAndURLs returns the IP address within networkPrefix that
+// corresponds to the given wireguard public key, as well as all accepted tunnel
+// URLs for the key under baseURL.
+//
+// We support an older 32 character format ("old format") and a newer 12
+// character format ("good format") which is preferred. The first URL returned
+// should be considered "preferred", and all other URLs are provided for
+// compatibility with older deployments only. The "good format" is preferred as
+// it's shorter to avoid issues with hostname length limits when apps prefixes
+// are added to the equation.
+//
+// "good format":
+//
+//	Take the first 8 bytes of the hash of the public key, and convert to
+//	base32.
+//
+// "old format":
+//
+//	Take the network prefix, and create a new address filling the last n bytes
+//	with the first n bytes of the hash of the public key. Then convert to hex.
+//
+// IPv4 networks are too small to derive IPs from the hash, so the server
+// assigns client IPs instead. For IPv4 network prefixes the returned IP is
+// invalid and only the "good format" URL is returned.
+func PublicKeyToIPAndURLs(publicKey device.NoisePublicKey, networkPrefix netip.Prefix, baseURL *url.URL, version TunnelVersion) (netip.Addr, []*url.URL) {
+	return KeyHashToIPAndURLs(PublicKeyHash(publicKey), networkPrefix, baseURL, version)
+}
+
+// PublicKeyHash returns the hash of a wireguard public key that tunnel IPs and
+// URLs are derived from.
+func PublicKeyHash(publicKey device.NoisePublicKey) [sha256.Size]byte {
+	return sha256.Sum256(publicKey[:])
+}
+
+// KeyHashToIPAndURLs is like PublicKeyToIPAndURLs, but takes the hash of the
+// public key as returned by PublicKeyHash.
+func KeyHashToIPAndURLs(keyHash [sha256.Size]byte, networkPrefix netip.Prefix, baseURL *url.URL, version TunnelVersion) (netip.Addr, []*url.URL) {
+	// Good format:
+	goodFormatBytes := make([]byte, 8)
+	copy(goodFormatBytes, keyHash[:8])
+	goodFormat := newHostnameEncoder.EncodeToString(goodFormatBytes)
+	goodFormatURL := *baseURL
+	goodFormatURL.Host = strings.ToLower(goodFormat) + "." + goodFormatURL.Host
+
+	if networkPrefix.Addr().Is4() {
+		return netip.Addr{}, []*url.URL{&goodFormatURL}
+	}
+
+	// IPv6 address:
+	// For the IP address, we take the first 64 bits of the network prefix and
+	// the first 64 bits of the hash of the public key.
+	addrBytes := networkPrefix.Addr().As16()
+	copy(addrBytes[8:], keyHash[:8])
+
+	// Old format:
+	oldFormatBytes := make([]byte, 16)
+	copy(oldFormatBytes, addrBytes[:])
+	prefixLenBytes := networkPrefix.Bits() / 8
+	copy(oldFormatBytes[prefixLenBytes:], keyHash[:16-prefixLenBytes])
+	oldFormat := hex.EncodeToString(oldFormatBytes)
+	oldFormatURL := *baseURL
+	oldFormatURL.Host = strings.ToLower(oldFormat) + "." + oldFormatURL.Host
+
+	urls := []*url.URL{&goodFormatURL, &oldFormatURL}
+	if version == TunnelVersion1 {
+		// Return the old format first for backwards compatibility.
+		urls = []*url.URL{&oldFormatURL, &goodFormatURL}
+	}
+
+	return netip.AddrFrom16(addrBytes), urls
+}
+
+// HostnameToIP returns the wireguard IP address within networkPrefix that
+// corresponds to a given encoded hostname label as returned by
+// PublicKeyToIPAndURLs. IPs in IPv4 networks are assigned by the server, so
+// they can't be derived from the hostname.
+func HostnameToIP(hostname string, networkPrefix netip.Prefix) (netip.Addr, error) {
+	if networkPrefix.Addr().Is4() {
+		return netip.Addr{}, xerrors.Errorf("client IPs in IPv4 network %s are assigned by the server", networkPrefix)
+	}
+
+	var addrLast8Bytes []byte
+
+	if len(hostname) == 32 {
+		// "Old format":
+		decoded, err := hex.DecodeString(hostname)
+		if err != nil {
+			return netip.Addr{}, xerrors.Errorf("decode old hostname %q as hex: %w", hostname, err)
+		}
+		if len(decoded) != 16 {
+			return netip.Addr{}, xerrors.Errorf("invalid old hostname length: got %d, expected 16", len(decoded))
+		}
+
+		// Even though the hostname will have the entire old IP address, we only
+		// care about the first 8 bytes after the prefix length.
+		prefixLenBytes := networkPrefix.Bits() / 8
+		addrLast8Bytes = decoded[prefixLenBytes : prefixLenBytes+8]
+	} else {
+		// "Good format":
+		decoded, err := newHostnameEncoder.DecodeString(strings.ToUpper(hostname))
+		if err != nil {
+			return netip.Addr{}, xerrors.Errorf("decode new hostname %q as base32: %w", hostname, err)
+		}
+		if len(decoded) != 8 {
+			return netip.Addr{}, xerrors.Errorf("invalid new hostname length: got %d, expected 8", len(decoded))
+		}
+
+		addrLast8Bytes = decoded
+	}
+
+	if addrLast8Bytes == nil {
+		return netip.Addr{}, xerrors.Errorf("invalid hostname %q, does not match new or old format", hostname)
+	}
+
+	addrBytes := networkPrefix.Addr().As16()
+	copy(addrBytes[8:], addrLast8Bytes[:])
+	return netip.AddrFrom16(addrBytes), nil
+}
@@ -0,0 +1,135 @@
+package tunnelsdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// AuthMode is a way for clients to authenticate registrations.
+type AuthMode string
+
+const (
+	// AuthModeNone means registrations only contain the client's public key.
+	// Used by TunnelVersion1 and TunnelVersion2.
+	AuthModeNone AuthMode = "none"
+	// AuthModeProof means registrations contain a proof of possession of the
+	// client's private key. Used by TunnelVersion3.
+	AuthModeProof AuthMode = "proof"
+)
+
+// ServerInfo describes the server's version, supported protocol versions and
+// features, and limits.
+type ServerInfo struct {
+	// Version is the semantic version of the server build.
+	Version string `json:"version"`
+	// TunnelVersions contains the tunnel versions accepted by the server in
+	// ascending order.
+	TunnelVersions    []TunnelVersion    `json:"tunnel_versions"`
+	Capabilities      ServerCapabilities `json:"capabilities"`
+	Limits            ServerLimits       `json:"limits"`
+	WireguardEndpoint string             `json:"wireguard_endpoint"`
+	// BaseURL is the URL that tunnel hostnames are subdomains of.
+	BaseURL string `json:"base_url"`
+	// WireguardNetworkPrefix is the network that client IPs are derived in.
+	// Together with BaseURL, it can be used with PublicKeyToIPAndURLs to find
+	// the IP and URLs of a key without registering it.
+	WireguardNetworkPrefix netip.Prefix `json:"wireguard_network_prefix"`
+}
+
+// ServerCapabilities contains the features enabled on the server.
+type ServerCapabilities struct {
+	// HTTP is true if the server proxies HTTP requests to tunnels.
+	HTTP bool `json:"http"`
+	// TCP is true if the server forwards raw TCP connections to tunnels.
+	TCP bool `json:"tcp"`
+	// UDP is true if the server forwards UDP packets to tunnels.
+	UDP bool `json:"udp"`
+	// AuthModes contains the accepted registration authentication modes.
+	AuthModes []AuthMode `json:"auth_modes"`
+	// VanityNames is true if clients can choose their tunnel hostnames.
+	VanityNames bool `json:"vanity_names"`
+}
+
+// ServerLimits contains the limits enforced by the server.
+type ServerLimits struct {
+	// APIRateLimit is the number of API requests allowed per client IP in
+	// each APIRateLimitWindow.
+	APIRateLimit       int           `json:"api_rate_limit"`
+	APIRateLimitWindow time.Duration `json:"api_rate_limit_window"`
+	// MaxRequestBodyBytes is the maximum size of proxied request bodies.
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes"`
+	// PeerRegisterInterval is how often clients are asked to re-register.
+	PeerRegisterInterval time.Duration `json:"peer_register_interval"`
+	// PeerTimeout is how long after the last registration a peer is removed.
+	PeerTimeout  time.Duration `json:"peer_timeout"`
+	WireguardMTU int           `json:"wireguard_mtu"`
+}
+
+// SupportsTunnelVersion returns true if the server accepts the tunnel version.
+func (i ServerInfo) SupportsTunnelVersion(version TunnelVersion) bool {
+	for _, v := range i.TunnelVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerInfo returns information about the server. Servers that predate the
+// info endpoint respond with a 404.
+func (c *Client) ServerInfo(ctx context.Context) (ServerInfo, error) {
+	res, err := c.Request(ctx, http.MethodGet, "/api/v2/info", nil)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ServerInfo{}, readBodyAsError(res)
+	}
+
+	var resp ServerInfo
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// negotiateVersion picks the tunnel version to use with the server. If
+// requested is zero, the latest version supported by both the client and the
+// server is used. Otherwise requested must be supported by the server.
+func negotiateVersion(info ServerInfo, requested TunnelVersion) (TunnelVersion, error) {
+	if requested != 0 {
+		if !info.SupportsTunnelVersion(requested) {
+			return 0, xerrors.Errorf("tunnel version %d is not supported by server %s, which supports versions %s",
+				requested, info.Version, formatVersions(info.TunnelVersions))
+		}
+		return requested, nil
+	}
+
+	var best TunnelVersion
+	for _, v := range info.TunnelVersions {
+		if v <= TunnelVersionLatest && v > best {
+			best = v
+		}
+	}
+	if best == 0 {
+		return 0, xerrors.Errorf("server %s supports tunnel versions %s, but this client only supports versions up to %d, please upgrade the client",
+			info.Version, formatVersions(info.TunnelVersions), TunnelVersionLatest)
+	}
+	return best, nil
+}
+
+func formatVersions(versions []TunnelVersion) string {
+	if len(versions) == 0 {
+		return "(none)"
+	}
+	strs := make([]string, len(versions))
+	for i, v := range versions {
+		strs[i] = fmt.Sprint(int(v))
+	}
+	return strings.Join(strs, ", ")
+}
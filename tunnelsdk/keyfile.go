@@ -0,0 +1,147 @@
+package tunnelsdk
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/xerrors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// encryptedKeyPrefix starts the header line of every encrypted key file. The
+// version follows it, so files written by newer versions can be told apart
+// from corrupt ones.
+const encryptedKeyPrefix = "wgtunnel-encrypted-key-"
+
+// encryptedKeyHeaderV1 is the header of version 1 encrypted key files. The
+// line after it holds the base64 encoded scrypt salt, XChaCha20-Poly1305 nonce
+// and sealed key. The header is used as additional data so it can't be
+// changed without failing authentication.
+const encryptedKeyHeaderV1 = encryptedKeyPrefix + "v1"
+
+// Version 1 scrypt parameters, the values recommended for interactive logins
+// in the scrypt documentation.
+const (
+	scryptSaltSize = 16
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+)
+
+// ErrIncorrectPassphrase is returned when an encrypted key can't be decrypted
+// with the given passphrase.
+var ErrIncorrectPassphrase = xerrors.New("incorrect passphrase or corrupt key file")
+
+// IsEncryptedPrivateKey returns true if data is an encrypted key file, as
+// written by EncryptPrivateKey.
+func IsEncryptedPrivateKey(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(encryptedKeyPrefix))
+}
+
+// EncryptPrivateKey returns the contents of a key file containing key
+// encrypted with passphrase. The key is encrypted with XChaCha20-Poly1305
+// using a key derived from the passphrase with scrypt.
+func EncryptPrivateKey(key Key, passphrase []byte) ([]byte, error) {
+	if !key.IsPrivate() {
+		return nil, xerrors.New("key must be a private key")
+	}
+	if len(passphrase) == 0 {
+		return nil, xerrors.New("passphrase must not be empty")
+	}
+
+	salt := make([]byte, scryptSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, xerrors.Errorf("generate salt: %w", err)
+	}
+	aead, err := keyFileAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, xerrors.Errorf("generate nonce: %w", err)
+	}
+
+	payload := make([]byte, 0, len(salt)+len(nonce)+len(key.k)+aead.Overhead())
+	payload = append(payload, salt...)
+	payload = append(payload, nonce...)
+	payload = aead.Seal(payload, nonce, key.k[:], []byte(encryptedKeyHeaderV1))
+	return []byte(encryptedKeyHeaderV1 + "\n" + base64.StdEncoding.EncodeToString(payload) + "\n"), nil
+}
+
+// DecryptPrivateKey decrypts a key file written by EncryptPrivateKey. It
+// returns ErrIncorrectPassphrase if the passphrase is wrong.
+func DecryptPrivateKey(data, passphrase []byte) (Key, error) {
+	header, body, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(header, encryptedKeyPrefix) {
+		return Key{}, xerrors.New("not an encrypted key file")
+	}
+	if header != encryptedKeyHeaderV1 {
+		return Key{}, xerrors.Errorf("unsupported encrypted key file version %q, upgrade to read it", strings.TrimPrefix(header, encryptedKeyPrefix))
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimSpace(body))
+	if err != nil {
+		return Key{}, xerrors.Errorf("decode encrypted key: %w", err)
+	}
+	if len(payload) < scryptSaltSize+chacha20poly1305.NonceSizeX {
+		return Key{}, xerrors.New("encrypted key is too short")
+	}
+	salt, payload := payload[:scryptSaltSize], payload[scryptSaltSize:]
+	nonce, sealed := payload[:chacha20poly1305.NonceSizeX], payload[chacha20poly1305.NonceSizeX:]
+
+	aead, err := keyFileAEAD(passphrase, salt)
+	if err != nil {
+		return Key{}, err
+	}
+	plain, err := aead.Open(nil, nonce, sealed, []byte(header))
+	if err != nil {
+		return Key{}, ErrIncorrectPassphrase
+	}
+	k, err := wgtypes.NewKey(plain)
+	if err != nil {
+		return Key{}, xerrors.Errorf("parse decrypted key: %w", err)
+	}
+	return Key{
+		k:         k,
+		isPrivate: true,
+	}, nil
+}
+
+// ParsePrivateKeyFile parses the contents of a key file, which is either a
+// base64 encoded key as accepted by ParsePrivateKey or an encrypted key. The
+// passphrase function is only called for encrypted keys, and may be nil if
+// encrypted keys aren't supported by the caller.
+func ParsePrivateKeyFile(data []byte, passphrase func() ([]byte, error)) (Key, error) {
+	if !IsEncryptedPrivateKey(data) {
+		return ParsePrivateKey(strings.TrimSpace(string(data)))
+	}
+	if passphrase == nil {
+		return Key{}, xerrors.New("key is encrypted but no passphrase was provided")
+	}
+	p, err := passphrase()
+	if err != nil {
+		return Key{}, xerrors.Errorf("get passphrase: %w", err)
+	}
+	return DecryptPrivateKey(data, p)
+}
+
+func keyFileAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, xerrors.Errorf("derive encryption key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, xerrors.Errorf("create cipher: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,142 @@
+package tunnelsdk
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// tunnelListener is a net.Listener that stays usable while the underlying
+// wireguard netstack is replaced. Connections accepted by each netstack
+// listener are funneled into a single channel.
+//
+// Accepted connections are tracked until they're closed so they can be
+// drained on shutdown.
+type tunnelListener struct {
+	addrMu sync.Mutex
+	addr   net.Addr
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	activeMu sync.Mutex
+	active   map[*trackedConn]struct{}
+	// activeChanged is closed and replaced whenever a tracked connection is
+	// closed.
+	activeChanged chan struct{}
+}
+
+var _ net.Listener = &tunnelListener{}
+
+func newTunnelListener() *tunnelListener {
+	return &tunnelListener{
+		conns:         make(chan net.Conn),
+		closed:        make(chan struct{}),
+		active:        make(map[*trackedConn]struct{}),
+		activeChanged: make(chan struct{}),
+	}
+}
+
+// serve accepts connections from l until it is closed and hands them to
+// callers of Accept. The caller is responsible for closing l.
+func (t *tunnelListener) serve(l net.Listener) {
+	t.addrMu.Lock()
+	t.addr = l.Addr()
+	t.addrMu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			select {
+			case t.conns <- conn:
+			case <-t.closed:
+				_ = conn.Close()
+				return
+			}
+		}
+	}()
+}
+
+func (t *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-t.conns:
+		tc := &trackedConn{Conn: conn, l: t}
+		t.activeMu.Lock()
+		t.active[tc] = struct{}{}
+		t.activeMu.Unlock()
+		return tc, nil
+	case <-t.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *tunnelListener) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+func (t *tunnelListener) Addr() net.Addr {
+	t.addrMu.Lock()
+	defer t.addrMu.Unlock()
+	return t.addr
+}
+
+// drain waits until all accepted connections have been closed. If ctx expires
+// first, the remaining connections are closed and ctx's error is returned.
+func (t *tunnelListener) drain(ctx context.Context) error {
+	for {
+		t.activeMu.Lock()
+		n, changed := len(t.active), t.activeChanged
+		t.activeMu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			t.activeMu.Lock()
+			conns := make([]*trackedConn, 0, len(t.active))
+			for tc := range t.active {
+				conns = append(conns, tc)
+			}
+			t.activeMu.Unlock()
+			for _, tc := range conns {
+				_ = tc.Close()
+			}
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (t *tunnelListener) untrack(tc *trackedConn) {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+
+	delete(t.active, tc)
+	close(t.activeChanged)
+	t.activeChanged = make(chan struct{})
+}
+
+// trackedConn removes itself from the listener's active connections when
+// closed.
+type trackedConn struct {
+	net.Conn
+
+	l         *tunnelListener
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.l.untrack(c)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,59 @@
+package tunnelsdk
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/xerrors"
+)
+
+// ProofMaxClockSkew is the maximum difference between the timestamp in a
+// proof and the server's clock.
+const ProofMaxClockSkew = 2 * time.Minute
+
+const proofInfo = "wgtunnel client proof v1"
+
+// ProofMAC computes a MAC over message that proves possession of a wireguard
+// private key to the holder of the peer's private key, without revealing
+// either key.
+//
+// The MAC key is derived with HKDF-SHA256 from the X25519 shared secret
+// between privateKey and peerPublicKey, so the client (client private key,
+// server public key) and the server (server private key, client public key)
+// derive the same MAC key.
+func ProofMAC(privateKey Key, peerPublicKey device.NoisePublicKey, message []byte) ([]byte, error) {
+	if !privateKey.IsPrivate() {
+		return nil, xerrors.New("proof requires a private key")
+	}
+
+	shared, err := curve25519.X25519(privateKey.k[:], peerPublicKey[:])
+	if err != nil {
+		// X25519 returns an error for low order points, which would result in
+		// an all-zero shared secret.
+		return nil, xerrors.Errorf("compute shared secret: %w", err)
+	}
+
+	macKey := make([]byte, sha256.Size)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, nil, []byte(proofInfo)), macKey)
+	if err != nil {
+		return nil, xerrors.Errorf("derive proof key: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	_, _ = mac.Write(message)
+	return mac.Sum(nil), nil
+}
+
+// VerifyProofMAC checks a MAC created by ProofMAC in constant time.
+func VerifyProofMAC(privateKey Key, peerPublicKey device.NoisePublicKey, message, proof []byte) bool {
+	expected, err := ProofMAC(privateKey, peerPublicKey, message)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, proof)
+}
@@ -0,0 +1,227 @@
+package tunnelsdk
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/xerrors"
+)
+
+// TunnelState is the health of the tunnel's wireguard session.
+type TunnelState string
+
+const (
+	// TunnelStateRegistering means the tunnel has not completed its initial
+	// registration with the server yet.
+	TunnelStateRegistering TunnelState = "registering"
+	// TunnelStateHandshaking means the tunnel is registered but has not
+	// completed a wireguard handshake with the current server peer yet.
+	TunnelStateHandshaking TunnelState = "handshaking"
+	// TunnelStateConnected means the tunnel is registered and has a recent
+	// wireguard handshake.
+	TunnelStateConnected TunnelState = "connected"
+	// TunnelStateDegraded means the last re-registration failed or the last
+	// wireguard handshake is too old for the session to still be valid.
+	TunnelStateDegraded TunnelState = "degraded"
+	// TunnelStateClosed means the tunnel has been closed.
+	TunnelStateClosed TunnelState = "closed"
+)
+
+const (
+	// handshakeStaleAfter is how long after the last handshake the wireguard
+	// session is considered dead. Wireguard rejects sessions older than 180s
+	// and re-handshakes every 120s while traffic (or keepalives) flow.
+	handshakeStaleAfter = 180 * time.Second
+	// statePollInterval is how often the wireguard device is polled for
+	// handshake changes.
+	statePollInterval = 2 * time.Second
+)
+
+// TunnelStats contains connection statistics for a tunnel.
+type TunnelStats struct {
+	State TunnelState
+	// LastHandshake is the time of the last completed wireguard handshake with
+	// the server, or the zero time if there hasn't been one with the current
+	// server peer.
+	LastHandshake time.Time
+	// RxBytes and TxBytes are the number of bytes received from and sent to
+	// the server over wireguard since the tunnel was launched.
+	RxBytes uint64
+	TxBytes uint64
+	// Endpoint is the server's current wireguard endpoint.
+	Endpoint string
+	// LastRegistration is the time of the last successful registration.
+	LastRegistration time.Time
+	// LastRegistrationError is the error from the last registration attempt,
+	// or nil if it succeeded.
+	LastRegistrationError error
+}
+
+// peerStats is the subset of the wireguard IPC output we care about for the
+// server peer.
+type peerStats struct {
+	lastHandshake time.Time
+	rxBytes       uint64
+	txBytes       uint64
+	endpoint      string
+}
+
+// serverPeerStats reads the stats of the (only) peer from the device.
+func serverPeerStats(dev *device.Device) (peerStats, error) {
+	out, err := dev.IpcGet()
+	if err != nil {
+		return peerStats{}, xerrors.Errorf("get wireguard device config: %w", err)
+	}
+
+	var (
+		stats      peerStats
+		sec, nsec  int64
+		scanner    = bufio.NewScanner(strings.NewReader(out))
+		parseError error
+	)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "last_handshake_time_sec":
+			sec, err = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, err = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			stats.rxBytes, err = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			stats.txBytes, err = strconv.ParseUint(value, 10, 64)
+		case "endpoint":
+			stats.endpoint = value
+		}
+		if err != nil && parseError == nil {
+			parseError = xerrors.Errorf("parse %q: %w", key, err)
+		}
+	}
+	if parseError != nil {
+		return peerStats{}, parseError
+	}
+	if sec != 0 || nsec != 0 {
+		stats.lastHandshake = time.Unix(sec, nsec)
+	}
+
+	return stats, nil
+}
+
+// State returns the current state of the tunnel.
+func (t *Tunnel) State() TunnelState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// Stats returns the current connection statistics of the tunnel.
+func (t *Tunnel) Stats() TunnelStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := TunnelStats{
+		State:                 t.state,
+		RxBytes:               t.rxBase,
+		TxBytes:               t.txBase,
+		Endpoint:              t.endpoint,
+		LastRegistration:      t.lastRegistration,
+		LastRegistrationError: t.lastRegistrationErr,
+	}
+	if t.state == TunnelStateClosed {
+		return stats
+	}
+
+	ps, err := serverPeerStats(t.dev)
+	if err != nil {
+		return stats
+	}
+	stats.LastHandshake = ps.lastHandshake
+	stats.RxBytes += ps.rxBytes
+	stats.TxBytes += ps.txBytes
+	if ps.endpoint != "" {
+		stats.Endpoint = ps.endpoint
+	}
+	return stats
+}
+
+// updateState recomputes the tunnel state and emits an event if it changed.
+func (t *Tunnel) updateState() {
+	// Serialize state updates so events are emitted in order.
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+
+	t.mu.Lock()
+	prev := t.state
+	next := prev
+	if prev != TunnelStateClosed {
+		var lastHandshake time.Time
+		ps, err := serverPeerStats(t.dev)
+		if err == nil {
+			lastHandshake = ps.lastHandshake
+		}
+
+		switch {
+		case t.lastRegistrationErr != nil:
+			next = TunnelStateDegraded
+		case lastHandshake.IsZero():
+			next = TunnelStateHandshaking
+		case time.Since(lastHandshake) > handshakeStaleAfter:
+			next = TunnelStateDegraded
+		default:
+			next = TunnelStateConnected
+		}
+	}
+	t.state = next
+	t.mu.Unlock()
+
+	if next != prev {
+		t.emit(TunnelEvent{
+			Type:          TunnelEventStateChanged,
+			State:         next,
+			PreviousState: prev,
+		})
+	}
+}
+
+// setClosedState marks the tunnel as closed and emits a state change event.
+func (t *Tunnel) setClosedState() {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+
+	t.mu.Lock()
+	prev := t.state
+	t.state = TunnelStateClosed
+	t.mu.Unlock()
+
+	if prev != TunnelStateClosed {
+		t.emit(TunnelEvent{
+			Type:          TunnelEventStateChanged,
+			State:         TunnelStateClosed,
+			PreviousState: prev,
+		})
+	}
+}
+
+// monitorState periodically polls the wireguard device for handshake changes
+// until the tunnel is closed.
+func (t *Tunnel) monitorState() {
+	ticker := time.NewTicker(statePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.updateState()
+	}
+}
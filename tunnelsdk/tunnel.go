@@ -5,12 +5,13 @@ import (
 	"crypto/rand"
 	"crypto/sha512"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/tailscale/wireguard-go/conn"
@@ -26,6 +27,18 @@ import (
 // listener is listening on.
 const TunnelPort = 8090
 
+// deregisterTimeout bounds how long closing a tunnel waits for the server to
+// acknowledge the deregistration.
+const deregisterTimeout = 5 * time.Second
+
+// persistentKeepaliveInterval is the keepalive interval in seconds for the
+// server peer. It keeps NAT mappings open so the server can reach the client.
+const persistentKeepaliveInterval = 21
+
+// keyRotationJitter is the maximum random delay after a scheduled server key
+// rotation before the client re-registers to pick up the new key.
+const keyRotationJitter = 5 * time.Second
+
 // TunnelVersion is the version of the tunnel URL specification.
 type TunnelVersion int
 
@@ -36,8 +49,13 @@ const (
 	// TunnelVersion2 is the "new style" tunnel URL. Each hostname base is ~12
 	// characters long and is base32 encoded.
 	TunnelVersion2 TunnelVersion = 2
+	// TunnelVersion3 uses the same URLs as TunnelVersion2, but registration
+	// requires proof that the client holds the private key for the public key
+	// it registers. Once a key has been registered with proof, the server
+	// rejects registrations of that key without proof while it's connected.
+	TunnelVersion3 TunnelVersion = 3
 
-	TunnelVersionLatest = TunnelVersion2
+	TunnelVersionLatest = TunnelVersion3
 )
 
 // Key is a Wireguard private or public key.
@@ -167,38 +185,87 @@ func (k Key) PublicKey() (Key, error) {
 type TunnelConfig struct {
 	Log slog.Logger
 	// Version denotes which version of the tunnel URL specification to use.
-	// Undefined version is treated as the latest version.
+	// Undefined version is treated as the latest version supported by both
+	// the client and the server. If set, launching the tunnel fails if the
+	// server doesn't support the version.
 	Version TunnelVersion
 	// PrivateKey is the Wireguard private key. You can use GeneratePrivateKey
 	// to generate a new key. It should be stored in a safe place for future
 	// tunnel sessions, otherwise you will get a new hostname.
 	PrivateKey Key
+	// EventHandler is called when the tunnel's connection changes, e.g. when
+	// the server's key or endpoint changes and the wireguard device is
+	// reconfigured. It's called synchronously from the tunnel's background
+	// goroutines, so it must not block or call methods on the Tunnel.
+	// Optional.
+	EventHandler func(TunnelEvent)
+}
+
+// TunnelEventType is the type of a TunnelEvent.
+type TunnelEventType string
+
+const (
+	// TunnelEventRegisterFailed is emitted when periodic re-registration
+	// fails. The tunnel will keep retrying.
+	TunnelEventRegisterFailed TunnelEventType = "register_failed"
+	// TunnelEventReconfigured is emitted when the server's public key,
+	// endpoint or IP changed and the server peer was updated in place.
+	TunnelEventReconfigured TunnelEventType = "reconfigured"
+	// TunnelEventRebuilt is emitted when the client IP or MTU changed and the
+	// wireguard device and network stack were recreated. Connections accepted
+	// before the rebuild are closed, but the tunnel's Listener stays usable.
+	TunnelEventRebuilt TunnelEventType = "rebuilt"
+	// TunnelEventReconfigureFailed is emitted when a change in the server's
+	// registration response could not be applied. The change will be retried
+	// on the next re-registration.
+	TunnelEventReconfigureFailed TunnelEventType = "reconfigure_failed"
+	// TunnelEventStateChanged is emitted when the tunnel's state changes. See
+	// TunnelState.
+	TunnelEventStateChanged TunnelEventType = "state_changed"
+)
+
+// TunnelEvent describes a change in the tunnel's connection.
+type TunnelEvent struct {
+	Type TunnelEventType
+	Time time.Time
+	// Changes contains the names of the registration fields that changed, for
+	// reconfigure and rebuild events.
+	Changes []string
+	// Err is set for failure events.
+	Err error
+	// State and PreviousState are set for state change events.
+	State         TunnelState
+	PreviousState TunnelState
 }
 
 // LaunchTunnel makes a request to the tunneld server to register the client's
 // tunnel using the client's public key, then establishes a wireguard connection
 // to the server and returns a *Tunnel. Connections can be accepted from
 // tunnel.Listener.
+//
+// Before registering, the server's info is checked to pick a tunnel version
+// both sides support. An error is returned if there is none.
+//
+// The client re-registers periodically in the background. If the server's
+// registration response changes (e.g. the server restarted with a new key or
+// moved to a new endpoint), the wireguard device is reconfigured or rebuilt in
+// place while tunnel.Listener stays usable.
 func (c *Client) LaunchTunnel(ctx context.Context, cfg TunnelConfig) (*Tunnel, error) {
-	if cfg.Version == 0 {
-		cfg.Version = TunnelVersionLatest
+	if cfg.EventHandler != nil {
+		cfg.EventHandler(TunnelEvent{
+			Type:  TunnelEventStateChanged,
+			Time:  time.Now(),
+			State: TunnelStateRegistering,
+		})
 	}
 
-	pubKey := cfg.PrivateKey.NoisePublicKey()
-
-	res, err := c.ClientRegister(ctx, ClientRegisterRequest{
-		Version:   cfg.Version,
-		PublicKey: pubKey,
-	})
+	res, err := c.Register(ctx, cfg)
 	if err != nil {
-		return nil, xerrors.Errorf("initial client registration: %w", err)
-	}
-	if len(res.TunnelURLs) == 0 {
-		return nil, xerrors.Errorf("no tunnel urls returned from server")
-	}
-	if res.ReregisterWait <= 0 {
-		return nil, xerrors.Errorf("invalid reregister wait time: %s", res.ReregisterWait)
+		return nil, err
 	}
+	// Use the version the server accepted for re-registrations, which may be
+	// lower if the server doesn't support the requested version.
+	cfg.Version = res.Version
 
 	primaryURL, err := url.Parse(res.TunnelURLs[0])
 	if err != nil {
@@ -213,61 +280,129 @@ func (c *Client) LaunchTunnel(ctx context.Context, cfg TunnelConfig) (*Tunnel, e
 		}
 	}
 
-	// Ensure the returned server endpoint from the API is an IP address and not
-	// a hostname to avoid constant DNS lookups.
-	host, port, err := net.SplitHostPort(res.ServerEndpoint)
+	wgEndpoint, err := resolveEndpoint(res.ServerEndpoint)
 	if err != nil {
-		return nil, xerrors.Errorf("parse server endpoint: %w", err)
+		return nil, err
 	}
-	wgIP, err := net.ResolveIPAddr("ip", host)
+
+	tunnelCtx, tunnelCancel := context.WithCancel(context.Background())
+	t := &Tunnel{
+		client:   c,
+		cfg:      cfg,
+		ctx:      tunnelCtx,
+		cancel:   tunnelCancel,
+		closed:   make(chan struct{}),
+		listener: newTunnelListener(),
+		reg:      res,
+		endpoint: wgEndpoint,
+
+		state:            TunnelStateRegistering,
+		lastRegistration: time.Now(),
+
+		URL:       primaryURL,
+		OtherURLs: otherURLs,
+	}
+	t.Listener = t.listener
+
+	t.dev, t.netListener, err = t.newDevice(ctx, res, wgEndpoint)
 	if err != nil {
-		return nil, xerrors.Errorf("resolve endpoint: %w", err)
+		tunnelCancel()
+		return nil, err
 	}
-	wgEndpoint := net.JoinHostPort(wgIP.String(), port)
+	t.listener.serve(t.netListener)
+	t.updateState()
 
-	// Start re-registering the client every 30 seconds.
-	returnedOK := false
-	tunnelCtx, tunnelCancel := context.WithCancel(context.Background())
-	defer func() {
-		if !returnedOK {
-			tunnelCancel()
-		}
-	}()
-	go func() {
-		ticker := time.NewTicker(res.ReregisterWait)
-		defer ticker.Stop()
+	// Start re-registering the client and monitoring the connection in the
+	// background.
+	go t.reregisterLoop(registrationWait(res))
+	go t.monitorState()
 
+	go func() {
+		defer close(t.closed)
 		for {
+			t.mu.Lock()
+			dev := t.dev
+			t.mu.Unlock()
+
 			select {
-			case <-tunnelCtx.Done():
+			case <-ctx.Done():
+				t.close()
 				return
-			case <-ticker.C:
-			}
-
-			ctx, cancel := context.WithTimeout(tunnelCtx, 10*time.Second)
-			res, err := c.ClientRegister(ctx, ClientRegisterRequest{
-				PublicKey: pubKey,
-			})
-			if err != nil && !errors.Is(err, context.Canceled) {
-				cfg.Log.Warn(ctx, "periodically re-register tunnel", slog.Error(err))
-			}
-
-			// If we failed to re-register, try again in 30 seconds plus a
-			// random amount of time between 0 and 30 seconds.
-			if res.ReregisterWait <= 0 {
-				res.ReregisterWait = 30 * time.Second
-				i, err := rand.Int(rand.Reader, big.NewInt(30))
-				if err != nil {
-					i = big.NewInt(30)
+			case <-dev.Wait():
+				t.mu.Lock()
+				replaced := t.dev != dev
+				t.mu.Unlock()
+				if replaced {
+					continue
 				}
-				res.ReregisterWait += time.Duration(i.Int64()) * time.Second
+				t.close()
+				return
 			}
-
-			ticker.Reset(res.ReregisterWait)
-			cancel()
 		}
 	}()
 
+	return t, nil
+}
+
+// Register checks the server's info to pick a tunnel version both sides
+// support and registers cfg.PrivateKey, like LaunchTunnel does, but doesn't
+// create a wireguard device. The returned response's Version is the version
+// the server accepted.
+//
+// Use Register with ClientRegisterResponse.WireguardConfig and KeepRegistered
+// to run the tunnel on a wireguard interface managed outside of the SDK.
+func (c *Client) Register(ctx context.Context, cfg TunnelConfig) (ClientRegisterResponse, error) {
+	// Only servers that predate the info endpoint may not support proofs.
+	fallback := false
+	info, err := c.ServerInfo(ctx)
+	switch {
+	case err == nil:
+		cfg.Version, err = negotiateVersion(info, cfg.Version)
+		if err != nil {
+			return ClientRegisterResponse{}, xerrors.Errorf("incompatible server: %w", err)
+		}
+	case isStatusCode(err, http.StatusNotFound):
+		// The server predates the info endpoint, registration falls back to
+		// an older version if necessary.
+		if cfg.Version == 0 {
+			cfg.Version = TunnelVersionLatest
+		}
+		fallback = true
+	default:
+		return ClientRegisterResponse{}, xerrors.Errorf("get server info: %w", err)
+	}
+
+	res, err := c.registerKey(ctx, cfg.Version, cfg.PrivateKey, fallback)
+	if err != nil {
+		return ClientRegisterResponse{}, xerrors.Errorf("initial client registration: %w", err)
+	}
+	if len(res.TunnelURLs) == 0 {
+		return ClientRegisterResponse{}, xerrors.Errorf("no tunnel urls returned from server")
+	}
+	if res.ReregisterWait <= 0 {
+		return ClientRegisterResponse{}, xerrors.Errorf("invalid reregister wait time: %s", res.ReregisterWait)
+	}
+	return res, nil
+}
+
+// resolveEndpoint ensures the returned server endpoint from the API is an IP
+// address and not a hostname to avoid constant DNS lookups from the wireguard
+// device.
+func resolveEndpoint(serverEndpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(serverEndpoint)
+	if err != nil {
+		return "", xerrors.Errorf("parse server endpoint: %w", err)
+	}
+	wgIP, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return "", xerrors.Errorf("resolve endpoint: %w", err)
+	}
+	return net.JoinHostPort(wgIP.String(), port), nil
+}
+
+// newDevice creates, configures and starts a wireguard device and network
+// stack for the given registration, and listens on the tunnel port.
+func (t *Tunnel) newDevice(ctx context.Context, res ClientRegisterResponse, wgEndpoint string) (*device.Device, net.Listener, error) {
 	// Create wireguard virtual network stack.
 	tun, tnet, err := netstack.CreateNetTUN(
 		[]netip.Addr{res.ClientIP},
@@ -277,11 +412,11 @@ func (c *Client) LaunchTunnel(ctx context.Context, cfg TunnelConfig) (*Tunnel, e
 		res.WireguardMTU,
 	)
 	if err != nil {
-		return nil, xerrors.Errorf("create net TUN: %w", err)
+		return nil, nil, xerrors.Errorf("create net TUN: %w", err)
 	}
 
 	// Create wireguard device, configure it and start it.
-	deviceLogger := cfg.Log.Named("wireguard_device")
+	deviceLogger := t.cfg.Log.Named("wireguard_device")
 	dlog := &device.Logger{
 		Verbosef: func(format string, args ...any) {
 			deviceLogger.Debug(ctx, fmt.Sprintf(format, args...))
@@ -292,72 +427,383 @@ func (c *Client) LaunchTunnel(ctx context.Context, cfg TunnelConfig) (*Tunnel, e
 	}
 	dev := device.NewDevice(tun, conn.NewDefaultBind(), dlog)
 	err = dev.IpcSet(fmt.Sprintf(`private_key=%s
-public_key=%s
-endpoint=%s
-persistent_keepalive_interval=21
-allowed_ip=%s/128`,
-		cfg.PrivateKey.HexString(),
-		hex.EncodeToString(res.ServerPublicKey[:]),
-		wgEndpoint,
-		res.ServerIP.String(),
+%s`,
+		t.cfg.PrivateKey.HexString(),
+		serverPeerConfig(res, wgEndpoint),
 	))
 	if err != nil {
-		return nil, xerrors.Errorf("configure wireguard ipc: %w", err)
+		dev.Close()
+		return nil, nil, xerrors.Errorf("configure wireguard ipc: %w", err)
 	}
 	err = dev.Up()
 	if err != nil {
-		return nil, xerrors.Errorf("wireguard device up: %w", err)
+		dev.Close()
+		return nil, nil, xerrors.Errorf("wireguard device up: %w", err)
 	}
 
 	// Create a listener on the static tunnel port.
 	wgListen, err := tnet.ListenTCP(&net.TCPAddr{Port: TunnelPort})
 	if err != nil {
-		return nil, xerrors.Errorf("wireguard device listen: %w", err)
+		closeDevice(dev)
+		return nil, nil, xerrors.Errorf("wireguard device listen: %w", err)
 	}
 
-	closed := make(chan struct{}, 1)
-	closeFn := func() {
-		tunnelCancel()
+	return dev, wgListen, nil
+}
 
-		_ = wgListen.Close()
-		// Remove peers before closing to avoid a race condition between
-		// dev.Close() and the peer goroutines which results in segfault.
-		dev.RemoveAllPeers()
-		dev.Close()
-	}
-	go func() {
-		defer close(closed)
+// serverPeerConfig returns the IPC configuration for the server peer.
+func serverPeerConfig(res ClientRegisterResponse, wgEndpoint string) string {
+	return fmt.Sprintf(`public_key=%s
+endpoint=%s
+persistent_keepalive_interval=%d
+allowed_ip=%s/%d`,
+		hex.EncodeToString(res.ServerPublicKey[:]),
+		wgEndpoint,
+		persistentKeepaliveInterval,
+		res.ServerIP.String(),
+		res.ServerIP.BitLen(),
+	)
+}
+
+func closeDevice(dev *device.Device) {
+	// Remove peers before closing to avoid a race condition between
+	// dev.Close() and the peer goroutines which results in segfault.
+	dev.RemoveAllPeers()
+	dev.Close()
+}
+
+func (t *Tunnel) reregisterLoop(wait time.Duration) {
+	ticker := time.NewTicker(wait)
+	defer ticker.Stop()
+
+	for {
 		select {
-		case <-ctx.Done():
-			closeFn()
-		case <-dev.Wait():
-			tunnelCancel()
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
 		}
-	}()
 
-	returnedOK = true
-	return &Tunnel{
-		closeFn:   closeFn,
-		closed:    closed,
-		URL:       primaryURL,
-		OtherURLs: otherURLs,
-		Listener:  wgListen,
-	}, nil
+		ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
+		res, err := t.client.registerKey(ctx, t.cfg.Version, t.cfg.PrivateKey, false)
+		cancel()
+		if t.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			t.cfg.Log.Warn(t.ctx, "periodically re-register tunnel", slog.Error(err))
+			t.emit(TunnelEvent{Type: TunnelEventRegisterFailed, Err: err})
+		} else {
+			t.applyRegistration(res)
+		}
+
+		t.mu.Lock()
+		t.lastRegistrationErr = err
+		if err == nil {
+			t.lastRegistration = time.Now()
+		}
+		t.mu.Unlock()
+		t.updateState()
+
+		ticker.Reset(nextRegistrationWait(res, err))
+	}
+}
+
+// nextRegistrationWait returns how long to wait before the next
+// re-registration after one that returned res and err.
+func nextRegistrationWait(res ClientRegisterResponse, err error) time.Duration {
+	if err == nil && res.ReregisterWait > 0 {
+		return registrationWait(res)
+	}
+
+	// If we failed to re-register, wait as long as the server asked us to, or
+	// 30 seconds if it didn't, plus a random amount of time of up to the same
+	// duration so clients don't retry in lockstep.
+	wait := RetryAfter(err)
+	if wait <= 0 {
+		wait = 30 * time.Second
+	}
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(wait)))
+	if err != nil {
+		i = big.NewInt(int64(wait))
+	}
+	return wait + time.Duration(i.Int64())
+}
+
+// registrationWait returns how long to wait before re-registering after a
+// successful registration. If the server is going to rotate its key before
+// then, the client re-registers shortly after the rotation so it can update
+// the server peer with the new key.
+func registrationWait(res ClientRegisterResponse) time.Duration {
+	wait := res.ReregisterWait
+	if res.ServerKeyRotationTime == nil {
+		return wait
+	}
+
+	untilRotation := time.Until(*res.ServerKeyRotationTime)
+	if untilRotation < 0 {
+		untilRotation = 0
+	}
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(keyRotationJitter)))
+	if err != nil {
+		i = big.NewInt(int64(keyRotationJitter))
+	}
+	untilRotation += time.Duration(i.Int64())
+
+	if untilRotation < wait {
+		return untilRotation
+	}
+	return wait
+}
+
+// applyRegistration compares a registration response against the one the
+// wireguard device is currently configured with, and reconfigures or rebuilds
+// the device if anything changed.
+func (t *Tunnel) applyRegistration(res ClientRegisterResponse) {
+	// Always re-resolve the endpoint in case the server's IP changed behind
+	// the same hostname.
+	wgEndpoint, err := resolveEndpoint(res.ServerEndpoint)
+	if err != nil {
+		t.cfg.Log.Warn(t.ctx, "resolve server endpoint", slog.F("endpoint", res.ServerEndpoint), slog.Error(err))
+		t.emit(TunnelEvent{Type: TunnelEventReconfigureFailed, Err: err})
+		return
+	}
+
+	t.mu.Lock()
+	prev, prevEndpoint := t.reg, t.endpoint
+	t.mu.Unlock()
+
+	changes, rebuild := registrationChanges(prev, res, prevEndpoint, wgEndpoint)
+	if len(changes) == 0 {
+		// Nothing to reconfigure, but keep the response so a next server key
+		// announced since the last change is used when deregistering.
+		t.mu.Lock()
+		t.reg = res
+		t.mu.Unlock()
+		return
+	}
+
+	log := t.cfg.Log.With(slog.F("changes", changes))
+	if rebuild {
+		err = t.rebuild(res, wgEndpoint)
+		if err != nil {
+			t.setNextServerKey(res)
+			log.Error(t.ctx, "rebuild wireguard device", slog.Error(err))
+			t.emit(TunnelEvent{Type: TunnelEventReconfigureFailed, Changes: changes, Err: err})
+			return
+		}
+		log.Info(t.ctx, "rebuilt wireguard device after server registration changed")
+		t.emit(TunnelEvent{Type: TunnelEventRebuilt, Changes: changes})
+		return
+	}
+
+	t.mu.Lock()
+	err = t.dev.IpcSet("replace_peers=true\n" + serverPeerConfig(res, wgEndpoint))
+	if err == nil {
+		t.reg = res
+		t.endpoint = wgEndpoint
+	}
+	t.mu.Unlock()
+	if err != nil {
+		t.setNextServerKey(res)
+		err = xerrors.Errorf("reconfigure server peer: %w", err)
+		log.Error(t.ctx, "reconfigure wireguard device", slog.Error(err))
+		t.emit(TunnelEvent{Type: TunnelEventReconfigureFailed, Changes: changes, Err: err})
+		return
+	}
+	log.Info(t.ctx, "reconfigured wireguard device after server registration changed")
+	t.emit(TunnelEvent{Type: TunnelEventReconfigured, Changes: changes})
+}
+
+// setNextServerKey stores the next server key from a registration that couldn't
+// be applied. The rest of the stored registration is kept so the changes are
+// retried after the next registration.
+func (t *Tunnel) setNextServerKey(res ClientRegisterResponse) {
+	t.mu.Lock()
+	t.reg.NextServerPublicKey = res.NextServerPublicKey
+	t.reg.ServerKeyRotationTime = res.ServerKeyRotationTime
+	t.mu.Unlock()
+}
+
+// registrationChanges returns the names of the fields that differ between two
+// registration responses and affect the wireguard device. rebuild is true if
+// the device has to be recreated rather than reconfigured.
+func registrationChanges(prev, res ClientRegisterResponse, prevEndpoint, endpoint string) (changes []string, rebuild bool) {
+	if res.ClientIP != prev.ClientIP {
+		changes = append(changes, "client_ip")
+		rebuild = true
+	}
+	if res.WireguardMTU != prev.WireguardMTU {
+		changes = append(changes, "wireguard_mtu")
+		rebuild = true
+	}
+	if res.ServerPublicKey != prev.ServerPublicKey {
+		changes = append(changes, "server_public_key")
+	}
+	if endpoint != prevEndpoint {
+		changes = append(changes, "server_endpoint")
+	}
+	if res.ServerIP != prev.ServerIP {
+		changes = append(changes, "server_ip")
+	}
+	return changes, rebuild
+}
+
+// rebuild replaces the wireguard device and network stack with a new one
+// configured for the given registration.
+func (t *Tunnel) rebuild(res ClientRegisterResponse, wgEndpoint string) error {
+	dev, netListener, err := t.newDevice(t.ctx, res, wgEndpoint)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.ctx.Err() != nil {
+		t.mu.Unlock()
+		_ = netListener.Close()
+		closeDevice(dev)
+		return t.ctx.Err()
+	}
+	oldDev, oldListener := t.dev, t.netListener
+	// Carry the transfer counters of the old device over so they don't go
+	// backwards.
+	if ps, err := serverPeerStats(oldDev); err == nil {
+		t.rxBase += ps.rxBytes
+		t.txBase += ps.txBytes
+	}
+	t.dev, t.netListener = dev, netListener
+	t.reg = res
+	t.endpoint = wgEndpoint
+	t.listener.serve(netListener)
+	t.mu.Unlock()
+
+	_ = oldListener.Close()
+	closeDevice(oldDev)
+	return nil
+}
+
+func (t *Tunnel) emit(ev TunnelEvent) {
+	if t.cfg.EventHandler == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	t.cfg.EventHandler(ev)
 }
 
 type Tunnel struct {
-	closeFn   func()
-	closed    <-chan struct{}
+	client *Client
+	cfg    TunnelConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closeOnce      sync.Once
+	closed         chan struct{}
+	deregisterOnce sync.Once
+
+	// listener is handed out as Listener and outlives device rebuilds.
+	listener *tunnelListener
+
+	// stateMu serializes state updates. It's acquired before mu.
+	stateMu sync.Mutex
+
+	mu                  sync.Mutex
+	dev                 *device.Device
+	netListener         net.Listener
+	reg                 ClientRegisterResponse
+	endpoint            string
+	state               TunnelState
+	lastRegistration    time.Time
+	lastRegistrationErr error
+	// rxBase and txBase hold the transfer counters of devices replaced by
+	// rebuilds.
+	rxBase uint64
+	txBase uint64
+
 	URL       *url.URL
 	OtherURLs []*url.URL
 	Listener  net.Listener
 }
 
+func (t *Tunnel) close() {
+	t.closeOnce.Do(func() {
+		t.cancel()
+		_ = t.listener.Close()
+
+		t.mu.Lock()
+		_ = t.netListener.Close()
+		closeDevice(t.dev)
+		t.mu.Unlock()
+
+		t.setClosedState()
+	})
+}
+
+// Close closes the tunnel immediately, including any connections accepted from
+// Listener, and deregisters the client from the server. Deregistration is best
+// effort: failures are logged and the server will time out the peer instead.
+// Use Shutdown to drain connections first.
 func (t *Tunnel) Close() error {
-	t.closeFn()
+	t.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+	_ = t.deregister(ctx)
+	return nil
+}
+
+// Shutdown gracefully shuts down the tunnel. It stops accepting connections
+// and waits for connections already accepted from Listener to be closed. Once
+// drained, it closes the tunnel and deregisters the client from the server so
+// traffic stops being routed to the tunnel immediately.
+//
+// If ctx expires before all connections are closed, the remaining connections
+// are closed forcibly and ctx's error is returned. The tunnel is always closed
+// when Shutdown returns.
+func (t *Tunnel) Shutdown(ctx context.Context) error {
+	_ = t.listener.Close()
+	drainErr := t.listener.drain(ctx)
+
+	// Close before deregistering so the re-register loop can't register the
+	// client again.
+	t.close()
+
+	// Deregister even if draining timed out, but don't hang if the caller's
+	// context is already done.
+	deregisterCtx := ctx
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		deregisterCtx, cancel = context.WithTimeout(context.Background(), deregisterTimeout)
+		defer cancel()
+	}
+	err := t.deregister(deregisterCtx)
+
+	if drainErr != nil {
+		return xerrors.Errorf("drain connections: %w", drainErr)
+	}
+	if err != nil {
+		return xerrors.Errorf("deregister tunnel: %w", err)
+	}
 	return nil
 }
 
+// deregister removes the client's peer from the server. Only the first call
+// sends a request, later calls return nil. It must be called after close.
+func (t *Tunnel) deregister(ctx context.Context) error {
+	var err error
+	t.deregisterOnce.Do(func() {
+		t.mu.Lock()
+		serverPublicKey := t.reg.ProofServerPublicKey()
+		t.mu.Unlock()
+
+		err = t.client.ClientDeregister(ctx, t.cfg.PrivateKey, serverPublicKey)
+		if err != nil {
+			t.cfg.Log.Warn(ctx, "deregister tunnel", slog.Error(err))
+		}
+	})
+	return err
+}
+
 func (t *Tunnel) Wait() <-chan struct{} {
 	return t.closed
 }
@@ -0,0 +1,70 @@
+package tunnelsdk
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/device"
+	"golang.org/x/crypto/curve25519"
+)
+
+// ValidatePublicKey returns a problem with a client's wireguard public key, or
+// an empty string if the key is usable. The all-zero key and other low order
+// points are rejected, since every private key has the same shared secret with
+// them.
+func ValidatePublicKey(publicKey device.NoisePublicKey) string {
+	if publicKey == (device.NoisePublicKey{}) {
+		return "public key is required"
+	}
+	// X25519 fails if the result is all-zero, which is the case for every
+	// scalar when the point has low order.
+	_, err := curve25519.X25519(curve25519.Basepoint, publicKey[:])
+	if err != nil {
+		return "public key must not be a low order point"
+	}
+	return ""
+}
+
+// Validate returns the problems with the fields of the request that can be
+// found without looking at the server's state. Version 0 is accepted and
+// means the server's default. Versions newer than this package knows about are
+// left for the server to reject, since only it knows which versions it
+// supports.
+func (r ClientRegisterRequest) Validate() []ValidationError {
+	var validations []ValidationError
+	if detail := ValidatePublicKey(r.PublicKey); detail != "" {
+		validations = append(validations, ValidationError{Field: "public_key", Detail: detail})
+	}
+	if r.Version < 0 {
+		validations = append(validations, ValidationError{
+			Field:  "version",
+			Detail: fmt.Sprintf("version must not be negative, got %d", r.Version),
+		})
+	}
+	if r.Version >= TunnelVersion3 && len(r.Proof) != 0 && len(r.Proof) != sha256.Size {
+		validations = append(validations, ValidationError{
+			Field:  "proof",
+			Detail: fmt.Sprintf("proof must be %d bytes, got %d", sha256.Size, len(r.Proof)),
+		})
+	}
+	return validations
+}
+
+// Validate returns the problems with the fields of the request that can be
+// found without looking at the server's state.
+func (r ClientDeregisterRequest) Validate() []ValidationError {
+	var validations []ValidationError
+	if detail := ValidatePublicKey(r.PublicKey); detail != "" {
+		validations = append(validations, ValidationError{Field: "public_key", Detail: detail})
+	}
+	if r.Timestamp.IsZero() {
+		validations = append(validations, ValidationError{Field: "timestamp", Detail: "timestamp is required"})
+	}
+	if len(r.Proof) != sha256.Size {
+		validations = append(validations, ValidationError{
+			Field:  "proof",
+			Detail: fmt.Sprintf("proof must be %d bytes, got %d", sha256.Size, len(r.Proof)),
+		})
+	}
+	return validations
+}
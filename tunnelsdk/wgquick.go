@@ -0,0 +1,96 @@
+package tunnelsdk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// WireguardConfig returns a wg-quick compatible configuration for the
+// registration, so the tunnel can run on a kernel wireguard interface instead
+// of the userspace network stack created by LaunchTunnel. The server forwards
+// tunnel traffic to TunnelPort on ClientIP, so something must listen there
+// once the interface is up.
+//
+// The configuration is only valid while the client stays registered, see
+// KeepRegistered.
+func (r ClientRegisterResponse) WireguardConfig(privateKey Key) (string, error) {
+	if !privateKey.IsPrivate() {
+		return "", xerrors.New("key must be a private key")
+	}
+
+	var b strings.Builder
+	_, _ = fmt.Fprintln(&b, "# Generated by wgtunnel. Tunnel traffic is forwarded to")
+	_, _ = fmt.Fprintf(&b, "# port %d on the interface address from:\n", TunnelPort)
+	for _, u := range r.TunnelURLs {
+		_, _ = fmt.Fprintf(&b, "#   %s\n", u)
+	}
+	_, _ = fmt.Fprintln(&b)
+	_, _ = fmt.Fprintln(&b, "[Interface]")
+	_, _ = fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	_, _ = fmt.Fprintf(&b, "Address = %s/%d\n", r.ClientIP, r.ClientIP.BitLen())
+	_, _ = fmt.Fprintf(&b, "MTU = %d\n", r.WireguardMTU)
+	_, _ = fmt.Fprintln(&b)
+	_, _ = fmt.Fprintln(&b, "[Peer]")
+	_, _ = fmt.Fprintf(&b, "PublicKey = %s\n", FromNoisePublicKey(r.ServerPublicKey))
+	_, _ = fmt.Fprintf(&b, "Endpoint = %s\n", r.ServerEndpoint)
+	_, _ = fmt.Fprintf(&b, "AllowedIPs = %s/%d\n", r.ServerIP, r.ServerIP.BitLen())
+	_, _ = fmt.Fprintf(&b, "PersistentKeepalive = %d\n", persistentKeepaliveInterval)
+	return b.String(), nil
+}
+
+// KeepRegistered re-registers the client periodically until ctx is done,
+// without creating a wireguard device. res is the response of the initial
+// registration from Register. When the server's registration changes in a way
+// that affects the wireguard interface, onChange is called with the new
+// response and the names of the changed fields, so the caller can update the
+// interface. When ctx is done, the client is deregistered and ctx's error is
+// returned.
+//
+// Registration failures are logged to cfg.Log and reported to
+// cfg.EventHandler like they are for tunnels, and the client keeps retrying.
+func (c *Client) KeepRegistered(ctx context.Context, cfg TunnelConfig, res ClientRegisterResponse, onChange func(res ClientRegisterResponse, changes []string)) error {
+	cfg.Version = res.Version
+
+	timer := time.NewTimer(registrationWait(res))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			deregisterCtx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+			defer cancel()
+			err := c.ClientDeregister(deregisterCtx, cfg.PrivateKey, res.ProofServerPublicKey())
+			if err != nil {
+				cfg.Log.Warn(deregisterCtx, "deregister client", slog.Error(err))
+			}
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		registerCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		next, err := c.registerKey(registerCtx, cfg.Version, cfg.PrivateKey, false)
+		cancel()
+		if ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			cfg.Log.Warn(ctx, "periodically re-register client", slog.Error(err))
+			if cfg.EventHandler != nil {
+				cfg.EventHandler(TunnelEvent{Type: TunnelEventRegisterFailed, Time: time.Now(), Err: err})
+			}
+		} else {
+			changes, _ := registrationChanges(res, next, res.ServerEndpoint, next.ServerEndpoint)
+			res = next
+			if len(changes) > 0 && onChange != nil {
+				onChange(res, changes)
+			}
+		}
+
+		timer.Reset(nextRegistrationWait(next, err))
+	}
+}